@@ -0,0 +1,204 @@
+// Package bayes provides a naive Bayes classifier that tells spam from
+// legitimate submissions ("ham") by the words they contain.
+package bayes
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Classes that documents are trained as
+const (
+	Spam = "spam"
+	Ham  = "ham"
+)
+
+// Limits on the length of words that are used as features
+const (
+	minWordLength = 2
+	maxWordLength = 40
+)
+
+// Model holds the word counts of the documents trained as spam and ham.
+// Safe for parallel use.
+type Model struct {
+	mutex     sync.RWMutex
+	SpamDocs  int64            `json:"spam_docs"`
+	HamDocs   int64            `json:"ham_docs"`
+	SpamWords map[string]int64 `json:"spam"`
+	HamWords  map[string]int64 `json:"ham"`
+	// Total number of words trained as each class
+	spamTotal int64
+	hamTotal  int64
+	// Number of distinct words trained as either class
+	vocab int64
+}
+
+// New returns an empty Model, which classifies everything as equally likely
+// to be spam or ham
+func New() *Model {
+	return &Model{
+		SpamWords: make(map[string]int64),
+		HamWords:  make(map[string]int64)}
+}
+
+// Tokenize splits text into the features used for classification: the
+// lowercase words in it and the hosts of any URLs in it
+func Tokenize(text string) []string {
+	var tokens []string
+	for _, field := range strings.Fields(text) {
+		if u, err := url.Parse(strings.Trim(field, "<>()[]\"'.,")); err == nil &&
+			(u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			tokens = append(tokens, "host:"+strings.ToLower(u.Hostname()))
+		}
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		if n := len([]rune(word)); n >= minWordLength && n <= maxWordLength {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+// FormText returns the text of a form submission that is classified: the
+// values of the given fields or, if fields is nil, of all fields in order of
+// name. Fields in skip and fields starting with "_", such as the time trap,
+// are left out when fields is nil.
+func FormText(form map[string][]string, fields []string, skip map[string]bool) string {
+	if fields == nil {
+		for name := range form {
+			if !skip[name] && !strings.HasPrefix(name, "_") {
+				fields = append(fields, name)
+			}
+		}
+		sort.Strings(fields)
+	}
+
+	var text []string
+	for _, name := range fields {
+		text = append(text, form[name]...)
+	}
+	return strings.Join(text, "\n")
+}
+
+// Train adds the text to the model as a document of the given class, which
+// is either Spam or Ham
+func (m *Model) Train(class string, text string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	counts, total, docs := m.HamWords, &m.hamTotal, &m.HamDocs
+	if class == Spam {
+		counts, total, docs = m.SpamWords, &m.spamTotal, &m.SpamDocs
+	}
+
+	*docs++
+	for _, token := range Tokenize(text) {
+		if m.SpamWords[token] == 0 && m.HamWords[token] == 0 {
+			m.vocab++
+		}
+		counts[token]++
+		*total++
+	}
+}
+
+// SpamProbability returns the probability, between 0 and 1, that the text
+// is spam. An untrained model returns 0.5.
+func (m *Model) SpamProbability(text string) float64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.SpamDocs == 0 || m.HamDocs == 0 {
+		return 0.5
+	}
+
+	// Work with logarithms so that long texts do not underflow, and add one
+	// to every count so that unseen words do not rule out either class
+	docs := float64(m.SpamDocs + m.HamDocs)
+	logSpam := math.Log(float64(m.SpamDocs) / docs)
+	logHam := math.Log(float64(m.HamDocs) / docs)
+	vocab := float64(m.vocab)
+	for _, token := range Tokenize(text) {
+		logSpam += math.Log(float64(m.SpamWords[token]+1) /
+			(float64(m.spamTotal) + vocab))
+		logHam += math.Log(float64(m.HamWords[token]+1) /
+			(float64(m.hamTotal) + vocab))
+	}
+
+	return 1 / (1 + math.Exp(logHam-logSpam))
+}
+
+// countTotals recalculates the total number of words of each class and the
+// number of distinct words after loading a model
+func (m *Model) countTotals() {
+	m.spamTotal, m.hamTotal = 0, 0
+	m.vocab = int64(len(m.SpamWords))
+	for _, n := range m.SpamWords {
+		m.spamTotal += n
+	}
+	for word, n := range m.HamWords {
+		m.hamTotal += n
+		if _, ok := m.SpamWords[word]; !ok {
+			m.vocab++
+		}
+	}
+}
+
+// Load reads a model from the file at the given path
+func Load(path string) (*Model, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := New()
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.SpamWords == nil {
+		m.SpamWords = make(map[string]int64)
+	}
+	if m.HamWords == nil {
+		m.HamWords = make(map[string]int64)
+	}
+	m.countTotals()
+	return m, nil
+}
+
+// Save writes the model to the file at the given path. The file is replaced
+// at once, so a server loading the model never sees a partial file.
+func (m *Model) Save(path string) error {
+	m.mutex.RLock()
+	b, err := json.Marshal(m)
+	m.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,100 @@
+package bayes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens := Tokenize("Buy CHEAP pills at https://Pills.example.com/buy now, a")
+	expected := []string{"host:pills.example.com", "buy", "cheap", "pills",
+		"at", "https", "pills", "example", "com", "buy", "now"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Expected tokens %#v, got %#v", expected, tokens)
+	}
+}
+
+func trainedModel() *Model {
+	m := New()
+	m.Train(Spam, "Buy cheap pills online at https://pills.example.com")
+	m.Train(Spam, "Improve your SEO ranking, cheap backlinks for sale")
+	m.Train(Spam, "Cheap SEO services, buy now")
+	m.Train(Ham, "Hi, I would like to ask about your opening hours")
+	m.Train(Ham, "Could you send me a quote for the garden project?")
+	m.Train(Ham, "Thanks for the quick reply, see you on Monday")
+	return m
+}
+
+func TestModel_SpamProbability(t *testing.T) {
+	if p := New().SpamProbability("anything"); p != 0.5 {
+		t.Errorf("Untrained model should return 0.5, got %f", p)
+	}
+
+	m := trainedModel()
+	if p := m.SpamProbability("Cheap SEO backlinks, buy now!"); p < 0.9 {
+		t.Errorf("Spam should have a high probability, got %f", p)
+	}
+	if p := m.SpamProbability("Can I get a quote for my garden?"); p > 0.5 {
+		t.Errorf("Ham should have a low probability, got %f", p)
+	}
+}
+
+func TestModel_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bayes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := trainedModel()
+	path := filepath.Join(dir, "model.json")
+	if err := m.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text := "Cheap SEO for your garden"
+	if m.SpamProbability(text) != loaded.SpamProbability(text) {
+		t.Errorf("Loaded model should classify like the saved one: %f != %f",
+			m.SpamProbability(text), loaded.SpamProbability(text))
+	}
+}
+
+func TestModel_TrainPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bayes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"export.jsonl":     "{\"message\": \"cheap pills\"}\n\n{\"message\": \"cheap SEO\"}\n",
+		"list.json":        `[{"message": "buy backlinks"}, "buy followers"]`,
+		"quarantined.json": `{"id": "abc", "fields": {"message": ["cheap watches"], "_ts": ["token"]}}`,
+		"message.txt":      "cheap loans",
+		".hidden":          "not trained"}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := New()
+	n, err := m.TrainPath(Spam, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 || m.SpamDocs != 6 {
+		t.Errorf("Expected 6 documents, got %d", n)
+	}
+	if m.SpamWords["cheap"] != 4 || m.SpamWords["abc"] != 0 ||
+		m.SpamWords["token"] != 0 {
+		t.Errorf("Unexpected word counts: %#v", m.SpamWords)
+	}
+}
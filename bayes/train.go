@@ -0,0 +1,136 @@
+package bayes
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxLineSize is the longest line read from a JSON lines export
+const maxLineSize = 1 << 20 // 1 MiB
+
+// jsonText returns all strings in a decoded JSON value, sorted by key in
+// objects. For objects with a "fields" key, such as quarantined submissions,
+// only the text of those fields is used, as chosen by FormText.
+func jsonText(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var text []string
+		for _, item := range val {
+			text = append(text, jsonText(item)...)
+		}
+		return text
+	case map[string]interface{}:
+		if fields, ok := val["fields"].(map[string]interface{}); ok {
+			form := make(map[string][]string, len(fields))
+			for name, values := range fields {
+				form[name] = jsonText(values)
+			}
+			return []string{FormText(form, nil, nil)}
+		}
+		keys := make([]string, 0, len(val))
+		for key := range val {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var text []string
+		for _, key := range keys {
+			text = append(text, jsonText(val[key])...)
+		}
+		return text
+	}
+	return nil
+}
+
+// trainFile trains each document in the file as the given class
+func (m *Model) trainFile(class, path string) (int, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl":
+		// One JSON document per line
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+
+		n := 0
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var v interface{}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				return n, err
+			}
+			m.Train(class, strings.Join(jsonText(v), "\n"))
+			n++
+		}
+		return n, scanner.Err()
+	case ".json":
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		var v interface{}
+		if err = json.Unmarshal(b, &v); err != nil {
+			return 0, err
+		}
+		// A list holds one document per item
+		if list, ok := v.([]interface{}); ok {
+			for _, item := range list {
+				m.Train(class, strings.Join(jsonText(item), "\n"))
+			}
+			return len(list), nil
+		}
+		m.Train(class, strings.Join(jsonText(v), "\n"))
+		return 1, nil
+	default:
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		m.Train(class, string(b))
+		return 1, nil
+	}
+}
+
+// TrainPath trains the documents exported to the given file, or to the files
+// in the given directory, as the given class. Each line of a .jsonl file
+// and each item of a list in a .json file is one document, made up of the
+// strings in it; any other file is one document of plain text. It returns
+// the number of documents trained.
+func (m *Model) TrainPath(class, path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if !info.IsDir() {
+		return m.trainFile(class, path)
+	}
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		n, err := m.trainFile(class, filepath.Join(path, f.Name()))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -1,19 +1,62 @@
 package config
 
 import (
+	"net"
+					"os"
 					"sync"
+	"time"
 
 	"gitlab.com/BluestNight/nebula-forms/handler"
 	l "gitlab.com/BluestNight/nebula-forms/log"
+	"gitlab.com/BluestNight/nebula-forms/queue"
+	"gitlab.com/BluestNight/nebula-forms/ratelimit"
 			"github.com/fsnotify/fsnotify"
 )
 
 // Default values for configuration options go here
 
-// DefaultMaxFileSize is the default value for maximum form upload body
+// DefaultMaxBodySize is the default value for the maximum size of a request
+// body, including all uploaded files
+const DefaultMaxBodySize = int64(10 * 1024 * 1024) // 10 MiB
+// DefaultMaxFileSize is the default value for maximum size of each uploaded
+// file
 const DefaultMaxFileSize = int64(5 * 1024 * 1024) // 5 MiB
+// DefaultMaxFiles is the default value for the maximum number of files
+// uploaded in a single request
+const DefaultMaxFiles = int64(10)
+// DefaultDomain is the domain that holds handlers for requests to domains
+// without their own handlers
+const DefaultDomain = ""
 // DefaultPort is the default port that the server will run at
 const DefaultPort = int64(2002)
+// DefaultQueueWorkers is the default number of queued submissions handled
+// at the same time
+const DefaultQueueWorkers = int64(4)
+// DefaultQueueRetries is the default number of times a queued submission is
+// retried after a server error
+const DefaultQueueRetries = int64(10)
+// DefaultQueueBackoff is the default time to wait before the first retry of a
+// queued submission
+const DefaultQueueBackoff = 30 * time.Second
+// DefaultReadTimeout is the default maximum time to read a whole request,
+// including the body
+const DefaultReadTimeout = time.Minute
+// DefaultReadHeaderTimeout is the default maximum time to read the headers of
+// a request
+const DefaultReadHeaderTimeout = 10 * time.Second
+// DefaultWriteTimeout is the default maximum time from the end of reading the
+// request headers to the end of writing the response. It must be longer than
+// the handler timeout for handlers to be able to respond.
+const DefaultWriteTimeout = 2 * time.Minute
+// DefaultIdleTimeout is the default maximum time to wait for the next request
+// on a keep-alive connection
+const DefaultIdleTimeout = 2 * time.Minute
+// DefaultHandlerTimeout is the default maximum time a handler may take to
+// handle a submission
+const DefaultHandlerTimeout = time.Minute
+// DefaultShutdownTimeout is the default maximum time to wait for requests in
+// progress to finish when shutting down a server
+const DefaultShutdownTimeout = time.Minute
 
 // labels contains the names of configuration options as found in the
 // configuration file. This prevents unnoticed issues due to misspelling
@@ -22,16 +65,36 @@ var (
 	// LabelPort is the label for the value containing the port the
 	// server will run on.
 	LabelPort = "port"
+	// LabelListen is the label for the list of addresses the server listens
+	// on. Entries are either "host:port" (host may be empty for all
+	// interfaces, and IPv6 addresses must be in brackets) or "unix:" followed
+	// by the path to a Unix domain socket. Defaults to all interfaces at the
+	// port set with LabelPort.
+	LabelListen = "listen"
+	// LabelSocketMode is the label for the permissions of Unix domain sockets
+	// created for LabelListen, such as "0660".
+	LabelSocketMode = "socket_mode"
+	// LabelSocketOwner is the label for the owner of Unix domain sockets
+	// created for LabelListen, given as "user" or "user:group".
+	LabelSocketOwner = "socket_owner"
 	// LabelErrorFile is the label for the path to place the error log file.
 	LabelErrorFile = "error_file"
 	// LabelLogFile is the label for the path to place the access log file.
 	LabelLogFile = "log_file"
 	// LabelDebugEnable is the label for whether debugging should be enabled.
 	LabelDebugEnable = "debug"
-	// LabelMaxFileSize is the label for the maximum size of a single request.
-	// This option is currently not respected, at least until I figure out how
-	// to enforce it
+	// LabelMaxBodySize is the label for the maximum size of a single
+	// request body, in bytes. Handlers may override this value. A value of 0
+	// disables the limit.
+	LabelMaxBodySize = "max_body_size"
+	// LabelMaxFileSize is the label for the maximum size of each file uploaded
+	// with a request, in bytes. Handlers may override this value. A value of 0
+	// disables the limit.
 	LabelMaxFileSize = "max_file_size"
+	// LabelMaxFiles is the label for the maximum number of files uploaded
+	// with a single request. Handlers may override this value. A value of 0
+	// disables the limit.
+	LabelMaxFiles = "max_files"
 	// LabelIncludeDir is the label for the *directory* from which to load more
 	// configuration files. It is to be used by functions that load the
 	// configuration file *before* parsing. In this case, by
@@ -40,6 +103,81 @@ var (
 	// LabelPluginDir is the label for the directory in which Nebula can find
 	// and load handler plugins.
 	LabelPluginDir = "plugins_dir"
+	// LabelDomains is the label for the collection of handler groups for
+	// specific domains. Each group has its own LabelHandlers collection,
+	// which handles requests whose Host is that domain. Handlers outside of
+	// any domain group handle requests to all other domains.
+	LabelDomains = "domain"
+	// LabelTLSCert is the label for the path to the PEM-encoded certificate
+	// (chain) to serve over HTTPS. If both this and LabelTLSKey are set, the
+	// server only accepts HTTPS connections.
+	LabelTLSCert = "tls_cert"
+	// LabelTLSKey is the label for the path to the PEM-encoded private key
+	// matching the certificate at LabelTLSCert.
+	LabelTLSKey = "tls_key"
+	// LabelTLSClientCA is the label for the path to a PEM-encoded bundle of
+	// CA certificates. If set, clients must present a certificate signed by
+	// one of these CAs (mutual TLS).
+	LabelTLSClientCA = "tls_client_ca"
+	// LabelAsync is the label for whether submissions should be queued and
+	// handled in the background. Clients get a 202 (Accepted) response as
+	// soon as the submission is stored in the queue.
+	LabelAsync = "async"
+	// LabelDataDir is the label for the directory in which Nebula stores
+	// data, such as the queue of submissions.
+	LabelDataDir = "data_dir"
+	// LabelSecret is the label for the key used to sign values such as time
+	// trap timestamps, form tokens, and proof of work challenges. It is given
+	// to every handler that does not set its own. If not set, a random secret
+	// is generated and stored in the data directory.
+	LabelSecret = "secret"
+	// LabelTrustedProxies is the label for the list of IP addresses and CIDR
+	// ranges of proxies whose forwarding header, set by
+	// LabelForwardedHeader, is trusted to tell the address of the client.
+	LabelTrustedProxies = "trusted_proxies"
+	// LabelForwardedHeader is the label for the header that the trusted
+	// proxies add the client's address to, either ForwardedHeaderXFF (the
+	// default) or ForwardedHeaderForwarded. The other header is ignored,
+	// since proxies usually pass it on from the client unchanged.
+	LabelForwardedHeader = "forwarded_header"
+	// LabelRateLimit is the label for the limit on the rate of submissions
+	// from each client to any path. See handler.LabelRateLimitRequests and
+	// handler.LabelRateLimitPer for its options.
+	LabelRateLimit = "rate_limit"
+	// LabelPathRateLimits is the label for the table of limits on the rate
+	// of submissions from each client, keyed by path.
+	LabelPathRateLimits = "path_rate_limits"
+	// LabelQueueWorkers is the label for the number of queued submissions
+	// handled at the same time.
+	LabelQueueWorkers = "queue_workers"
+	// LabelQueueRetries is the label for the number of times a queued
+	// submission is retried after a server error before giving up.
+	LabelQueueRetries = "queue_max_retries"
+	// LabelQueueBackoff is the label for the time to wait before retrying a
+	// queued submission for the first time. The time doubles for every retry.
+	LabelQueueBackoff = "queue_retry_backoff"
+	// LabelReadTimeout is the label for the maximum time to read a whole
+	// request, including the body. A value of 0 disables the timeout.
+	LabelReadTimeout = "read_timeout"
+	// LabelReadHeaderTimeout is the label for the maximum time to read the
+	// headers of a request. A value of 0 disables the timeout.
+	LabelReadHeaderTimeout = "read_header_timeout"
+	// LabelWriteTimeout is the label for the maximum time from the end of
+	// reading the request headers to the end of writing the response.
+	// A value of 0 disables the timeout.
+	LabelWriteTimeout = "write_timeout"
+	// LabelIdleTimeout is the label for the maximum time to wait for the next
+	// request on a keep-alive connection. A value of 0 disables the timeout.
+	LabelIdleTimeout = "idle_timeout"
+	// LabelHandlerTimeout is the label for the maximum time a handler may take
+	// to handle a submission, after which the client gets a 504 (Gateway
+	// Timeout) response. Handlers may override this value. A value of 0
+	// disables the timeout.
+	LabelHandlerTimeout = "handler_timeout"
+	// LabelShutdownTimeout is the label for the maximum time to wait for
+	// requests in progress to finish when shutting down or replacing the
+	// server.
+	LabelShutdownTimeout = "shutdown_timeout"
 )
 
 // Config represents the parsed server configuration.
@@ -47,33 +185,152 @@ type Config struct {
 	fWatcher    *fsnotify.Watcher
 	RootConfig  string
 	Port        int64
+	Listen      []string
+	SocketMode  os.FileMode
+	SocketOwner string
 	PluginDir   string
 	Logger      *l.Logger
+	DataDir     string
+	Secret      string
+	Async       bool
 	hMutex      sync.RWMutex
-	handlers    map[string][]handler.Handler
+	handlers    map[string]map[string][]handler.Handler
+	hNames      map[string]map[string][]string
+	named       map[string]handler.Handler
 	plugins     map[string]*handler.Plugin
+	queue       *queue.Queue
+	MaxBodySize int64
 	MaxFileSize int64
+	MaxFiles    int64
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	certs       *certReloader
+	// Configuration files added with WatchFile, as opposed to the
+	// directories of TLS files
+	wMutex  sync.Mutex
+	watched map[string]bool
+	// Client addresses and rate limits
+	TrustedProxies  []*net.IPNet
+	ForwardedHeader string
+	RateLimit       *ratelimit.Limiter
+	pathRateLimits  map[string]*ratelimit.Limiter
+	// Timeouts for the server and handlers
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	HandlerTimeout    time.Duration
+	ShutdownTimeout   time.Duration
 }
 
-// AddHandler adds a handler for a given handler path.
+// AddHandler adds a handler for a given handler path in the default domain.
 // Safe for parallel use.
 func (c *Config) AddHandler(path string, h handler.Handler) {
+	c.AddDomainHandler(DefaultDomain, path, "", h)
+}
+
+// AddNamedHandler adds a handler for a given handler path in the default
+// domain, with a name that identifies it across configuration reloads. Only
+// named handlers can handle submissions asynchronously.
+// Safe for parallel use.
+func (c *Config) AddNamedHandler(path string, name string, h handler.Handler) {
+	c.AddDomainHandler(DefaultDomain, path, name, h)
+}
+
+// AddDomainHandler adds a named handler for a given handler path, only
+// handling requests made to the given domain. Use DefaultDomain for handlers
+// of requests to domains without their own handlers. The name may be empty.
+// Safe for parallel use.
+func (c *Config) AddDomainHandler(domain, path, name string, h handler.Handler) {
 	if h != nil && path != "" && path[0] == '/' {
+		domain = normalizeHost(domain)
 		c.hMutex.Lock()
 		if c.handlers == nil {
-			c.handlers = make(map[string][]handler.Handler)
+			c.handlers = make(map[string]map[string][]handler.Handler)
+		}
+		if c.hNames == nil {
+			c.hNames = make(map[string]map[string][]string)
+		}
+		if c.named == nil {
+			c.named = make(map[string]handler.Handler)
+		}
+		if c.handlers[domain] == nil {
+			c.handlers[domain] = make(map[string][]handler.Handler)
+			c.hNames[domain] = make(map[string][]string)
 		}
-		s := c.handlers[path]
+		s := c.handlers[domain][path]
 		s = append(s, h)
-		c.handlers[path] = s
+		c.handlers[domain][path] = s
+		c.hNames[domain][path] = append(c.hNames[domain][path], name)
+		if name != "" {
+			c.named[name] = h
+		}
 		c.hMutex.Unlock()
 	}
 }
 
-// GetHandlers retrieves the list of handlers for a given handler path.
+// GetHandlers retrieves the list of handlers for a given handler path in the
+// default domain.
 // Safe for parallel use.
 func (c *Config) GetHandlers(path string) []handler.Handler {
+	return c.GetDomainHandlers(DefaultDomain, path)
+}
+
+// GetDomainHandlers retrieves the list of handlers for a given handler path in
+// the given domain. Unlike requests to the server, this does not fall back to
+// the default domain.
+// Safe for parallel use.
+func (c *Config) GetDomainHandlers(domain, path string) []handler.Handler {
 	c.hMutex.RLock()
 	defer c.hMutex.RUnlock()
-	return c.handlers[path]
-}
\ No newline at end of file
+	return c.handlers[normalizeHost(domain)][path]
+}
+
+// GetHandlerNames retrieves the names of the handlers for a given handler
+// path in the default domain, in the same order as GetHandlers. Unnamed
+// handlers have an empty name.
+// Safe for parallel use.
+func (c *Config) GetHandlerNames(path string) []string {
+	return c.GetDomainHandlerNames(DefaultDomain, path)
+}
+
+// GetDomainHandlerNames retrieves the names of the handlers for a given
+// handler path in the given domain, in the same order as GetDomainHandlers.
+// Safe for parallel use.
+func (c *Config) GetDomainHandlerNames(domain, path string) []string {
+	c.hMutex.RLock()
+	defer c.hMutex.RUnlock()
+	return c.hNames[normalizeHost(domain)][path]
+}
+
+// Domains returns the domains that have their own handlers. The default
+// domain is included if any handlers were added to it.
+// Safe for parallel use.
+func (c *Config) Domains() []string {
+	c.hMutex.RLock()
+	defer c.hMutex.RUnlock()
+	domains := make([]string, 0, len(c.handlers))
+	for domain := range c.handlers {
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+// GetNamedHandler retrieves the handler with the given name, or nil if no
+// handler has that name.
+// Safe for parallel use.
+func (c *Config) GetNamedHandler(name string) handler.Handler {
+	c.hMutex.RLock()
+	defer c.hMutex.RUnlock()
+	return c.named[name]
+}
+
+// Limits returns the server-wide limits on the size of submissions, which
+// apply to any handler that does not set its own.
+func (c *Config) Limits() handler.Limits {
+	return handler.Limits{
+		MaxBodySize: c.MaxBodySize,
+		MaxFileSize: c.MaxFileSize,
+		MaxFiles:    c.MaxFiles}
+}
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// parseJSONForm decodes a JSON object in the request body into req.PostForm
+// and req.Form, so handlers can read the values the same way they would
+// for any other form. See flattenJSON for how values are converted.
+func parseJSONForm(req *http.Request) error {
+	if req.Body == nil {
+		return errors.New("missing form body")
+	}
+
+	var data interface{}
+	dec := json.NewDecoder(req.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return fmt.Errorf("could not parse JSON body: %s", err)
+	}
+
+	obj, ok := data.(map[string]interface{})
+	if !ok {
+		return errors.New("JSON body must be an object")
+	}
+
+	values := url.Values{}
+	for key, val := range obj {
+		flattenJSON(values, key, val)
+	}
+
+	// Query parameters come after values from the body, like in ParseForm
+	req.PostForm = values
+	req.Form = url.Values{}
+	for key, vals := range values {
+		req.Form[key] = append(req.Form[key], vals...)
+	}
+	for key, vals := range req.URL.Query() {
+		req.Form[key] = append(req.Form[key], vals...)
+	}
+
+	return nil
+}
+
+// flattenJSON adds the decoded JSON value to the form values under the given
+// key. Arrays add one value per element under the same key, and nested
+// objects add their members with their keys joined by dots, so
+// {"address": {"city": "Springfield"}} becomes "address.city". Numbers and
+// booleans are added in their JSON form and null as an empty string.
+func flattenJSON(values url.Values, key string, val interface{}) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, inner := range v {
+			flattenJSON(values, key+"."+k, inner)
+		}
+	case []interface{}:
+		for _, inner := range v {
+			flattenJSON(values, key, inner)
+		}
+	case string:
+		values.Add(key, v)
+	case json.Number:
+		values.Add(key, v.String())
+	case bool:
+		values.Add(key, strconv.FormatBool(v))
+	case nil:
+		values.Add(key, "")
+	}
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+// maxFormMemory is the number of bytes of a multipart form kept in memory
+// while parsing. Uploaded files beyond this are stored in temporary files.
+const maxFormMemory = int64(1 << 20) // 1 MiB
+
+// limitedBody wraps a request body limited with http.MaxBytesReader and
+// records whether reading stopped because the limit was reached, so the
+// error can be told apart from other errors while parsing the form.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	read     int64
+	exceeded bool
+	// raw receives a copy of everything read, if not nil
+	raw *bytes.Buffer
+}
+
+func newLimitedBody(rw http.ResponseWriter, req *http.Request, limit int64) *limitedBody {
+	b := &limitedBody{ReadCloser: req.Body, limit: limit}
+	if limit > 0 {
+		b.ReadCloser = http.MaxBytesReader(rw, req.Body, limit)
+	}
+	return b
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.raw != nil {
+		b.raw.Write(p[:n])
+	}
+	if err != nil && err != io.EOF && b.limit > 0 && b.read >= b.limit {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// maxBodySize returns the largest body size accepted by any of the handlers,
+// or 0 if any of them accepts bodies of any size.
+func maxBodySize(handlers []handler.Handler, def handler.Limits) int64 {
+	var max int64
+	for _, h := range handlers {
+		size := h.Limits().WithDefaults(def).MaxBodySize
+		if size == 0 {
+			return 0
+		}
+		if size > max {
+			max = size
+		}
+	}
+	return max
+}
+
+// bodyTooLarge returns the HTTPError for a request body larger than the
+// given limit
+func bodyTooLarge(limit int64) *e.HTTPError {
+	return e.NewHTTPError(fmt.Sprintf(
+		"Request body is larger than the maximum of %d bytes", limit),
+		http.StatusRequestEntityTooLarge)
+}
+
+// checkLimits checks the parsed request against the given limits, returning
+// an HTTPError with status 413 (Request Entity Too Large) if any are exceeded.
+func checkLimits(req *http.Request, read int64, lim handler.Limits) *e.HTTPError {
+	if lim.MaxBodySize > 0 && read > lim.MaxBodySize {
+		return bodyTooLarge(lim.MaxBodySize)
+	}
+
+	if req.MultipartForm == nil {
+		return nil
+	}
+
+	var count int64
+	for _, files := range req.MultipartForm.File {
+		for _, fh := range files {
+			count++
+			if lim.MaxFileSize > 0 && fh.Size > lim.MaxFileSize {
+				return e.NewHTTPError(fmt.Sprintf(
+					"File %s is larger than the maximum of %d bytes",
+					fh.Filename, lim.MaxFileSize),
+					http.StatusRequestEntityTooLarge)
+			}
+		}
+	}
+
+	if lim.MaxFiles > 0 && count > lim.MaxFiles {
+		return e.NewHTTPError(fmt.Sprintf(
+			"Request contains more than the maximum of %d files",
+			lim.MaxFiles), http.StatusRequestEntityTooLarge)
+	}
+
+	return nil
+}
@@ -0,0 +1,411 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// unixPrefix marks a listen address as the path to a Unix domain socket
+const unixPrefix = "unix:"
+
+// splitListenAddr returns the network and address to pass to net.Listen for
+// an entry in the listen list
+func splitListenAddr(addr string) (string, string, error) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		path := strings.TrimPrefix(addr, unixPrefix)
+		if path == "" {
+			return "", "", fmt.Errorf("missing socket path in \"%s\"", addr)
+		}
+		return "unix", path, nil
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", err
+	}
+	return "tcp", addr, nil
+}
+
+// listenKey returns the address that identifies the socket for an entry in
+// the listen list, so that entries like ":2002" and "0.0.0.0:2002" share a
+// socket instead of the second one failing to bind.
+func listenKey(addr string) string {
+	network, address, err := splitListenAddr(addr)
+	if err != nil {
+		return addr
+	}
+	if network == "unix" {
+		return unixPrefix + filepath.Clean(address)
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr(network, address)
+	// Port 0 picks a random port, so there is no socket to share
+	if err != nil || tcpAddr.Port == 0 {
+		return addr
+	}
+	port := strconv.Itoa(tcpAddr.Port)
+	if tcpAddr.IP == nil || tcpAddr.IP.IsUnspecified() {
+		return ":" + port
+	}
+	return net.JoinHostPort(tcpAddr.IP.String(), port)
+}
+
+func (c *Config) unmarshalListen(data map[string]interface{}) error {
+	addrs, err := parse.SliceOrNil(data[LabelListen])
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelListen, err)
+	}
+
+	c.Listen = nil
+	for _, a := range addrs {
+		addr, err := parse.String(a)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelListen, err)
+		}
+		if _, _, err = splitListenAddr(addr); err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelListen, err)
+		}
+		c.Listen = append(c.Listen, addr)
+	}
+
+	// Listen on all interfaces at the configured port by default
+	if len(c.Listen) == 0 {
+		c.Listen = []string{fmt.Sprintf(":%d", c.Port)}
+	}
+
+	// Socket mode may be given as an octal string or a number
+	switch mode := data[LabelSocketMode].(type) {
+	case nil:
+		c.SocketMode = 0
+	case string:
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelSocketMode, err)
+		}
+		c.SocketMode = os.FileMode(m)
+	default:
+		m, err := parse.Int64(mode)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelSocketMode, err)
+		}
+		c.SocketMode = os.FileMode(m)
+	}
+	if c.SocketMode&^os.ModePerm != 0 {
+		return fmt.Errorf(e.ErrConfigItem, LabelSocketMode,
+			"only permission bits may be set")
+	}
+
+	c.SocketOwner, err = parse.StringOrDefault(data[LabelSocketOwner], "")
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelSocketOwner, err)
+	}
+	if _, _, err = lookupOwner(c.SocketOwner); err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelSocketOwner, err)
+	}
+
+	return nil
+}
+
+// lookupOwner returns the user and group IDs for an owner given as "user" or
+// "user:group", where both may be names or numeric IDs. A value of -1 means
+// the ID should not be changed.
+func lookupOwner(owner string) (int, int, error) {
+	uid, gid := -1, -1
+	if owner == "" {
+		return uid, gid, nil
+	}
+
+	parts := strings.SplitN(owner, ":", 2)
+	if parts[0] != "" {
+		id := parts[0]
+		if _, err := strconv.Atoi(id); err != nil {
+			u, err := user.Lookup(id)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = u.Uid
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+
+	if len(parts) == 2 && parts[1] != "" {
+		id := parts[1]
+		if _, err := strconv.Atoi(id); err != nil {
+			g, err := user.LookupGroup(id)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = g.Gid
+		}
+		gid, _ = strconv.Atoi(id)
+	}
+
+	return uid, gid, nil
+}
+
+// listenUnix creates a Unix domain socket at the given path, replacing a
+// stale socket left behind by a previous run, and applies the configured
+// mode and owner.
+func (c *Config) listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err = os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.setSocketPermissions(path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// setSocketPermissions applies the configured mode and owner to the Unix
+// domain socket at the given path
+func (c *Config) setSocketPermissions(path string) error {
+	if c.SocketMode != 0 {
+		if err := os.Chmod(path, c.SocketMode); err != nil {
+			return err
+		}
+	}
+
+	uid, gid, err := lookupOwner(c.SocketOwner)
+	if err == nil && (uid != -1 || gid != -1) {
+		err = os.Lchown(path, uid, gid)
+	}
+	return err
+}
+
+// listen opens a listener for a single entry in the listen list
+func (c *Config) listen(addr string) (net.Listener, error) {
+	network, address, err := splitListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		return c.listenUnix(address)
+	}
+	return net.Listen(network, address)
+}
+
+// errViewClosed is returned from Accept on a listener view after the server
+// using it has been shut down
+var errViewClosed = errors.New("listener closed")
+
+// sharedListener owns an open socket and hands accepted connections to
+// whichever listener views are currently accepting. This lets the socket
+// outlive the server using it.
+type sharedListener struct {
+	net.Listener
+	addr    string
+	conns   chan net.Conn
+	closing chan struct{}
+	done    chan struct{}
+	err     error
+}
+
+func newSharedListener(addr string, ln net.Listener) *sharedListener {
+	l := &sharedListener{
+		Listener: ln,
+		addr:     addr,
+		conns:    make(chan net.Conn),
+		closing:  make(chan struct{}),
+		done:     make(chan struct{})}
+	go l.run()
+	return l
+}
+
+// run accepts connections on the socket until it is closed. Connections are
+// only accepted as fast as views take them, so connections arriving while
+// no server is accepting wait in the socket's backlog.
+func (l *sharedListener) run() {
+	defer close(l.done)
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// Back off on temporary errors, like net/http does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			l.err = err
+			return
+		}
+		delay = 0
+
+		select {
+		case l.conns <- conn:
+		case <-l.closing:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// close closes the socket and waits for the accept loop to exit
+func (l *sharedListener) close() error {
+	close(l.closing)
+	err := l.Listener.Close()
+	<-l.done
+	return err
+}
+
+// view returns a new listener that takes connections from the shared
+// socket. Closing the view does not close the socket.
+func (l *sharedListener) view() net.Listener {
+	return &listenerView{shared: l, closed: make(chan struct{})}
+}
+
+// listenerView is the net.Listener given to a single server
+type listenerView struct {
+	shared *sharedListener
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (v *listenerView) Accept() (net.Conn, error) {
+	// Prefer reporting the view as closed over taking a new connection
+	select {
+	case <-v.closed:
+		return nil, errViewClosed
+	default:
+	}
+
+	select {
+	case conn := <-v.shared.conns:
+		return conn, nil
+	case <-v.closed:
+		return nil, errViewClosed
+	case <-v.shared.done:
+		return nil, v.shared.err
+	}
+}
+
+func (v *listenerView) Close() error {
+	v.once.Do(func() { close(v.closed) })
+	return nil
+}
+
+func (v *listenerView) Addr() net.Addr {
+	return v.shared.Addr()
+}
+
+// ListenerSet keeps the sockets the server listens on open across
+// configuration reloads. Each server gets its own listeners from Listen, so
+// a new server can start accepting on the same sockets before the old one is
+// shut down, and shutting the old one down does not close the sockets.
+type ListenerSet struct {
+	mutex     sync.Mutex
+	listeners map[string]*sharedListener
+}
+
+// Listen returns listeners for every address in the configuration's listen
+// list, reusing sockets that are already open and opening any new ones.
+// Sockets for addresses that are no longer listed stay open until Prune is
+// called. If any socket fails to open, those opened by this call are closed
+// and the set is left unchanged.
+func (s *ListenerSet) Listen(c *Config) ([]net.Listener, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.listeners == nil {
+		s.listeners = make(map[string]*sharedListener)
+	}
+
+	var opened []*sharedListener
+	var views []net.Listener
+	for _, addr := range c.Listen {
+		key := listenKey(addr)
+		l, ok := s.listeners[key]
+		for _, o := range opened {
+			if o.addr == key {
+				l, ok = o, true
+			}
+		}
+		if ok {
+			// Reused sockets still get the new configuration's permissions
+			if network, path, _ := splitListenAddr(addr); network == "unix" {
+				if err := c.setSocketPermissions(path); err != nil {
+					s.closeAll(opened)
+					return nil, fmt.Errorf("could not listen on %s: %s", addr, err)
+				}
+			}
+		} else {
+			ln, err := c.listen(addr)
+			if err != nil {
+				s.closeAll(opened)
+				return nil, fmt.Errorf("could not listen on %s: %s", addr, err)
+			}
+			l = newSharedListener(key, ln)
+			opened = append(opened, l)
+		}
+		views = append(views, l.view())
+	}
+
+	for _, l := range opened {
+		s.listeners[l.addr] = l
+	}
+
+	return views, nil
+}
+
+func (s *ListenerSet) closeAll(listeners []*sharedListener) {
+	for _, l := range listeners {
+		l.close()
+	}
+}
+
+// Prune closes the sockets for any addresses not in the configuration's
+// listen list. Call it once servers using an older configuration have been
+// shut down.
+func (s *ListenerSet) Prune(c *Config) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keep := make(map[string]bool, len(c.Listen))
+	for _, addr := range c.Listen {
+		keep[listenKey(addr)] = true
+	}
+
+	var err error
+	for addr, l := range s.listeners {
+		if !keep[addr] {
+			if cErr := l.close(); cErr != nil && err == nil {
+				err = cErr
+			}
+			delete(s.listeners, addr)
+		}
+	}
+	return err
+}
+
+// Close closes all sockets in the set
+func (s *ListenerSet) Close() error {
+	return s.Prune(&Config{})
+}
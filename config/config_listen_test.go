@@ -0,0 +1,182 @@
+package config
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnmarshalListen(t *testing.T) {
+	c := &Config{Port: 2002}
+	if err := c.unmarshalListen(map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listen) != 1 || c.Listen[0] != ":2002" {
+		t.Errorf("Expected default listen address \":2002\", got %v", c.Listen)
+	}
+
+	err := c.unmarshalListen(map[string]interface{}{
+		LabelListen:     []interface{}{"127.0.0.1:8080", "[::1]:8080", "unix:/run/forms.sock"},
+		LabelSocketMode: "0660"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Listen) != 3 {
+		t.Errorf("Expected 3 listen addresses, got %v", c.Listen)
+	}
+	if c.SocketMode != 0660 {
+		t.Errorf("Expected socket mode 0660, got %o", c.SocketMode)
+	}
+
+	for _, bad := range []interface{}{"localhost", "unix:", 8080} {
+		err = c.unmarshalListen(map[string]interface{}{
+			LabelListen: []interface{}{bad}})
+		if err == nil {
+			t.Errorf("Expected error for listen address %v", bad)
+		}
+	}
+
+	err = c.unmarshalListen(map[string]interface{}{LabelSocketMode: "4755"})
+	if err == nil {
+		t.Error("Expected error for socket mode with setuid bit")
+	}
+}
+
+func TestListenerSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-forms-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "forms.sock")
+	// Leave a stale socket behind like a crashed server would
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	set := &ListenerSet{}
+	defer set.Close()
+
+	c := &Config{
+		Listen:     []string{"127.0.0.1:0", "unix:" + sock},
+		SocketMode: 0600}
+	old, err := set.Listen(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 {
+		t.Fatalf("Expected 2 listeners, got %d", len(old))
+	}
+
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModePerm != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", fi.Mode()&os.ModePerm)
+	}
+
+	// Reloading with the same addresses reuses the sockets, and closing the
+	// old server's listeners leaves them open for the new one
+	c.SocketMode = 0660
+	next, err := set.Listen(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ln := range old {
+		ln.Close()
+		if _, err = ln.Accept(); err == nil {
+			t.Error("Expected error accepting on closed listener")
+		}
+	}
+
+	fi, err = os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModePerm != 0660 {
+		t.Errorf("Expected socket mode 0660, got %o", fi.Mode()&os.ModePerm)
+	}
+
+	for _, ln := range next {
+		accepted := make(chan error, 1)
+		go func(ln net.Listener) {
+			conn, err := ln.Accept()
+			if err == nil {
+				conn.Close()
+			}
+			accepted <- err
+		}(ln)
+
+		conn, err := net.Dial(ln.Addr().Network(), ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if err = <-accepted; err != nil {
+			t.Errorf("Error accepting on %s: %s", ln.Addr(), err)
+		}
+	}
+
+	// Dropping an address closes its socket once pruned
+	c.Listen = c.Listen[:1]
+	if _, err = set.Listen(c); err != nil {
+		t.Fatal(err)
+	}
+	if err = set.Prune(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed, got %v", err)
+	}
+
+	// A failed address leaves the set unchanged
+	file := filepath.Join(dir, "regular")
+	if err = ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Listen = append(c.Listen, "unix:"+file)
+	if _, err = set.Listen(c); err == nil {
+		t.Error("Expected error when socket path is a regular file")
+	}
+	if len(set.listeners) != 1 {
+		t.Errorf("Expected 1 open socket, got %d", len(set.listeners))
+	}
+}
+
+func TestListenerSetSharesEquivalentAddresses(t *testing.T) {
+	// Find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	set := &ListenerSet{}
+	defer set.Close()
+
+	c := &Config{Listen: []string{":" + port}}
+	if _, err = set.Listen(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same socket is reused for an equivalent address, instead of
+	// failing because the port is in use
+	c.Listen = []string{"0.0.0.0:" + port}
+	if _, err = set.Listen(c); err != nil {
+		t.Fatal(err)
+	}
+	if err = set.Prune(c); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.listeners) != 1 {
+		t.Errorf("Expected 1 open socket, got %d", len(set.listeners))
+	}
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -11,9 +12,9 @@ import (
 	"gitlab.com/BluestNight/nebula-forms/handler"
 	"gitlab.com/Shadow53/merge-config/merge"
 	l "gitlab.com/BluestNight/nebula-forms/log"
+	"gitlab.com/BluestNight/nebula-forms/rpcplugin"
 	"github.com/BurntSushi/toml"
 	"github.com/Shadow53/interparser/parse"
-	"github.com/fsnotify/fsnotify"
 	"sync"
 	"os"
 	"path"
@@ -67,57 +68,185 @@ func (c *Config) unmarshalLoggers(data map[string]interface{}) error {
 	return nil
 }
 
-func (c *Config) unmarshalHandlers(data map[string]interface{}) error {
-	// Actual handlers
-	// Checking for nil because configuration files can be partial
-	if data[handler.LabelHandlers] != nil {
-		handlerMap, err := parse.MapStringKeys(data[handler.LabelHandlers])
-		for plugin, conf := range handlerMap {
-			// Load plugin first
-			plugPath := filepath.Join(c.PluginDir, plugin + ".so")
-			// Attempt to load plugin into map, return error if occurs
-			c.plugins[plugin], err = handler.LoadPlugin(plugPath)
-			if err != nil {
-				return fmt.Errorf("could not load plugin %s: %s", plugin, err)
-			}
+// loadPlugin loads the plugin with the given name and configures it, unless
+// it was already loaded. Handler types registered with handler.Register are
+// used first. Otherwise, the plugin is loaded from the plugins directory:
+// plugins built with Go's plugin package end in .so, while plugins running
+// as separate processes are executables without an extension.
+func (c *Config) loadPlugin(plugin string, data map[string]interface{}) error {
+	if c.plugins[plugin] != nil {
+		return nil
+	}
 
-			// Run Configure on the plugin before creating handlers
-			if data[plugin] != nil {
-				err = c.plugins[plugin].Configure(data[plugin])
-				if err != nil {
-					return fmt.Errorf(e.ErrConfigItem, plugin, err)
+	// Load plugin first
+	p, builtin := handler.Registered(plugin)
+	var err error
+	plugPath := filepath.Join(c.PluginDir, plugin)
+	if builtin {
+		c.Logger.Debugf("Using built-in handler type %s", plugin)
+	} else if _, statErr := os.Stat(plugPath + ".so"); statErr != nil &&
+		rpcplugin.IsPlugin(plugPath) {
+		c.Logger.Debugf("Starting plugin %s as a separate process", plugPath)
+		p, err = rpcplugin.Load(plugPath, c.Logger)
+	} else {
+		p, err = handler.LoadPlugin(plugPath + ".so")
+	}
+	if err != nil {
+		return fmt.Errorf("could not load plugin %s: %s", plugin, err)
+	}
+	if p.Metadata.Version != "" {
+		c.Logger.Debugf("Loaded plugin %s version %s", plugin, p.Metadata.Version)
+	}
+	// Stored before configuring so that it is closed with the others
+	// if configuring fails
+	c.plugins[plugin] = p
+
+	// Run Configure on the plugin before creating handlers
+	if data[plugin] != nil {
+		err = p.Configure(data[plugin])
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, plugin, err)
+		}
+	}
+
+	return nil
+}
+
+// Shutdown releases the resources of the handlers created by this
+// configuration, and then of the plugins it loaded, such as stopping plugins
+// that run as separate processes. Handlers and plugins that have a Shutdown
+// hook have until the context is done to finish work in progress; others
+// are closed. Call it once the configuration's handlers are no longer used,
+// that is after the server using it has shut down.
+func (c *Config) Shutdown(ctx context.Context) error {
+	var errs []string
+	c.hMutex.RLock()
+	for domain, paths := range c.handlers {
+		for path, handlers := range paths {
+			for i, h := range handlers {
+				name := c.hNames[domain][path][i]
+				if name == "" {
+					name = domain + path
 				}
+				if err := handler.Shutdown(ctx, h); err != nil {
+					errs = append(errs, fmt.Sprintf("handler %s: %s", name, err))
+				}
+			}
+		}
+	}
+	c.hMutex.RUnlock()
+
+	for name, p := range c.plugins {
+		if err := handler.Shutdown(ctx, p); err != nil {
+			errs = append(errs, fmt.Sprintf("plugin %s: %s", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not shut down: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// unmarshalHandlerGroup creates the handlers in the given handler collection
+// and adds them to the given domain. It returns the number of handlers added.
+func (c *Config) unmarshalHandlerGroup(domain string, conf interface{},
+	data map[string]interface{}) (int, error) {
+	handlerMap, err := parse.MapStringKeys(conf)
+	if err != nil {
+		return 0, fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers, err)
+	}
+
+	// Handlers in a domain group are named after the domain too, so
+	// they stay distinct from handlers with the same name elsewhere
+	prefix := ""
+	if domain != DefaultDomain {
+		prefix = domain + "/"
+	}
+
+	count := 0
+	for plugin, conf := range handlerMap {
+		if err = c.loadPlugin(plugin, data); err != nil {
+			return 0, err
+		}
+
+		hMap, err := parse.MapStringKeys(conf)
+		if err != nil {
+			return 0, fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
+				fmt.Sprintf(e.ErrConfigItem, plugin, err))
+		}
+		for hName, hConf := range hMap {
+			hConfMap, err := parse.MapStringKeys(hConf)
+			if err != nil {
+				return 0, fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
+					fmt.Sprintf(e.ErrConfigItem, plugin,
+						fmt.Sprintf(e.ErrConfigItem, hName, err)))
 			}
-			hMap, err := parse.MapStringKeys(conf)
+			hPath, err := parse.String(hConfMap[handler.LabelHandlerPath])
 			if err != nil {
-				return fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
-					fmt.Sprintf(e.ErrConfigItem, plugin, err))
+				return 0, fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
+					fmt.Sprintf(e.ErrConfigItem, plugin,
+						fmt.Sprintf(e.ErrConfigItem, hName, err)))
 			}
-			for hName, hConf := range hMap {
-				hConfMap, err := parse.MapStringKeys(hConf)
-				if err != nil {
-					return fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
-						fmt.Sprintf(e.ErrConfigItem, plugin,
-							fmt.Sprintf(e.ErrConfigItem, hName, err)))
-				}
-				hPath, err := parse.String(hConfMap[handler.LabelHandlerPath])
-				if err != nil {
-					return fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
-						fmt.Sprintf(e.ErrConfigItem, plugin,
-							fmt.Sprintf(e.ErrConfigItem, hName, err)))
-				}
-				h, err := c.plugins[plugin].NewHandler(hConf)
-				if err != nil {
-					return fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
-						fmt.Sprintf(e.ErrConfigItem, plugin,
-							fmt.Sprintf(e.ErrConfigItem, hName, err)))
-				}
-				c.AddHandler(hPath, h)
-				c.Logger.Debugf("Registered handler for \"%s\" named %s",
-					hPath, hName)
+			// Handlers sign values with the server's secret by default
+			if hConfMap[handler.LabelSecret] == nil {
+				hConfMap[handler.LabelSecret] = c.Secret
 			}
+			h, err := c.plugins[plugin].NewHandler(hConfMap)
+			if err != nil {
+				return 0, fmt.Errorf(e.ErrConfigItem, handler.LabelHandlers,
+					fmt.Sprintf(e.ErrConfigItem, plugin,
+						fmt.Sprintf(e.ErrConfigItem, hName, err)))
+			}
+			c.AddDomainHandler(domain, hPath, prefix+plugin+"."+hName, h)
+			c.Logger.Debugf("Registered handler for \"%s%s\" named %s",
+				domain, hPath, hName)
+			count++
 		}
-	} else {
+	}
+
+	return count, nil
+}
+
+func (c *Config) unmarshalHandlers(data map[string]interface{}) error {
+	count := 0
+
+	// Actual handlers
+	// Checking for nil because configuration files can be partial
+	if data[handler.LabelHandlers] != nil {
+		n, err := c.unmarshalHandlerGroup(DefaultDomain,
+			data[handler.LabelHandlers], data)
+		if err != nil {
+			return err
+		}
+		count += n
+	}
+
+	// Handlers for specific domains
+	domains, err := parse.MapStringKeysOrNew(data[LabelDomains])
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelDomains, err)
+	}
+	for domain, dConf := range domains {
+		name := normalizeHost(domain)
+		if name == DefaultDomain {
+			return fmt.Errorf(e.ErrConfigItem, LabelDomains,
+				"domain names cannot be empty")
+		}
+
+		d, err := parse.MapStringKeys(dConf)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelDomains,
+				fmt.Sprintf(e.ErrConfigItem, domain, err))
+		}
+		n, err := c.unmarshalHandlerGroup(name, d[handler.LabelHandlers], data)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelDomains,
+				fmt.Sprintf(e.ErrConfigItem, domain, err))
+		}
+		count += n
+	}
+
+	if count == 0 {
 		return errors.New("at least one handler should be configured for this server")
 	}
 	return nil
@@ -135,13 +264,16 @@ func (c *Config) unmarshalHandlers(data map[string]interface{}) error {
 func (c *Config) Unmarshal(conf interface{}) (err error) {
 	// Prepare the *Config - i.e. reset
 	c.plugins = make(map[string]*handler.Plugin)
-	c.handlers = make(map[string][]handler.Handler)
+	c.handlers = make(map[string]map[string][]handler.Handler)
+	c.hNames = make(map[string]map[string][]string)
+	c.named = make(map[string]handler.Handler)
+	c.queue = nil
 	c.Logger = &l.Logger{}
 	c.hMutex = sync.RWMutex{}
-	c.fWatcher, err = fsnotify.NewWatcher()
-	if err != nil {
-		return err
-	}
+	// The watcher is created by WatchFile, which also starts the goroutine
+	// that listens for its events
+	c.fWatcher = nil
+	c.watched = nil
 
 	// Parse configuration as map
 	data, err := parse.MapStringKeys(conf)
@@ -157,6 +289,16 @@ func (c *Config) Unmarshal(conf interface{}) (err error) {
 	// We have a non-nil map - parse it for values
 
 	// Try to parse the value
+	c.MaxBodySize, err = parse.Int64OrDefault(data[LabelMaxBodySize], DefaultMaxBodySize)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelMaxBodySize, err)
+	}
+
+	// Check that parsed MaxBodySize is valid
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("%s must be non-negative", LabelMaxBodySize)
+	}
+
 	c.MaxFileSize, err = parse.Int64OrDefault(data[LabelMaxFileSize], DefaultMaxFileSize)
 	if err != nil {
 		return fmt.Errorf(e.ErrConfigItem, LabelMaxFileSize, err)
@@ -167,12 +309,26 @@ func (c *Config) Unmarshal(conf interface{}) (err error) {
 		return fmt.Errorf("%s must be non-negative", LabelMaxFileSize)
 	}
 
+	c.MaxFiles, err = parse.Int64OrDefault(data[LabelMaxFiles], DefaultMaxFiles)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelMaxFiles, err)
+	}
+
+	// Check that parsed MaxFiles is valid
+	if c.MaxFiles < 0 {
+		return fmt.Errorf("%s must be non-negative", LabelMaxFiles)
+	}
+
 	// Port
 	c.Port, err = parse.Int64OrDefault(data[LabelPort], DefaultPort)
 	if err != nil {
 		return fmt.Errorf(e.ErrConfigItem, LabelPort, err)
 	}
 
+	if err = c.unmarshalListen(data); err != nil {
+		return err
+	}
+
 	// Plugins directory - required or else won't know where to load from
 	c.PluginDir, err = parse.StringOrDefault(data[LabelPluginDir], DefaultPluginDir)
 	if err != nil {
@@ -183,6 +339,30 @@ func (c *Config) Unmarshal(conf interface{}) (err error) {
 		return err
 	}
 
+	if err = c.unmarshalTLS(data); err != nil {
+		return err
+	}
+
+	if err = c.unmarshalQueue(data); err != nil {
+		return err
+	}
+
+	if err = c.unmarshalTimeouts(data); err != nil {
+		return err
+	}
+
+	if err = c.unmarshalSecret(data); err != nil {
+		return err
+	}
+
+	if err = c.unmarshalTrustedProxies(data); err != nil {
+		return err
+	}
+
+	if err = c.unmarshalRateLimits(data); err != nil {
+		return err
+	}
+
 	return c.unmarshalHandlers(data)
 }
 
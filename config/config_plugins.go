@@ -0,0 +1,115 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	l "gitlab.com/BluestNight/nebula-forms/log"
+	"gitlab.com/BluestNight/nebula-forms/rpcplugin"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Kinds of handler types listed by ListPlugins
+const (
+	PluginBuiltIn = "built-in"
+	PluginShared  = "shared object"
+	PluginProcess = "process"
+)
+
+// PluginInfo describes a handler type found by ListPlugins
+type PluginInfo struct {
+	Name string
+	Kind string
+	// Path is the plugin's file, or empty for built-in handler types
+	Path     string
+	Metadata handler.Metadata
+	// Err is why the handler type cannot be used, if it cannot
+	Err error
+}
+
+// PluginDirFromTOMLFile returns the plugins directory set in the TOML file at
+// the given path, or DefaultPluginDir if it is not set, without parsing the
+// rest of the configuration.
+func PluginDirFromTOMLFile(filename string) (string, error) {
+	conf, _, err := (&Config{}).tomlInner(filename)
+	if err != nil {
+		return "", err
+	}
+
+	dir, err := parse.StringOrDefault(conf[LabelPluginDir], DefaultPluginDir)
+	if err != nil {
+		return "", fmt.Errorf(e.ErrConfigItem, LabelPluginDir, err)
+	}
+	return dir, nil
+}
+
+// ListPlugins returns the built-in handler types followed by the plugins in
+// the given directory. Each plugin is loaded to read its metadata and check
+// that it is compatible with this server; plugins running as separate
+// processes are started and stopped again. Errors loading a plugin are
+// reported in its PluginInfo, with the same precedence as when loading the
+// configuration.
+func ListPlugins(dir string, logger *l.Logger) ([]PluginInfo, error) {
+	var plugins []PluginInfo
+	builtin := make(map[string]bool)
+	for _, name := range handler.RegisteredNames() {
+		p, _ := handler.Registered(name)
+		plugins = append(plugins, PluginInfo{Name: name, Kind: PluginBuiltIn,
+			Metadata: p.Metadata})
+		builtin[name] = true
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return plugins, err
+	}
+
+	shared := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".so") {
+			shared[strings.TrimSuffix(file.Name(), ".so")] = true
+		}
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name())
+		info := PluginInfo{Name: strings.TrimSuffix(file.Name(), ".so"),
+			Path: path}
+
+		var p *handler.Plugin
+		if strings.HasSuffix(file.Name(), ".so") {
+			info.Kind = PluginShared
+			p, info.Err = handler.LoadPlugin(path)
+		} else if rpcplugin.IsPlugin(path) {
+			info.Kind = PluginProcess
+			if shared[info.Name] {
+				info.Err = fmt.Errorf("ignored in favor of %s.so", info.Name)
+			} else {
+				p, info.Err = rpcplugin.Load(path, logger)
+			}
+		} else {
+			// Not a plugin
+			continue
+		}
+
+		if p != nil {
+			info.Metadata = p.Metadata
+			err := handler.Shutdown(context.Background(), p)
+			if err != nil {
+				logger.Errorf("Error while closing plugin %s: %s\n", path, err)
+			}
+		}
+		if info.Err == nil && builtin[info.Name] {
+			info.Err = fmt.Errorf("ignored in favor of the built-in handler type")
+		}
+		plugins = append(plugins, info)
+	}
+
+	return plugins, nil
+}
+
@@ -0,0 +1,103 @@
+package config
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	l "gitlab.com/BluestNight/nebula-forms/log"
+)
+
+func TestListPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	handler.Register("test-listed", handler.Factory{
+		NewHandler: func(interface{}) (handler.Handler, error) { return nil, nil },
+		Metadata:   handler.Metadata{Version: "2.0.0"}})
+
+	// Neither is a working plugin, but only the shared object is listed
+	files := map[string]os.FileMode{"broken.so": 0644, "README": 0644}
+	for name, mode := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil, mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	plugins, err := ListPlugins(dir, &l.Logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[string]PluginInfo)
+	for _, p := range plugins {
+		found[p.Name] = p
+	}
+	if p := found["test-listed"]; p.Kind != PluginBuiltIn ||
+		p.Metadata.Version != "2.0.0" || p.Err != nil {
+		t.Errorf("Unexpected listing of built-in handler type: %#v", p)
+	}
+	if p := found["broken"]; p.Kind != PluginShared || p.Err == nil {
+		t.Errorf("Broken plugin should be listed with an error, got %#v", p)
+	}
+	if _, ok := found["README"]; ok {
+		t.Error("Files that are not plugins should not be listed")
+	}
+}
+
+// closingHandler records whether its Close or Shutdown hook was called
+type closingHandler struct {
+	testHandler
+	closed bool
+}
+
+func (h *closingHandler) Close() error {
+	h.closed = true
+	return nil
+}
+
+type shutdownHandler struct {
+	closingHandler
+	deadline bool
+}
+
+func (h *shutdownHandler) Shutdown(ctx context.Context) error {
+	_, h.deadline = ctx.Deadline()
+	return nil
+}
+
+func TestConfig_Shutdown(t *testing.T) {
+	closing := &closingHandler{}
+	shutdown := &shutdownHandler{}
+	c := testConfig(handler.Limits{}, closing, shutdown, newTestHandler(t, nil))
+
+	pluginClosed := false
+	c.plugins = map[string]*handler.Plugin{"test": {
+		Close: func() error {
+			pluginClosed = true
+			return nil
+		}}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !closing.closed {
+		t.Error("Handler should have been closed")
+	}
+	if shutdown.closed || !shutdown.deadline {
+		t.Error("Handler should have been shut down with the context, not closed")
+	}
+	if !pluginClosed {
+		t.Error("Plugin should have been closed")
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Headers that trusted proxies may add the client's address to
+const (
+	ForwardedHeaderXFF       = "x-forwarded-for"
+	ForwardedHeaderForwarded = "forwarded"
+)
+
+// parseTrustedProxy parses a CIDR range or single IP address
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if strings.Contains(proxy, "/") {
+		_, ipNet, err := net.ParseCIDR(proxy)
+		return ipNet, err
+	}
+
+	ip := net.ParseIP(proxy)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address or CIDR range: %s", proxy)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func (c *Config) unmarshalTrustedProxies(data map[string]interface{}) error {
+	proxies, err := parse.SliceOrNil(data[LabelTrustedProxies])
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelTrustedProxies, err)
+	}
+
+	c.TrustedProxies = nil
+	for _, p := range proxies {
+		proxy, err := parse.String(p)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelTrustedProxies, err)
+		}
+		ipNet, err := parseTrustedProxy(proxy)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, LabelTrustedProxies, err)
+		}
+		c.TrustedProxies = append(c.TrustedProxies, ipNet)
+	}
+
+	c.ForwardedHeader, err = parse.StringOrDefault(data[LabelForwardedHeader],
+		ForwardedHeaderXFF)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelForwardedHeader, err)
+	}
+	c.ForwardedHeader = strings.ToLower(c.ForwardedHeader)
+	if c.ForwardedHeader != ForwardedHeaderXFF &&
+		c.ForwardedHeader != ForwardedHeaderForwarded {
+		return fmt.Errorf(e.ErrConfigItem, LabelForwardedHeader, fmt.Sprintf(
+			"must be \"%s\" or \"%s\"", ForwardedHeaderXFF,
+			ForwardedHeaderForwarded))
+	}
+
+	return nil
+}
+
+// trusted returns whether the IP address belongs to a trusted proxy
+func (c *Config) trusted(ip net.IP) bool {
+	for _, ipNet := range c.TrustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop parses an address from a forwarding header, which may have a
+// port and, in the Forwarded header, quotes and brackets around IPv6
+// addresses
+func parseHop(hop string) net.IP {
+	hop = strings.Trim(strings.TrimSpace(hop), "\"")
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	hop = strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")
+	return net.ParseIP(hop)
+}
+
+// forwardedFor returns the addresses in the given forwarding header of the
+// request, from the client to the last proxy
+func forwardedFor(req *http.Request, header string) []string {
+	var hops []string
+	if header == ForwardedHeaderForwarded {
+		fwd := req.Header["Forwarded"]
+		for _, element := range strings.Split(strings.Join(fwd, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.ToLower(kv[0]) == "for" {
+					hops = append(hops, kv[1])
+				}
+			}
+		}
+		return hops
+	}
+
+	for _, xff := range req.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(xff, ",")...)
+	}
+	return hops
+}
+
+// clientIP returns the IP address of the client that made the request. If
+// the request came from a trusted proxy, the configured forwarding header is
+// followed back to the first address that is not a trusted proxy.
+func (c *Config) clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !c.trusted(ip) {
+		return host
+	}
+
+	hops := forwardedFor(req, c.ForwardedHeader)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// An obfuscated or invalid address, so the last known one
+			// is the closest to the client that can be told
+			break
+		}
+		ip = hop
+		if !c.trusted(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	c := &Config{}
+	err := c.unmarshalTrustedProxies(map[string]interface{}{
+		LabelTrustedProxies: []interface{}{"10.0.0.0/8", "2001:db8::1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.ForwardedHeader != ForwardedHeaderXFF {
+		t.Errorf("Expected %s by default, got %s", ForwardedHeaderXFF,
+			c.ForwardedHeader)
+	}
+
+	xff, fwd := ForwardedHeaderXFF, ForwardedHeaderForwarded
+	tests := []struct {
+		header  string
+		remote  string
+		headers map[string]string
+		client  string
+	}{
+		// Headers from untrusted clients are ignored
+		{xff, "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"192.0.2.1"},
+		{xff, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			"198.51.100.1"},
+		// Addresses added by the client itself are skipped
+		{xff, "10.0.0.1:1234", map[string]string{
+			"X-Forwarded-For": "203.0.113.1, 198.51.100.1, 10.0.0.2"},
+			"198.51.100.1"},
+		// A forged Forwarded header passed on by a proxy that only adds to
+		// X-Forwarded-For is ignored
+		{xff, "10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=203.0.113.1",
+			"X-Forwarded-For": "198.51.100.1"},
+			"198.51.100.1"},
+		{xff, "10.0.0.1:1234", map[string]string{"Forwarded": "for=203.0.113.1"},
+			"10.0.0.1"},
+		{fwd, "[2001:db8::1]:1234", map[string]string{
+			"Forwarded": `for=198.51.100.1;proto=https, for="[2001:db8::2]:4711"`},
+			"2001:db8::2"},
+		{fwd, "10.0.0.1:1234", map[string]string{
+			"Forwarded":       "for=198.51.100.1",
+			"X-Forwarded-For": "203.0.113.1"},
+			"198.51.100.1"},
+		{fwd, "10.0.0.1:1234", map[string]string{"X-Forwarded-For": "203.0.113.1"},
+			"10.0.0.1"},
+		{fwd, "10.0.0.1:1234", map[string]string{"Forwarded": "for=_hidden"},
+			"10.0.0.1"},
+		{xff, "10.0.0.1:1234", nil, "10.0.0.1"}}
+
+	for _, test := range tests {
+		c.ForwardedHeader = test.header
+		req := httptest.NewRequest(http.MethodPost, "https://example.com/test", nil)
+		req.RemoteAddr = test.remote
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		if ip := c.clientIP(req); ip != test.client {
+			t.Errorf("%s with %s %#v: expected client %s, got %s", test.remote,
+				test.header, test.headers, test.client, ip)
+		}
+	}
+
+	err = c.unmarshalTrustedProxies(map[string]interface{}{
+		LabelForwardedHeader: "X-Real-IP"})
+	if err == nil {
+		t.Error("Unknown forwarding headers should not be accepted")
+	}
+
+	err = c.unmarshalTrustedProxies(map[string]interface{}{
+		LabelTrustedProxies: []interface{}{"proxy.example.com"}})
+	if err == nil {
+		t.Error("Host names should not be accepted as trusted proxies")
+	}
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+// quarantineDir is the subdirectory of the data directory holding
+// submissions that the spam filter quarantined
+const quarantineDir = "quarantine"
+
+// quarantined is a submission stored by quarantine. It can be passed to
+// the train command as spam or ham once reviewed.
+type quarantined struct {
+	ID       string              `json:"id"`
+	Path     string              `json:"path"`
+	Origin   string              `json:"origin"`
+	ClientIP string              `json:"client_ip"`
+	Received time.Time           `json:"received"`
+	Handlers []string            `json:"handlers"`
+	Scores   []float64           `json:"scores"`
+	Fields   map[string][]string `json:"fields"`
+	Files    map[string][]string `json:"files,omitempty"`
+}
+
+// quarantine stores the submission in the quarantine directory, recording
+// the handlers that quarantined it with the scores they gave it
+func (c *Config) quarantine(req *http.Request, path string, names []string,
+	scores []float64) error {
+	dir := filepath.Join(c.DataDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	q := quarantined{
+		ID:       handler.SubmissionID(req),
+		Path:     path,
+		Origin:   req.Header.Get("Origin"),
+		ClientIP: handler.ClientIP(req),
+		Received: time.Now(),
+		Handlers: names,
+		Scores:   scores,
+		Fields:   req.PostForm}
+	// File contents are not kept, only their names
+	if req.MultipartForm != nil {
+		q.Files = make(map[string][]string)
+		for field, files := range req.MultipartForm.File {
+			for _, fh := range files {
+				q.Files[field] = append(q.Files[field], fh.Filename)
+			}
+		}
+	}
+
+	b, err := json.MarshalIndent(q, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, q.ID+".json"), b, 0600)
+}
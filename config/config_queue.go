@@ -0,0 +1,145 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/queue"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// queueDir is the subdirectory of the data directory holding queued
+// submissions
+const queueDir = "queue"
+
+func (c *Config) unmarshalQueue(data map[string]interface{}) (err error) {
+	c.DataDir, err = parse.StringOrDefault(data[LabelDataDir], DefaultDataDir)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelDataDir, err)
+	}
+
+	c.Async, err = parse.BoolOrDefault(data[LabelAsync], false)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelAsync, err)
+	}
+
+	if !c.Async {
+		return nil
+	}
+
+	workers, err := parse.Int64OrDefault(data[LabelQueueWorkers], DefaultQueueWorkers)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelQueueWorkers, err)
+	}
+
+	retries, err := parse.Int64OrDefault(data[LabelQueueRetries], DefaultQueueRetries)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelQueueRetries, err)
+	}
+
+	backoff, err := handler.DurationOrDefault(data[LabelQueueBackoff], DefaultQueueBackoff)
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelQueueBackoff, err)
+	}
+	if backoff <= 0 {
+		return fmt.Errorf(e.ErrConfigItem, LabelQueueBackoff, "must be positive")
+	}
+
+	c.queue, err = queue.New(filepath.Join(c.DataDir, queueDir), queue.Options{
+		Workers:    int(workers),
+		MaxRetries: int(retries),
+		Backoff:    backoff}, c.Logger)
+	if err != nil {
+		return fmt.Errorf("could not create submission queue: %s", err)
+	}
+
+	return nil
+}
+
+// StartQueue starts handling queued submissions in the background, if
+// asynchronous handling is enabled. Submissions left in the queue by a
+// previous run or configuration are handled as well.
+//
+// Only one Config may handle the queue at a time, so StopQueue must be called
+// on the old Config before calling StartQueue on a reloaded one.
+func (c *Config) StartQueue() {
+	if c.queue != nil {
+		c.Logger.Logf("Handling queued submissions from %s", c.queue.Dir())
+		c.queue.Start(c.processJob)
+	}
+}
+
+// StopQueue stops handling queued submissions, waiting for the submissions
+// being handled to finish. Submissions still in the queue are kept on disk.
+func (c *Config) StopQueue() {
+	if c.queue != nil {
+		c.Logger.Logln("Stopping handling of queued submissions")
+		c.queue.Stop()
+	}
+}
+
+// enqueue adds the submission to the queue for the named handler
+func (c *Config) enqueue(req *http.Request, name string, body []byte) error {
+	job := queue.NewJob(handler.SubmissionID(req), name, req, body)
+	job.ClientIP = handler.ClientIP(req)
+	return c.queue.Enqueue(job)
+}
+
+// processJob handles a queued submission with the handler named in the job.
+// The job is only retried if the handler returned an error, never while the
+// handler may still be running.
+func (c *Config) processJob(job *queue.Job) *e.HTTPError {
+	h := c.GetNamedHandler(job.Handler)
+	if h == nil {
+		return e.NewHTTPError(fmt.Sprintf(
+			"handler %s is no longer configured", job.Handler),
+			http.StatusNotFound)
+	}
+
+	req, err := job.Request()
+	if err != nil {
+		return e.NewHTTPError(err.Error(), http.StatusBadRequest)
+	}
+	req = handler.WithSubmission(req, &handler.Submission{ID: job.Submission,
+		ClientIP: job.ClientIP})
+
+	if err := parseForm(req); err != nil {
+		return err
+	}
+	if req.MultipartForm != nil {
+		defer req.MultipartForm.RemoveAll()
+	}
+
+	timeout := c.handlerTimeout(h)
+	ctx, cancel := handlerContext(req, timeout)
+	defer cancel()
+
+	// Unlike runHandler, wait for the handler to return even after the
+	// timeout. A handler still running may yet handle the submission, so
+	// retrying the job then could handle it twice.
+	ch := make(chan *e.HTTPError, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go h.Handle(req.WithContext(ctx), ch, &wg)
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var status *e.HTTPError
+	for err := range ch {
+		if err != nil && status == nil {
+			status = err
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		c.Logger.Errorf("Handler %s took longer than %s for queued job %s",
+			job.Handler, timeout, job.ID)
+	}
+	return status
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/ratelimit"
+	"github.com/Shadow53/interparser/parse"
+)
+
+func (c *Config) unmarshalRateLimits(data map[string]interface{}) (err error) {
+	c.RateLimit, err = handler.ParseRateLimit(LabelRateLimit, data[LabelRateLimit])
+	if err != nil {
+		return err
+	}
+
+	paths, err := parse.MapStringKeysOrNew(data[LabelPathRateLimits])
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelPathRateLimits, err)
+	}
+
+	c.pathRateLimits = make(map[string]*ratelimit.Limiter, len(paths))
+	for path, conf := range paths {
+		c.pathRateLimits[path], err = handler.ParseRateLimit(
+			fmt.Sprintf("%s (%s)", LabelPathRateLimits, path), conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rateLimited checks the server-wide rate limit and the rate limit of the
+// path, returning the error for the first one the client exceeded.
+func (c *Config) rateLimited(domain, path, ip string) *e.HTTPError {
+	if err := handler.RateLimited(c.RateLimit, ip); err != nil {
+		return err
+	}
+	// Domains share the limit's options, but each has its own buckets
+	return handler.RateLimited(c.pathRateLimits[path], domain+"\x00"+ip)
+}
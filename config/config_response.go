@@ -0,0 +1,190 @@
+package config
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	l "gitlab.com/BluestNight/nebula-forms/log"
+)
+
+// submissionIDHeader is the response header containing the submission's ID
+const submissionIDHeader = "X-Submission-ID"
+
+// jsonResponse is the body of responses to clients that accept JSON
+type jsonResponse struct {
+	Status  int               `json:"status"`
+	ID      string            `json:"id"`
+	Message string            `json:"message,omitempty"`
+	Code    string            `json:"code,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// wantsJSON returns whether the client listed application/json in the
+// request's Accept header
+func wantsJSON(req *http.Request) bool {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFieldErrors returns a copy of next that also contains the field
+// errors of prev, unless next has its own error for the same field.
+func mergeFieldErrors(prev *e.HTTPError, next *e.HTTPError) *e.HTTPError {
+	merged := e.NewCodedError(next.Code(), next.Error(), next.Status())
+	for field, msg := range prev.FieldErrors() {
+		merged.AddFieldError(field, msg)
+	}
+	for field, msg := range next.FieldErrors() {
+		merged.AddFieldError(field, msg)
+	}
+	return merged
+}
+
+// responseMessage returns the message shown to the client for the given
+// status, hiding the details of server errors
+func responseMessage(status *e.HTTPError) string {
+	if status.Status() >= 500 {
+		return handler.ServerErrorMessage
+	}
+	return status.Error()
+}
+
+// setCORSHeaders allows the given origin to read the response to a request
+// with the given method, if any of the handlers allows the origin
+func setCORSHeaders(rw http.ResponseWriter, origin, method string,
+	handlers []handler.Handler) {
+	rw.Header().Set("Vary", "Origin")
+	cors, ok := corsFor(origin, handlers)
+	if origin == "" || !ok {
+		return
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	rw.Header().Set("Access-Control-Allow-Methods", method)
+	rw.Header().Set("Access-Control-Expose-Headers", submissionIDHeader)
+	if cors.AllowCredentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// issueResponse is the body of responses to GET requests for the hidden
+// fields that handlers expect in submissions
+type issueResponse struct {
+	Fields map[string]string `json:"fields"`
+}
+
+// writeIssuedFields answers a GET request with the hidden fields issued by
+// the handlers that allow the request's origin, such as time trap
+// timestamps and form tokens. It returns false without writing anything if
+// no handler issues fields to the origin.
+func writeIssuedFields(rw http.ResponseWriter, req *http.Request,
+	handlers []handler.Handler, l *l.Logger) bool {
+	fields := make(map[string]string)
+	for _, h := range handlers {
+		if !h.OriginAllowed(h.RequestOrigin(req)) {
+			continue
+		}
+		issued, err := h.IssueFields(req)
+		if err != nil {
+			l.Errorf("Error while issuing fields: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(handler.ServerErrorMessage))
+			return true
+		}
+		for name, value := range issued {
+			fields[name] = value
+		}
+	}
+	if len(fields) == 0 {
+		return false
+	}
+
+	body, err := json.Marshal(issueResponse{Fields: fields})
+	if err != nil {
+		l.Errorf("Error while encoding issued fields: %s", err)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return true
+	}
+
+	setCORSHeaders(rw, req.Header.Get("Origin"), http.MethodGet, handlers)
+	// Every response must be unique, or the time trap would see the page
+	// load time of whoever fetched it first
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+	return true
+}
+
+// writeResponse answers the submission with the given status. Clients that
+// accept JSON get a jsonResponse, others are redirected if any handler
+// that accepted the submission configures a redirect, or else get the
+// status code and a short message.
+func writeResponse(rw http.ResponseWriter, req *http.Request, path string,
+	status *e.HTTPError, handlers []handler.Handler,
+	handled []handler.Handler, l *l.Logger) {
+	origin := req.Header.Get("Origin")
+
+	for key, values := range status.Header() {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+
+	// If the source is allowed, add to response
+	if status.Status() != http.StatusForbidden {
+		l.Logln("Setting CORS headers to match request")
+		setCORSHeaders(rw, origin, http.MethodPost, handlers)
+	} else {
+		l.Logf(
+			"Submission from %s to %s was not accepted", origin, path)
+	}
+
+	if wantsJSON(req) {
+		body, err := json.Marshal(jsonResponse{
+			Status:  status.Status(),
+			ID:      handler.SubmissionID(req),
+			Message: responseMessage(status),
+			Code:    status.Code(),
+			Errors:  status.FieldErrors()})
+		if err != nil {
+			l.Errorf("Error while encoding JSON response: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status.Status())
+		rw.Write(body)
+		return
+	}
+
+	// Redirect forms submitted without JavaScript back to the site
+	for _, h := range handled {
+		target, err := h.Redirect(req, status)
+		if err != nil {
+			l.Errorf("Error while creating redirect URL: %s", err)
+		} else if target != "" {
+			l.Debugf("Redirecting submission to %s", target)
+			http.Redirect(rw, req, target, http.StatusSeeOther)
+			return
+		}
+	}
+
+	rw.WriteHeader(status.Status())
+	if (status.Status() == http.StatusBadRequest ||
+		status.Status() == http.StatusRequestEntityTooLarge) &&
+		status.Error() != "" {
+		rw.Write([]byte(status.Error()))
+	} else if status.Status() >= 500 {
+		rw.Write([]byte(handler.ServerErrorMessage))
+	}
+}
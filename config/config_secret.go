@@ -0,0 +1,77 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// secretFile is the file in the data directory holding the generated secret
+// used when the configuration does not set one
+const secretFile = "secret"
+
+// loadSecret reads the secret stored in the data directory, generating and
+// storing a new one if there is none yet
+func (c *Config) loadSecret() (string, error) {
+	path := filepath.Join(c.DataDir, secretFile)
+	if b, err := ioutil.ReadFile(path); err == nil {
+		if secret := strings.TrimSpace(string(b)); secret != "" {
+			return secret, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	secret, err := randomSecret()
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(c.DataDir, 0700); err != nil {
+		return "", err
+	}
+	if err = ioutil.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func randomSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *Config) unmarshalSecret(data map[string]interface{}) (err error) {
+	c.Secret, err = parse.StringOrDefault(data[LabelSecret], "")
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelSecret, err)
+	}
+	if c.Secret != "" {
+		return nil
+	}
+
+	c.Secret, err = c.loadSecret()
+	if err == nil {
+		return nil
+	}
+
+	// Signed values still work until the server restarts
+	c.Logger.Errorf("Could not load or store secret in %s, using a temporary "+
+		"one instead: %s\n", c.DataDir, err)
+	c.Secret, err = randomSecret()
+	if err != nil {
+		return fmt.Errorf("could not generate secret: %s", err)
+	}
+	return nil
+}
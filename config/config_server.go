@@ -1,46 +1,240 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"sync"
 
 	e "gitlab.com/BluestNight/nebula-forms/errors"
 	"gitlab.com/BluestNight/nebula-forms/handler"
 	l "gitlab.com/BluestNight/nebula-forms/log"
-	"errors"
+	"strconv"
 	"strings"
 )
 
 type handleFunc func(rw http.ResponseWriter, req *http.Request)
 
-func parseForm(req *http.Request) error {
+// parseForm parses the request body into req.Form and req.PostForm, based on
+// its content type
+func parseForm(req *http.Request) *e.HTTPError {
 	var err error
 	// HasPrefix because other information is added after the actual type
 	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
-		err = req.ParseMultipartForm(http.DefaultMaxHeaderBytes)
+		err = req.ParseMultipartForm(maxFormMemory)
 	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
 		err = req.ParseForm()
+	} else if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		err = parseJSONForm(req)
 	} else {
-		err = errors.New("Request body content type must be application/x-www-form-urlencoded or multipart/form-data")
+		return e.NewHTTPError(
+			"Request body content type must be application/x-www-form-urlencoded, multipart/form-data, or application/json",
+			http.StatusUnsupportedMediaType)
 	}
 
-	return err
+	if err != nil {
+		return e.NewHTTPError(err.Error(), http.StatusBadRequest)
+	}
+	return nil
 }
 
-func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleFunc {
+// corsFor combines the CORS options of all handlers that allow the given
+// origin. The returned bool is false if no handler allows the origin.
+func corsFor(origin string, handlers []handler.Handler) (handler.CORS, bool) {
+	cors := handler.CORS{}
+	allowed := false
+	seen := make(map[string]struct{})
+
+	for _, h := range handlers {
+		if !h.OriginAllowed(origin) {
+			continue
+		}
+
+		hCors := h.CORS()
+		for _, header := range hCors.AllowedHeaders {
+			key := http.CanonicalHeaderKey(header)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				cors.AllowedHeaders = append(cors.AllowedHeaders, key)
+			}
+		}
+
+		// Use the shortest cache time so no handler's options are cached
+		// longer than it allows
+		if !allowed || hCors.MaxAge < cors.MaxAge {
+			cors.MaxAge = hCors.MaxAge
+		}
+
+		cors.AllowCredentials = cors.AllowCredentials || hCors.AllowCredentials
+		allowed = true
+	}
+
+	return cors, allowed
+}
+
+// handlePreflight answers a CORS preflight (OPTIONS) request based on the
+// options of the handlers that allow the request's origin.
+func handlePreflight(rw http.ResponseWriter, req *http.Request, path string,
+	handlers []handler.Handler, l *l.Logger) {
+	origin := req.Header.Get("Origin")
+	l.Debugf("Received preflight request from origin: %s", origin)
+
+	rw.Header().Add("Vary", "Origin")
+	rw.Header().Add("Vary", "Access-Control-Request-Method")
+	rw.Header().Add("Vary", "Access-Control-Request-Headers")
+
+	cors, ok := corsFor(origin, handlers)
+	if !ok {
+		l.Logf("Preflight from %s to %s was not accepted", origin, path)
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	method := req.Header.Get("Access-Control-Request-Method")
+	if method != "" && method != http.MethodPost {
+		l.Debugf("Preflight requested unsupported method %s", method)
+		rw.Header().Set("Allow", "OPTIONS, POST")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	rw.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+	if len(cors.AllowedHeaders) > 0 {
+		rw.Header().Set("Access-Control-Allow-Headers",
+			strings.Join(cors.AllowedHeaders, ", "))
+	}
+	if cors.MaxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age",
+			strconv.FormatInt(cors.MaxAge, 10))
+	}
+	if cors.AllowCredentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// originHandlers returns the handlers that allow the request's origin. They
+// decide the redirect for submissions rejected before any handler accepted
+// them. The body is not parsed again for their templates, so only the
+// query's values are available to them.
+func originHandlers(req *http.Request, handlers []handler.Handler) []handler.Handler {
+	if req.Form == nil {
+		req.Form = req.URL.Query()
+	}
+	if req.PostForm == nil {
+		req.PostForm = url.Values{}
+	}
+
+	var allowed []handler.Handler
+	for _, h := range handlers {
+		if h.OriginAllowed(h.RequestOrigin(req)) {
+			allowed = append(allowed, h)
+		}
+	}
+	return allowed
+}
+
+func (c *Config) getHandleFunc(domain, path string) handleFunc {
+	handlers := c.GetDomainHandlers(domain, path)
+	names := c.GetDomainHandlerNames(domain, path)
+	limits := c.Limits()
+	l := c.Logger
+
 	return func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodOptions {
+			handlePreflight(rw, req, path, handlers, l)
+			return
+		}
+
+		// Forms fetch the hidden fields they need before being submitted
+		if req.Method == http.MethodGet && writeIssuedFields(rw, req, handlers, l) {
+			l.Debugf("Issued hidden fields for %s to %s", path,
+				req.Header.Get("Origin"))
+			return
+		}
+
+		req, sub, err := handler.NewSubmission(req)
+		if err != nil {
+			l.Errorf("Error while creating submission ID: %s", err)
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte(handler.ServerErrorMessage))
+			return
+		}
+		rw.Header().Set(submissionIDHeader, sub.ID)
+		sub.ClientIP = c.clientIP(req)
+
+		// Turn away clients sending too many submissions before reading
+		// the body
+		if req.Method == http.MethodPost {
+			if err := c.rateLimited(domain, path, sub.ClientIP); err != nil {
+				l.Logf("Client %s exceeded the rate limit for %s", sub.ClientIP, path)
+				writeResponse(rw, req, path, err, handlers,
+					originHandlers(req, handlers), l)
+				return
+			}
+		}
+
+		// Limit the body to the largest size any handler accepts. Handlers
+		// with smaller limits are checked after the form is parsed.
+		body := newLimitedBody(rw, req, maxBodySize(handlers, limits))
+		req.Body = body
+		// Keep the raw body to store in the queue
+		if c.queue != nil {
+			body.raw = &bytes.Buffer{}
+		}
+
 		// Create a buffered channel large enough to fit responses from
 		// all handlers
 		ch := make(chan *e.HTTPError, len(handlers))
 		var wg sync.WaitGroup
+		// Handlers still running, even after timing out
+		var running sync.WaitGroup
 
 		origin := req.Header.Get("Origin")
 		l.Debugf("Received request from origin: %s", origin)
 
 		status := e.NewHTTPError("", http.StatusNotFound)
-		// Run a goroutine for each handler
-		for _, h := range handlers {
+		// Handlers that accepted the submission, to look up redirects
+		var handled []handler.Handler
+		// Whether the submission was queued for any handler
+		queued := false
+
+		// Parse the body once, before any handler checks its conditions
+		if req.Method == http.MethodPost {
+			if err := parseForm(req); err != nil {
+				if body.exceeded {
+					l.Logf("Submission to %s exceeded the maximum body size of %d bytes",
+						path, body.limit)
+					status = bodyTooLarge(body.limit)
+				} else {
+					l.Logf("Error while parsing form: %s", err)
+					status = err
+				}
+				writeResponse(rw, req, path, status, handlers,
+					originHandlers(req, handlers), l)
+				return
+			}
+			// The server only removes the files of the original request,
+			// not of this copy. Handlers that timed out may still be
+			// reading them, so wait for those in the background.
+			if form := req.MultipartForm; form != nil {
+				defer func() {
+					go func() {
+						running.Wait()
+						form.RemoveAll()
+					}()
+				}()
+			}
+			l.Debugf("Request has following form fields/entries: %#v", req.Form)
+		}
+
+		// Find the handlers that should handle the submission
+		var accepted []int
+		for i, h := range handlers {
 			// Checking like this because I may change the above status
 			if status.Status() != http.StatusOK &&
 				status.Status() != http.StatusForbidden {
@@ -55,21 +249,14 @@ func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleF
 					"Handler %s can handle from this request from %s",
 					req.RequestURI, origin)
 				l.Logf(
-					"Received form submission on path %s from origin %s\n",
-					path, origin)
+					"Received form submission %s on path %s from origin %s\n",
+					sub.ID, path, origin)
 				if req.Method == http.MethodPost {
-					err = parseForm(req)
-					if err == nil {
-						wg.Add(1)
-						go h.Handle(req, ch, &wg)
-						// Return OK status even if honeypot is triggered
-						// they might try again
-						status = e.NewHTTPError("", http.StatusOK)
-						l.Debugf("Request has following form fields/entries: %#v", req.Form)
-					} else {
-						l.Errorf("Error while parsing form: %s", err)
-						status = e.NewHTTPError(err.Error(), http.StatusInternalServerError)
-					}
+					accepted = append(accepted, i)
+					handled = append(handled, h)
+					// Return OK status even if honeypot is triggered
+					// they might try again
+					status = e.NewHTTPError("", http.StatusOK)
 				} else {
 					status = e.NewHTTPError("", http.StatusMethodNotAllowed)
 				}
@@ -77,11 +264,132 @@ func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleF
 				l.Errorf("While determining if handler should handle: %s", err)
 				status = e.NewHTTPError(err.Error(),
 					http.StatusInternalServerError)
+			} else if req.Method == http.MethodPost &&
+				h.OriginAllowed(h.RequestOrigin(req)) {
+				if spam, reason := h.Spam(req); spam {
+					// Pretend the submission was handled so that bots do
+					// not learn that they were caught
+					l.Logf("Discarding submission %s to %s as spam: %s",
+						sub.ID, path, reason)
+					handled = append(handled, h)
+					status = e.NewHTTPError("", http.StatusOK)
+				} else {
+					l.Debugf("Handler %s should not handle from %s", req.RequestURI, origin)
+				}
 			} else {
 				l.Debugf("Handler %s should not handle from %s", req.RequestURI, origin)
 			}
 		}
 
+		for _, i := range accepted {
+			if err := handlers[i].CheckRateLimit(req); err != nil {
+				l.Logf("Client %s exceeded the rate limit of a handler for %s",
+					sub.ClientIP, path)
+				writeResponse(rw, req, path, err, handlers, handled, l)
+				return
+			}
+		}
+
+		// Check every handler's size limits before any of them runs, so that
+		// the submission is either handled by all of them or rejected
+		for _, i := range accepted {
+			lim := handlers[i].Limits().WithDefaults(limits)
+			if err := checkLimits(req, body.read, lim); err != nil {
+				l.Logf("Submission %s to %s exceeded a size limit: %s",
+					sub.ID, path, err)
+				writeResponse(rw, req, path, err, handlers, handled, l)
+				return
+			}
+		}
+
+		// Validate the submission against every handler's fields before any
+		// of them runs, so that none of them handle an invalid submission
+		var invalid *e.HTTPError
+		for _, i := range accepted {
+			if err := handlers[i].Validate(req); err != nil {
+				if invalid == nil {
+					invalid = err
+				} else {
+					invalid = mergeFieldErrors(invalid, err)
+				}
+			}
+		}
+		if invalid != nil {
+			l.Logf("Submission %s to %s is invalid: %s", sub.ID, path, invalid)
+			writeResponse(rw, req, path, invalid, handlers, handled, l)
+			return
+		}
+
+		// Verify proofs of work and CAPTCHAs last, since they can only be
+		// used once and the user would have to solve new ones for an
+		// invalid form
+		for _, i := range accepted {
+			if err := handlers[i].VerifyProofOfWork(req); err != nil {
+				l.Logf("Submission %s to %s failed the proof of work: %s",
+					sub.ID, path, err)
+				writeResponse(rw, req, path, err, handlers, handled, l)
+				return
+			}
+		}
+		for _, i := range accepted {
+			if err := handlers[i].VerifyCaptcha(req); err != nil {
+				if err.Status() >= 500 {
+					l.Errorf("Error while verifying CAPTCHA for submission %s: %s",
+						sub.ID, err)
+				} else {
+					l.Logf("Submission %s to %s failed the CAPTCHA: %s",
+						sub.ID, path, err)
+				}
+				writeResponse(rw, req, path, err, handlers, handled, l)
+				return
+			}
+		}
+		// Form tokens can only be used once, so they are checked after
+		// everything else that could reject the submission
+		for _, i := range accepted {
+			if err := handlers[i].CheckToken(req); err != nil {
+				l.Logf("Submission %s to %s has no valid form token: %s",
+					sub.ID, path, err)
+				writeResponse(rw, req, path, err, handlers, handled, l)
+				return
+			}
+		}
+
+		// Run a goroutine for each handler
+		var qNames []string
+		var qScores []float64
+		for _, i := range accepted {
+			h := handlers[i]
+			if h.SpamAction(req) == handler.SpamActionQuarantine {
+				qNames = append(qNames, names[i])
+				qScores = append(qScores, h.SpamScore(req))
+				continue
+			}
+			if c.queue != nil && names[i] != "" {
+				err := c.enqueue(req, names[i], body.raw.Bytes())
+				if err == nil {
+					l.Debugf("Queued submission %s for handler %s",
+						sub.ID, names[i])
+					queued = true
+					continue
+				}
+				// Better late than never: handle it right away
+				l.Errorf("Error while queueing submission: %s", err)
+			}
+			wg.Add(1)
+			running.Add(1)
+			go runHandler(h, req, c.handlerTimeout(h), ch, &wg, &running)
+		}
+
+		// Spam is answered as if it was handled
+		if len(qNames) > 0 {
+			if err := c.quarantine(req, path, qNames, qScores); err != nil {
+				l.Errorf("Error while quarantining submission %s: %s", sub.ID, err)
+			} else {
+				l.Logf("Quarantined submission %s to %s as spam", sub.ID, path)
+			}
+		}
+
 		wg.Wait()
 		close(ch)
 
@@ -97,6 +405,7 @@ func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleF
 		// 405 - MethodNotAllowed
 		// 500 - InternalServerError
 		// 501 - NotImplemented
+		// 504 - GatewayTimeout (a handler took too long)
 		// The following switch has the codes I expect to see used above or
 		// by handlers, in order of least to greatest precedence.
 		for err := range ch {
@@ -105,7 +414,7 @@ func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleF
 				switch status.Status() {
 				case http.StatusOK:
 					status = err
-				case http.StatusInternalServerError:
+				case http.StatusInternalServerError, http.StatusGatewayTimeout:
 					// Assume that a client error may have caused the server
 					// error
 					if err.Status() >= 400 {
@@ -124,58 +433,101 @@ func getHandleFunc(path string, handlers []handler.Handler, l *l.Logger) handleF
 						err.Status() < http.StatusMethodNotAllowed {
 						status = err
 					}
+				case http.StatusRequestEntityTooLarge:
+					if err.Status() == http.StatusBadRequest {
+						status = err
+					}
 				case http.StatusBadRequest:
 					// Have as greatest precedence because it should indicate
-					// what the client did wrong
-					status = err
+					// what the client did wrong. Keep the errors for fields
+					// from all handlers
+					if err.Status() == http.StatusBadRequest {
+						status = mergeFieldErrors(status, err)
+					} else {
+						status = err
+					}
 				}
 			}
 		}
 
+		// The submission is still being processed by queued handlers
+		if queued && status.Status() == http.StatusOK {
+			status = e.NewHTTPError("", http.StatusAccepted)
+		}
+
 		l.Logln("Completed processing form submission")
 
-		// If the source is allowed, add to response
-		if status.Status() != http.StatusForbidden {
-			l.Logln("Setting CORS headers to match request")
-			rw.Header().Set("Access-Control-Allow-Origin", origin)
-			rw.Header().Set("Access-Control-Allow-Methods", "POST")
-			//rw.Header().Set("Access-Control-Allow-Headers",
-			//"Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
-			rw.Header().Set("Vary", "Origin")
-		} else {
-			l.Logf(
-				"Submission from %s to %s was not accepted",
-				req.Header.Get("Origin"), path)
-		}
+		writeResponse(rw, req, path, status, handlers, handled, l)
+	}
+}
 
-		rw.WriteHeader(status.Status())
-		if status.Status() == http.StatusBadRequest && status.Error() != "" {
-			rw.Write([]byte(status.Error()))
-		} else if status.Status() >= 500 {
-			rw.Write([]byte("A server error occurred. Please try again later."))
-		}
+// normalizeHost returns the domain name in a Host header or configuration
+// key, without the port, trailing dot, or differences in case
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
 	}
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
 }
 
-// CreateServer generates an http.Server that handles the handlers found in
-// this configuration struct
-func (c *Config) CreateServer() *http.Server {
+// createMux creates the ServeMux for the handlers in the given domain
+func (c *Config) createMux(domain string) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request){
 		c.Logger.Errorf(
-			"Received request to unhandled path %s", req.RequestURI)
+			"Received request to unhandled path %s%s", req.Host, req.RequestURI)
 		rw.WriteHeader(http.StatusNotFound)
 	})
 
-	for path, handlers := range c.handlers {
-		mux.HandleFunc(path, getHandleFunc(path, handlers, c.Logger))
+	c.hMutex.RLock()
+	paths := make([]string, 0, len(c.handlers[domain]))
+	for path := range c.handlers[domain] {
+		paths = append(paths, path)
+	}
+	c.hMutex.RUnlock()
+
+	for _, path := range paths {
+		mux.HandleFunc(path, c.getHandleFunc(domain, path))
+	}
+
+	return mux
+}
+
+// CreateServer generates an http.Server that handles the handlers found in
+// this configuration struct. Requests are routed to the handlers for the
+// domain in their Host header, or to those in the default domain if that
+// domain has no handlers of its own.
+func (c *Config) CreateServer() *http.Server {
+	muxes := make(map[string]*http.ServeMux)
+	for _, domain := range c.Domains() {
+		muxes[domain] = c.createMux(domain)
+	}
+	// Requests to unknown domains still get logged when there is no default
+	if muxes[DefaultDomain] == nil {
+		muxes[DefaultDomain] = c.createMux(DefaultDomain)
 	}
 
+	router := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mux, ok := muxes[normalizeHost(req.Host)]
+		if !ok {
+			mux = muxes[DefaultDomain]
+		}
+		mux.ServeHTTP(rw, req)
+	})
+
 	// Create ServeMux, now create Server
 	s := &http.Server{
-		Addr:    fmt.Sprintf(":%d", c.Port),
-		Handler: mux}
+		Addr:              fmt.Sprintf(":%d", c.Port),
+		Handler:           router,
+		TLSConfig:         c.TLSConfig(),
+		ReadTimeout:       c.ReadTimeout,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout}
 
 	return s
 }
@@ -0,0 +1,1071 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/bayes"
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	l "gitlab.com/BluestNight/nebula-forms/log"
+	"gitlab.com/BluestNight/nebula-forms/queue"
+)
+
+// testHandler counts how many times it handled a submission, records the
+// client IP of the last one and returns result, if set, as the handler's
+// error
+type testHandler struct {
+	handler.Base
+	mutex    sync.Mutex
+	handled  int
+	clientIP string
+	result   *e.HTTPError
+}
+
+func (h *testHandler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+	h.mutex.Lock()
+	h.handled++
+	h.clientIP = handler.ClientIP(req)
+	h.mutex.Unlock()
+	if h.result != nil {
+		ch <- h.result
+	}
+}
+
+func newTestHandler(t *testing.T, conf map[string]interface{}) *testHandler {
+	if conf == nil {
+		conf = make(map[string]interface{})
+	}
+	if conf[handler.LabelAllowedOrigins] == nil {
+		conf[handler.LabelAllowedOrigins] = []interface{}{"https://example.com"}
+	}
+	h := &testHandler{}
+	if err := h.Unmarshal(conf); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testConfig returns a Config serving the given handlers at /test
+func testConfig(limits handler.Limits, handlers ...handler.Handler) *Config {
+	c := &Config{
+		Logger:      &l.Logger{},
+		MaxBodySize: limits.MaxBodySize,
+		MaxFileSize: limits.MaxFileSize,
+		MaxFiles:    limits.MaxFiles}
+	for _, h := range handlers {
+		c.AddHandler("/test", h)
+	}
+	return c
+}
+
+func formRequest(body url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/test",
+		strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://example.com")
+	return req
+}
+
+func multipartRequest(t *testing.T, files map[string]string) *http.Request {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	for name, content := range files {
+		f, err := w.CreateFormFile(name, name+".txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(content))
+	}
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/test", buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	req.Header.Set("Origin", "https://example.com")
+	return req
+}
+
+func serve(hf handleFunc, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	hf(rw, req)
+	return rw
+}
+
+func TestGetHandleFunc_Limits(t *testing.T) {
+	h := newTestHandler(t, nil)
+	limits := handler.Limits{MaxBodySize: 64, MaxFileSize: 8, MaxFiles: 2}
+	hf := testConfig(limits, h).getHandleFunc(DefaultDomain, "/test")
+
+	body := url.Values{}
+	body.Set("name", "Joe Smith")
+	if rw := serve(hf, formRequest(body)); rw.Code != http.StatusOK {
+		t.Errorf("Small body should be accepted, got status %d", rw.Code)
+	}
+
+	body.Set("message", strings.Repeat("a", 100))
+	if rw := serve(hf, formRequest(body)); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Body over the limit should return 413, got %d", rw.Code)
+	}
+
+	req := multipartRequest(t, map[string]string{"file": "0123456789"})
+	if rw := serve(hf, req); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("File over the limit should return 413, got %d", rw.Code)
+	}
+
+	if h.handled != 1 {
+		t.Errorf("Handler should only handle the accepted submission, handled %d",
+			h.handled)
+	}
+
+	// Handler limits override the server-wide ones
+	h = newTestHandler(t, map[string]interface{}{
+		handler.LabelMaxBodySize: 1024,
+		handler.LabelMaxFiles:    1})
+	hf = testConfig(limits, h).getHandleFunc(DefaultDomain, "/test")
+
+	if rw := serve(hf, formRequest(body)); rw.Code != http.StatusOK {
+		t.Errorf("Body within the handler's limit should be accepted, got %d",
+			rw.Code)
+	}
+
+	req = multipartRequest(t, map[string]string{"a": "1", "b": "2"})
+	if rw := serve(hf, req); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Too many files should return 413, got %d", rw.Code)
+	}
+}
+
+func TestGetHandleFunc_LimitsAllHandlers(t *testing.T) {
+	large := newTestHandler(t, map[string]interface{}{
+		handler.LabelMaxBodySize: 1024})
+	small := newTestHandler(t, nil)
+	hf := testConfig(handler.Limits{MaxBodySize: 64}, large, small).
+		getHandleFunc(DefaultDomain, "/test")
+
+	body := url.Values{}
+	body.Set("message", strings.Repeat("a", 100))
+	if rw := serve(hf, formRequest(body)); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Body over one handler's limit should return 413, got %d", rw.Code)
+	}
+	if large.handled != 0 || small.handled != 0 {
+		t.Errorf("No handler should handle a submission over any limit, "+
+			"handled %d and %d", large.handled, small.handled)
+	}
+}
+
+func TestGetHandleFunc_MultipartCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-multipart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Files larger than maxFormMemory are stored in the temporary directory
+	tmpdir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	h := newTestHandler(t, nil)
+	c := testConfig(handler.Limits{}, h)
+	c.AddNamedHandler("/test", "test.handler", h)
+	large := strings.Repeat("a", int(2*maxFormMemory))
+
+	req := multipartRequest(t, map[string]string{"file": large})
+	if rw := serve(c.getHandleFunc(DefaultDomain, "/test"), req); rw.Code != http.StatusOK {
+		t.Fatalf("Large upload should be accepted, got status %d", rw.Code)
+	}
+
+	req = multipartRequest(t, map[string]string{"file": large})
+	body, _ := ioutil.ReadAll(req.Body)
+	job := queue.NewJob("submission", "test.handler", req, body)
+	if err := c.processJob(job); err != nil {
+		t.Fatalf("Queued large upload should be handled, got %s", err)
+	}
+
+	waitForEmpty(t, dir)
+}
+
+// waitForEmpty waits until the directory is empty, since uploaded files are
+// removed in the background
+func waitForEmpty(t *testing.T, dir string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) == 0 {
+			return
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Uploaded files should be removed after handling, found %d",
+				len(files))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// corsHandlers returns a handler for https://example.com only and one for
+// any origin that allows credentials, with overlapping CORS options
+func corsHandlers(t *testing.T) []handler.Handler {
+	return []handler.Handler{
+		newTestHandler(t, map[string]interface{}{
+			handler.LabelAllowedHeaders: []interface{}{"X-One"},
+			handler.LabelCORSMaxAge:     600}),
+		newTestHandler(t, map[string]interface{}{
+			handler.LabelAllowedOrigins:   []interface{}{"*"},
+			handler.LabelAllowedHeaders:   []interface{}{"x-one", "X-Two"},
+			handler.LabelCORSMaxAge:       60,
+			handler.LabelAllowCredentials: true})}
+}
+
+func TestCorsFor(t *testing.T) {
+	handlers := corsHandlers(t)
+	tests := []struct {
+		name     string
+		origin   string
+		handlers []handler.Handler
+		cors     handler.CORS
+		allowed  bool
+	}{
+		{"merged", "https://example.com", handlers, handler.CORS{
+			AllowedHeaders: []string{"X-One", "X-Two"}, MaxAge: 60,
+			AllowCredentials: true}, true},
+		{"wildcard only", "https://other.com", handlers, handler.CORS{
+			AllowedHeaders: []string{"X-One", "X-Two"}, MaxAge: 60,
+			AllowCredentials: true}, true},
+		{"single", "https://example.com", handlers[:1], handler.CORS{
+			AllowedHeaders: []string{"X-One"}, MaxAge: 600}, true},
+		{"not allowed", "https://other.com", handlers[:1], handler.CORS{}, false}}
+
+	for _, test := range tests {
+		cors, allowed := corsFor(test.origin, test.handlers)
+		if allowed != test.allowed {
+			t.Errorf("%s: expected allowed to be %t", test.name, test.allowed)
+		}
+		if strings.Join(cors.AllowedHeaders, ",") != strings.Join(test.cors.AllowedHeaders, ",") ||
+			cors.MaxAge != test.cors.MaxAge ||
+			cors.AllowCredentials != test.cors.AllowCredentials {
+			t.Errorf("%s: expected %#v, got %#v", test.name, test.cors, cors)
+		}
+	}
+}
+
+func TestHandlePreflight(t *testing.T) {
+	handlers := corsHandlers(t)
+	tests := []struct {
+		name     string
+		origin   string
+		method   string
+		handlers []handler.Handler
+		code     int
+		headers  map[string]string
+	}{
+		{"merged", "https://example.com", http.MethodPost, handlers,
+			http.StatusNoContent, map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Methods":     http.MethodPost,
+				"Access-Control-Allow-Headers":     "X-One, X-Two",
+				"Access-Control-Max-Age":           "60",
+				"Access-Control-Allow-Credentials": "true"}},
+		// Credentials are never allowed for "*", so the origin is echoed
+		{"credentials with wildcard", "https://other.com", "", handlers,
+			http.StatusNoContent, map[string]string{
+				"Access-Control-Allow-Origin":      "https://other.com",
+				"Access-Control-Allow-Credentials": "true"}},
+		{"without credentials", "https://example.com", http.MethodPost,
+			handlers[:1], http.StatusNoContent, map[string]string{
+				"Access-Control-Allow-Origin":      "https://example.com",
+				"Access-Control-Allow-Headers":     "X-One",
+				"Access-Control-Max-Age":           "600",
+				"Access-Control-Allow-Credentials": ""}},
+		{"origin not allowed", "https://other.com", http.MethodPost,
+			handlers[:1], http.StatusForbidden, map[string]string{
+				"Access-Control-Allow-Origin": ""}},
+		{"method not allowed", "https://example.com", http.MethodPut, handlers,
+			http.StatusMethodNotAllowed, map[string]string{
+				"Access-Control-Allow-Origin": "",
+				"Allow":                       "OPTIONS, POST"}}}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodOptions, "https://example.com/test", nil)
+		req.Header.Set("Origin", test.origin)
+		if test.method != "" {
+			req.Header.Set("Access-Control-Request-Method", test.method)
+		}
+		hf := testConfig(handler.Limits{}, test.handlers...).
+			getHandleFunc(DefaultDomain, "/test")
+		rw := serve(hf, req)
+
+		if rw.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.code, rw.Code)
+		}
+		for name, value := range test.headers {
+			if got := rw.Header().Get(name); got != value {
+				t.Errorf("%s: expected %s to be %q, got %q", test.name, name,
+					value, got)
+			}
+		}
+		// Caches must keep the answers for each origin apart
+		vary := false
+		for _, value := range rw.Header()["Vary"] {
+			vary = vary || value == "Origin"
+		}
+		if !vary {
+			t.Errorf("%s: response should vary by Origin, got %v", test.name,
+				rw.Header()["Vary"])
+		}
+	}
+}
+
+func TestGetHandleFunc_Redirect(t *testing.T) {
+	h := newTestHandler(t, map[string]interface{}{
+		handler.LabelSuccessRedirect: "https://example.com/thanks?name={{ FormValue \"name\" | QueryEscape }}",
+		handler.LabelErrorRedirect:   "https://example.com/error?msg={{ QueryEscape .Error }}"})
+	hf := testConfig(handler.Limits{MaxBodySize: 64}, h).getHandleFunc(DefaultDomain, "/test")
+
+	body := url.Values{}
+	body.Set("name", "Joe Smith")
+	rw := serve(hf, formRequest(body))
+	if rw.Code != http.StatusSeeOther {
+		t.Errorf("Successful submission should redirect with 303, got %d", rw.Code)
+	}
+	if got := rw.Header().Get("Location"); got != "https://example.com/thanks?name=Joe+Smith" {
+		t.Errorf("Wrong success redirect: %s", got)
+	}
+
+	// _next overrides the success redirect if its origin is allowed
+	body.Set(handler.NextField, "https://example.com/other")
+	rw = serve(hf, formRequest(body))
+	if got := rw.Header().Get("Location"); got != "https://example.com/other" {
+		t.Errorf("Allowed %s should be used as redirect, got %s",
+			handler.NextField, got)
+	}
+
+	body.Set(handler.NextField, "https://evil.example.org/")
+	rw = serve(hf, formRequest(body))
+	if got := rw.Header().Get("Location"); got != "https://example.com/thanks?name=Joe+Smith" {
+		t.Errorf("%s with a disallowed origin should be ignored, got %s",
+			handler.NextField, got)
+	}
+
+	// Errors use the error redirect
+	h2 := newTestHandler(t, map[string]interface{}{
+		handler.LabelMaxFileSize:   4,
+		handler.LabelErrorRedirect: "https://example.com/error?status={{ .Status }}"})
+	hf = testConfig(handler.Limits{}, h2).getHandleFunc(DefaultDomain, "/test")
+	rw = serve(hf, multipartRequest(t, map[string]string{"file": "0123456789"}))
+	if got := rw.Header().Get("Location"); got != "https://example.com/error?status=413" {
+		t.Errorf("Wrong error redirect: %s", got)
+	}
+
+	// So do submissions rejected before any handler accepted them
+	body.Set("message", strings.Repeat("a", 100))
+	rw = serve(testConfig(handler.Limits{MaxBodySize: 64}, h2).
+		getHandleFunc(DefaultDomain, "/test"), formRequest(body))
+	if got := rw.Header().Get("Location"); got != "https://example.com/error?status=413" {
+		t.Errorf("Body over the limit should use the error redirect, got %s", got)
+	}
+
+	c := testConfig(handler.Limits{}, h2)
+	err := c.unmarshalRateLimits(map[string]interface{}{
+		LabelRateLimit: map[string]interface{}{
+			handler.LabelRateLimitRequests: int64(1),
+			handler.LabelRateLimitPer:      "1h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf = c.getHandleFunc(DefaultDomain, "/test")
+	serve(hf, formRequest(url.Values{}))
+	rw = serve(hf, formRequest(url.Values{}))
+	if got := rw.Header().Get("Location"); got != "https://example.com/error?status=429" {
+		t.Errorf("Rate limited submission should use the error redirect, got %s", got)
+	}
+
+	// Handlers that do not allow the origin do not redirect, and the origin
+	// is not allowed to read the response
+	req := formRequest(url.Values{})
+	req.Header.Set("Origin", "https://evil.example.org")
+	if rw = serve(hf, req); rw.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429 for other origins, got %d", rw.Code)
+	}
+	if got := rw.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Disallowed origin should not get CORS headers, got %s", got)
+	}
+}
+
+func TestGetHandleFunc_JSON(t *testing.T) {
+	h1 := newTestHandler(t, nil)
+	h1.result = e.NewFieldError("email", "not an email address", http.StatusBadRequest)
+	h2 := newTestHandler(t, nil)
+	h2.result = e.NewFieldError("name", "required", http.StatusBadRequest)
+	hf := testConfig(handler.Limits{}, h1, h2).getHandleFunc(DefaultDomain, "/test")
+
+	req := formRequest(url.Values{})
+	req.Header.Set("Accept", "application/json, text/plain;q=0.5")
+	rw := serve(hf, req)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rw.Code)
+	}
+	if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %s", ct)
+	}
+
+	resp := jsonResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != http.StatusBadRequest {
+		t.Errorf("JSON status should be 400, got %d", resp.Status)
+	}
+	if resp.ID == "" || resp.ID != rw.Header().Get(submissionIDHeader) {
+		t.Errorf("JSON ID %s should match %s header %s", resp.ID,
+			submissionIDHeader, rw.Header().Get(submissionIDHeader))
+	}
+	if len(resp.Errors) != 2 || resp.Errors["email"] != "not an email address" ||
+		resp.Errors["name"] != "required" {
+		t.Errorf("Field errors from both handlers should be returned, got %#v",
+			resp.Errors)
+	}
+
+	// Server errors are not shown to the client
+	h1.result = e.NewHTTPError("connection refused", http.StatusInternalServerError)
+	h2.result = nil
+	rw = serve(hf, req)
+	resp = jsonResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != http.StatusInternalServerError ||
+		resp.Message != handler.ServerErrorMessage {
+		t.Errorf("Server error details should be hidden, got %#v", resp)
+	}
+}
+
+func TestParseForm_JSON(t *testing.T) {
+	body := `{
+		"name": "Joe Smith",
+		"age": 42,
+		"subscribe": true,
+		"comment": null,
+		"favorite-nums": [1, 14, "19"],
+		"address": {"city": "Springfield", "lines": ["742 Evergreen Terrace"]}
+	}`
+	req := httptest.NewRequest(http.MethodPost,
+		"https://example.com/test?source=footer", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	if err := parseForm(req); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string][]string{
+		"name":          {"Joe Smith"},
+		"age":           {"42"},
+		"subscribe":     {"true"},
+		"comment":       {""},
+		"favorite-nums": {"1", "14", "19"},
+		"address.city":  {"Springfield"},
+		"address.lines": {"742 Evergreen Terrace"}}
+
+	for key, vals := range expected {
+		got := req.PostForm[key]
+		if len(got) != len(vals) {
+			t.Errorf("Wrong values for %s: expected %#v, got %#v", key, vals, got)
+			continue
+		}
+		for i := range vals {
+			if got[i] != vals[i] {
+				t.Errorf("Wrong values for %s: expected %#v, got %#v", key, vals, got)
+			}
+		}
+	}
+
+	if req.FormValue("source") != "footer" {
+		t.Error("Query parameters should be included in the form values")
+	}
+	if req.PostFormValue("name") != "Joe Smith" {
+		t.Error("JSON values should be available from PostFormValue")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "https://example.com/test",
+		strings.NewReader(`["not", "an", "object"]`))
+	req.Header.Set("Content-Type", "application/json")
+	if err := parseForm(req); err == nil || err.Status() != http.StatusBadRequest {
+		t.Errorf("JSON body that is not an object should be a 400 error, got %v", err)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "https://example.com/test",
+		strings.NewReader("name: Joe"))
+	req.Header.Set("Content-Type", "text/plain")
+	if err := parseForm(req); err == nil || err.Status() != http.StatusUnsupportedMediaType {
+		t.Errorf("Unsupported content type should be a 415 error, got %v", err)
+	}
+}
+
+func TestGetHandleFunc_Async(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := newTestHandler(t, nil)
+	c := &Config{Logger: &l.Logger{}}
+	c.AddNamedHandler("/test", "test.handler", h)
+	c.queue, err = queue.New(dir, queue.Options{Workers: 1, Backoff: time.Second}, c.Logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.unmarshalTrustedProxies(map[string]interface{}{
+		LabelTrustedProxies: []interface{}{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := url.Values{}
+	body.Set("name", "Joe Smith")
+	req := formRequest(body)
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if rw := serve(c.getHandleFunc(DefaultDomain, "/test"), req); rw.Code != http.StatusAccepted {
+		t.Errorf("Queued submission should return 202, got %d", rw.Code)
+	}
+	if h.handled != 0 {
+		t.Error("Queued submission should not be handled before the queue starts")
+	}
+
+	c.StartQueue()
+	defer c.StopQueue()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.mutex.Lock()
+		handled := h.handled
+		h.mutex.Unlock()
+		if handled == 1 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for queued submission to be handled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.clientIP != "198.51.100.1" {
+		t.Errorf("Queued submission should keep the client IP, got %s", h.clientIP)
+	}
+}
+
+// slowHandler waits until its request's context is done
+type slowHandler struct {
+	testHandler
+	canceled chan error
+}
+
+func (h *slowHandler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+	<-req.Context().Done()
+	h.canceled <- req.Context().Err()
+}
+
+func TestGetHandleFunc_Timeout(t *testing.T) {
+	slow := &slowHandler{canceled: make(chan error, 1)}
+	err := slow.Unmarshal(map[string]interface{}{
+		handler.LabelAllowedOrigins: []interface{}{"https://example.com"},
+		handler.LabelTimeout:        "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast := newTestHandler(t, nil)
+
+	c := testConfig(handler.Limits{}, fast, slow)
+	c.HandlerTimeout = time.Minute
+	rw := serve(c.getHandleFunc(DefaultDomain, "/test"), formRequest(url.Values{}))
+
+	if rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d", rw.Code)
+	}
+	select {
+	case err := <-slow.canceled:
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Handler's context was not canceled")
+	}
+	if fast.handled != 1 {
+		t.Errorf("Other handlers should still handle, got %d", fast.handled)
+	}
+}
+
+// fileHandler reads the uploaded file after its request's context is done
+type fileHandler struct {
+	testHandler
+	read chan string
+}
+
+func (h *fileHandler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+	<-req.Context().Done()
+	time.Sleep(50 * time.Millisecond)
+	f, _, err := req.FormFile("file")
+	if err != nil {
+		h.read <- err.Error()
+		return
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		h.read <- err.Error()
+		return
+	}
+	h.read <- string(b)
+}
+
+func TestGetHandleFunc_TimeoutFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-multipart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tmpdir := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", dir)
+	defer os.Setenv("TMPDIR", tmpdir)
+
+	h := &fileHandler{read: make(chan string, 1)}
+	err = h.Unmarshal(map[string]interface{}{
+		handler.LabelAllowedOrigins: []interface{}{"https://example.com"},
+		handler.LabelTimeout:        "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := testConfig(handler.Limits{}, h).getHandleFunc(DefaultDomain, "/test")
+
+	large := strings.Repeat("a", int(2*maxFormMemory))
+	req := multipartRequest(t, map[string]string{"file": large})
+	if rw := serve(hf, req); rw.Code != http.StatusGatewayTimeout {
+		t.Errorf("Expected status 504, got %d", rw.Code)
+	}
+
+	select {
+	case content := <-h.read:
+		if content != large {
+			t.Errorf("Handler that timed out should still read the file, got %.40q",
+				content)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler did not read the file")
+	}
+	waitForEmpty(t, dir)
+}
+
+// lateHandler handles submissions after its request's context is done
+type lateHandler struct {
+	testHandler
+}
+
+func (h *lateHandler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	<-req.Context().Done()
+	h.testHandler.Handle(req, ch, wg)
+}
+
+func TestProcessJob_Timeout(t *testing.T) {
+	late := &lateHandler{}
+	err := late.Unmarshal(map[string]interface{}{
+		handler.LabelAllowedOrigins: []interface{}{"https://example.com"},
+		handler.LabelTimeout:        "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig(handler.Limits{})
+	c.AddNamedHandler("/test", "test.handler", late)
+
+	req := formRequest(url.Values{"name": {"Joe Smith"}})
+	body, _ := ioutil.ReadAll(req.Body)
+	job := queue.NewJob("submission", "test.handler", req, body)
+	if err := c.processJob(job); err != nil {
+		t.Errorf("Job handled after the timeout should not be retried, got %s", err)
+	}
+	if late.handled != 1 {
+		t.Errorf("Handler should have handled the job once, handled %d",
+			late.handled)
+	}
+}
+
+func TestCreateServer_Domains(t *testing.T) {
+	def := newTestHandler(t, nil)
+	org := newTestHandler(t, nil)
+	c := testConfig(handler.Limits{})
+	c.AddHandler("/contact", def)
+	c.AddHandler("/feedback", def)
+	c.AddDomainHandler("Example.org", "/contact", "example.org/test.contact", org)
+	s := c.CreateServer()
+
+	tests := []struct {
+		host   string
+		path   string
+		status int
+		def    int
+		org    int
+	}{
+		{"example.org", "/contact", http.StatusOK, 0, 1},
+		{"EXAMPLE.ORG.:8080", "/contact", http.StatusOK, 0, 2},
+		{"example.com", "/contact", http.StatusOK, 1, 2},
+		// Known domains do not fall back to the default handlers
+		{"example.org", "/feedback", http.StatusNotFound, 1, 2},
+		{"example.com", "/feedback", http.StatusOK, 2, 2}}
+
+	for _, test := range tests {
+		req := formRequest(url.Values{})
+		req.Host = test.host
+		req.URL.Path = test.path
+		req.RequestURI = test.path
+		rw := httptest.NewRecorder()
+		s.Handler.ServeHTTP(rw, req)
+
+		if rw.Code != test.status {
+			t.Errorf("%s%s: expected status %d, got %d", test.host, test.path,
+				test.status, rw.Code)
+		}
+		if def.handled != test.def || org.handled != test.org {
+			t.Errorf("%s%s: expected %d/%d default/example.org submissions, got %d/%d",
+				test.host, test.path, test.def, test.org, def.handled, org.handled)
+		}
+	}
+
+	if c.GetNamedHandler("example.org/test.contact") != org {
+		t.Error("Domain handler should be found by name")
+	}
+}
+
+func TestGetHandleFunc_Validation(t *testing.T) {
+	strict := newTestHandler(t, map[string]interface{}{
+		handler.LabelFields: map[string]interface{}{
+			"email": map[string]interface{}{"required": true, "type": "email"}}})
+	other := newTestHandler(t, map[string]interface{}{
+		handler.LabelFields: map[string]interface{}{
+			"name": map[string]interface{}{"required": true}}})
+	hf := testConfig(handler.Limits{}, strict, other).getHandleFunc(DefaultDomain, "/test")
+
+	req := formRequest(url.Values{"email": {"joe"}})
+	req.Header.Set("Accept", "application/json")
+	rw := serve(hf, req)
+
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", rw.Code)
+	}
+	resp := jsonResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Errors) != 2 || resp.Errors["email"] == "" || resp.Errors["name"] == "" {
+		t.Errorf("Errors from all handlers' fields should be returned, got %#v",
+			resp.Errors)
+	}
+	// No handler runs if any of them rejects the submission
+	if strict.handled != 0 || other.handled != 0 {
+		t.Errorf("Handlers should not handle invalid submissions, got %d/%d",
+			strict.handled, other.handled)
+	}
+
+	rw = serve(hf, formRequest(url.Values{"email": {"joe@example.com"}, "name": {"Joe"}}))
+	if rw.Code != http.StatusOK || strict.handled != 1 || other.handled != 1 {
+		t.Errorf("Valid submission should be handled, got status %d", rw.Code)
+	}
+}
+
+func TestGetHandleFunc_Spam(t *testing.T) {
+	h := newTestHandler(t, map[string]interface{}{
+		handler.LabelHoneypot: []interface{}{"pot", "url"},
+		handler.LabelSecret:   "s3cret",
+		handler.LabelTimeTrap: true})
+	hf := testConfig(handler.Limits{}, h).getHandleFunc(DefaultDomain, "/test")
+
+	// Forms fetch the time trap's token before being submitted
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/test", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rw := serve(hf, req)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 for issued fields, got %d", rw.Code)
+	}
+	if rw.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+		t.Error("Issued fields should be readable by the allowed origin")
+	}
+	issued := issueResponse{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &issued); err != nil {
+		t.Fatal(err)
+	}
+	if issued.Fields[handler.DefaultTimeTrapField] == "" {
+		t.Fatalf("Expected a time trap token, got %#v", issued.Fields)
+	}
+
+	req.Header.Set("Origin", "https://evil.com")
+	if rw = serve(hf, req); rw.Code == http.StatusOK {
+		t.Error("Fields should not be issued to origins that are not allowed")
+	}
+
+	// Spam gets the same response as a handled submission
+	token := issued.Fields[handler.DefaultTimeTrapField]
+	spam := []url.Values{
+		{handler.DefaultTimeTrapField: {token}},
+		{handler.DefaultTimeTrapField: {handler.TimeTrapToken("s3cret", "/test",
+			time.Now().Add(-time.Minute))}, "url": {"http://spam.com"}}}
+	for _, body := range spam {
+		if rw = serve(hf, formRequest(body)); rw.Code != http.StatusOK {
+			t.Errorf("Expected fake status 200 for spam, got %d", rw.Code)
+		}
+	}
+	if h.handled != 0 {
+		t.Errorf("Spam should not be handled, got %d", h.handled)
+	}
+
+	rw = serve(hf, formRequest(url.Values{handler.DefaultTimeTrapField: {
+		handler.TimeTrapToken("s3cret", "/test", time.Now().Add(-time.Minute))}}))
+	if rw.Code != http.StatusOK || h.handled != 1 {
+		t.Errorf("Submission passing the time trap should be handled, got status %d",
+			rw.Code)
+	}
+}
+
+func TestGetHandleFunc_Token(t *testing.T) {
+	h := newTestHandler(t, map[string]interface{}{
+		handler.LabelSecret:       "s3cret",
+		handler.LabelRequireToken: true,
+		handler.LabelFields: map[string]interface{}{
+			"name": map[string]interface{}{handler.LabelFieldRequired: true}}})
+	hf := testConfig(handler.Limits{}, h).getHandleFunc(DefaultDomain, "/test")
+
+	token, err := handler.FormToken("s3cret", "/test", "https://example.com",
+		time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(body url.Values) (int, string) {
+		req := formRequest(body)
+		req.Header.Set("Accept", "application/json")
+		rw := serve(hf, req)
+		resp := jsonResponse{}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return rw.Code, resp.Code
+	}
+
+	// A submission rejected for another reason does not use up the token
+	if status, _ := submit(url.Values{handler.DefaultTokenField: {token}}); status != http.StatusBadRequest {
+		t.Errorf("Invalid submission should return 400, got %d", status)
+	}
+	body := url.Values{handler.DefaultTokenField: {token}, "name": {"Joe"}}
+	if status, _ := submit(body); status != http.StatusOK || h.handled != 1 {
+		t.Errorf("Token should still be valid after a rejected submission, got %d",
+			status)
+	}
+
+	status, code := submit(body)
+	if status != http.StatusForbidden || code != handler.CodeInvalidToken {
+		t.Errorf("Reused token should return 403 %s, got %d %s",
+			handler.CodeInvalidToken, status, code)
+	}
+	if h.handled != 1 {
+		t.Error("Submission with a reused token should not be handled")
+	}
+}
+
+func TestGetHandleFunc_Captcha(t *testing.T) {
+	var mutex sync.Mutex
+	verified := 0
+	stub := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		verified++
+		mutex.Unlock()
+		if req.FormValue("secret") != "captcha-secret" {
+			t.Errorf("Expected the configured secret, got %s", req.FormValue("secret"))
+		}
+		if req.FormValue("response") == "human" {
+			rw.Write([]byte(`{"success": true, "score": 0.9}`))
+		} else {
+			rw.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer stub.Close()
+
+	conf := func() map[string]interface{} {
+		return map[string]interface{}{
+			handler.LabelCaptcha: map[string]interface{}{
+				handler.LabelCaptchaProvider:  "recaptcha",
+				handler.LabelCaptchaSecret:    "captcha-secret",
+				handler.LabelCaptchaMinScore:  0.5,
+				handler.LabelCaptchaVerifyURL: stub.URL}}
+	}
+	h1 := newTestHandler(t, conf())
+	h2 := newTestHandler(t, conf())
+	hf := testConfig(handler.Limits{}, h1, h2).getHandleFunc(DefaultDomain, "/test")
+
+	tests := []struct {
+		response string
+		status   int
+		code     string
+	}{
+		{"", http.StatusBadRequest, handler.CodeCaptchaMissing},
+		{"bot", http.StatusBadRequest, handler.CodeCaptchaFailed},
+		{"human", http.StatusOK, ""}}
+
+	for _, test := range tests {
+		mutex.Lock()
+		verified = 0
+		mutex.Unlock()
+
+		req := formRequest(url.Values{"g-recaptcha-response": {test.response}})
+		req.Header.Set("Accept", "application/json")
+		rw := serve(hf, req)
+		if rw.Code != test.status {
+			t.Errorf("Response \"%s\": expected status %d, got %d",
+				test.response, test.status, rw.Code)
+		}
+		resp := jsonResponse{}
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Code != test.code {
+			t.Errorf("Response \"%s\": expected code \"%s\", got \"%s\"",
+				test.response, test.code, resp.Code)
+		}
+		// Each response is only verified once, even with two handlers
+		if test.response != "" && verified != 1 {
+			t.Errorf("Response \"%s\": expected 1 verification, got %d",
+				test.response, verified)
+		}
+	}
+
+	if h1.handled != 1 || h2.handled != 1 {
+		t.Errorf("Only the verified submission should be handled, got %d/%d",
+			h1.handled, h2.handled)
+	}
+}
+
+func TestGetHandleFunc_RateLimit(t *testing.T) {
+	h := newTestHandler(t, map[string]interface{}{
+		handler.LabelRateLimit: map[string]interface{}{
+			handler.LabelRateLimitRequests: int64(1),
+			handler.LabelRateLimitPer:      "1h"}})
+	c := testConfig(handler.Limits{}, h)
+	err := c.unmarshalRateLimits(map[string]interface{}{
+		LabelPathRateLimits: map[string]interface{}{
+			"/test": map[string]interface{}{
+				handler.LabelRateLimitRequests: int64(2),
+				handler.LabelRateLimitPer:      "1m"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hf := c.getHandleFunc(DefaultDomain, "/test")
+
+	submit := func(ip string) *httptest.ResponseRecorder {
+		req := formRequest(url.Values{})
+		req.RemoteAddr = ip + ":1234"
+		return serve(hf, req)
+	}
+
+	if rw := submit("192.0.2.1"); rw.Code != http.StatusOK {
+		t.Fatalf("First submission should be handled, got status %d", rw.Code)
+	}
+
+	// The handler allows one submission per hour
+	rw := submit("192.0.2.1")
+	if rw.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", rw.Code)
+	}
+	if rw.Header().Get("Retry-After") != "3600" {
+		t.Errorf("Expected Retry-After of 3600, got \"%s\"",
+			rw.Header().Get("Retry-After"))
+	}
+
+	// The path allows two submissions per minute
+	rw = submit("192.0.2.1")
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "30" {
+		t.Errorf("Expected status 429 after 30 seconds, got %d after \"%s\"",
+			rw.Code, rw.Header().Get("Retry-After"))
+	}
+
+	if rw = submit("192.0.2.2"); rw.Code != http.StatusOK {
+		t.Errorf("Other clients should not be limited, got status %d", rw.Code)
+	}
+	if h.handled != 2 {
+		t.Errorf("Expected 2 handled submissions, got %d", h.handled)
+	}
+}
+
+func TestGetHandleFunc_SpamFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	model := bayes.New()
+	model.Train(bayes.Spam, "cheap pills, buy now")
+	model.Train(bayes.Spam, "cheap SEO backlinks")
+	model.Train(bayes.Ham, "could I get a quote for my garden")
+	model.Train(bayes.Ham, "what are your opening hours")
+	modelPath := filepath.Join(dir, "model.json")
+	if err := model.Save(modelPath); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := func(action string) *testHandler {
+		return newTestHandler(t, map[string]interface{}{
+			handler.LabelSpamFilter: map[string]interface{}{
+				handler.LabelSpamFilterModel:     modelPath,
+				handler.LabelSpamFilterThreshold: 0.6,
+				handler.LabelSpamFilterAction:    action}})
+	}
+	drop := filter(handler.SpamActionDrop)
+	quarantine := filter(handler.SpamActionQuarantine)
+	tag := filter(handler.SpamActionTag)
+	c := testConfig(handler.Limits{})
+	c.DataDir = dir
+	c.AddNamedHandler("/test", "drop", drop)
+	c.AddNamedHandler("/test", "quarantine", quarantine)
+	c.AddNamedHandler("/test", "tag", tag)
+	hf := c.getHandleFunc(DefaultDomain, "/test")
+
+	rw := serve(hf, formRequest(url.Values{"message": {"buy cheap pills"}}))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Spam should get a fake status 200, got %d", rw.Code)
+	}
+	if drop.handled != 0 || quarantine.handled != 0 || tag.handled != 1 {
+		t.Errorf("Only the handler tagging spam should handle it, got %d/%d/%d",
+			drop.handled, quarantine.handled, tag.handled)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, quarantineDir,
+		rw.Header().Get(submissionIDHeader)+".json"))
+	if err != nil {
+		t.Fatalf("Spam should have been quarantined: %s", err)
+	}
+	q := quarantined{}
+	if err := json.Unmarshal(b, &q); err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Handlers) != 1 || q.Handlers[0] != "quarantine" ||
+		q.Fields["message"][0] != "buy cheap pills" {
+		t.Errorf("Unexpected quarantined submission: %#v", q)
+	}
+
+	serve(hf, formRequest(url.Values{"message": {"a quote for my garden"}}))
+	if drop.handled != 1 || quarantine.handled != 1 || tag.handled != 2 {
+		t.Errorf("Ham should be handled by all handlers, got %d/%d/%d",
+			drop.handled, quarantine.handled, tag.handled)
+	}
+}
@@ -0,0 +1,116 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+func (c *Config) unmarshalTimeouts(data map[string]interface{}) (err error) {
+	timeouts := []struct {
+		label string
+		value *time.Duration
+		def   time.Duration
+	}{
+		{LabelReadTimeout, &c.ReadTimeout, DefaultReadTimeout},
+		{LabelReadHeaderTimeout, &c.ReadHeaderTimeout, DefaultReadHeaderTimeout},
+		{LabelWriteTimeout, &c.WriteTimeout, DefaultWriteTimeout},
+		{LabelIdleTimeout, &c.IdleTimeout, DefaultIdleTimeout},
+		{LabelHandlerTimeout, &c.HandlerTimeout, DefaultHandlerTimeout},
+		{LabelShutdownTimeout, &c.ShutdownTimeout, DefaultShutdownTimeout}}
+
+	for _, t := range timeouts {
+		*t.value, err = handler.DurationOrDefault(data[t.label], t.def)
+		if err != nil {
+			return fmt.Errorf(e.ErrConfigItem, t.label, err)
+		}
+		if *t.value < 0 {
+			return fmt.Errorf(e.ErrConfigItem, t.label, "must be non-negative")
+		}
+	}
+
+	if c.WriteTimeout != 0 && (c.HandlerTimeout == 0 ||
+		c.HandlerTimeout >= c.WriteTimeout) {
+		c.Logger.Logf("Warning: %s should be shorter than %s, or responses "+
+			"may not reach clients", LabelHandlerTimeout, LabelWriteTimeout)
+	}
+
+	return nil
+}
+
+// handlerTimeout returns how long the given handler may take to handle a
+// submission, or zero for no limit
+func (c *Config) handlerTimeout(h handler.Handler) time.Duration {
+	if t := h.Timeout(); t != 0 {
+		return t
+	}
+	return c.HandlerTimeout
+}
+
+// handlerContext returns the context to run a handler with, which is done
+// when the timeout passes, if it is not zero
+func handlerContext(req *http.Request, timeout time.Duration) (context.Context,
+	context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(req.Context(), timeout)
+	}
+	return context.WithCancel(req.Context())
+}
+
+// runHandler runs the handler with a deadline on the request's context, so
+// the handler can stop working once it is no longer waited for. If the
+// handler does not finish in time, a 504 (Gateway Timeout) error is sent on
+// ch instead of its result. Since the handler may keep running after that,
+// running is only marked done once it returns.
+func runHandler(h handler.Handler, req *http.Request, timeout time.Duration,
+	ch chan *e.HTTPError, wg *sync.WaitGroup, running *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx, cancel := handlerContext(req, timeout)
+	defer cancel()
+
+	// The handler gets its own channel so that a late result is not sent
+	// on ch after it was closed
+	hCh := make(chan *e.HTTPError, 1)
+	var hWg sync.WaitGroup
+	hWg.Add(1)
+	go h.Handle(req.WithContext(ctx), hCh, &hWg)
+
+	done := make(chan struct{})
+	go func() {
+		hWg.Wait()
+		close(done)
+		running.Done()
+	}()
+
+	select {
+	case <-done:
+		close(hCh)
+		for err := range hCh {
+			ch <- err
+		}
+	case <-ctx.Done():
+		// Discard late results so that the handler can return
+		go func() {
+			<-done
+			close(hCh)
+		}()
+		go func() {
+			for range hCh {
+			}
+		}()
+		if ctx.Err() == context.DeadlineExceeded {
+			ch <- e.NewHTTPError(fmt.Sprintf(
+				"handler did not finish within %s", timeout),
+				http.StatusGatewayTimeout)
+		} else {
+			ch <- e.NewHTTPError("request was canceled",
+				http.StatusGatewayTimeout)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloader holds the certificate and client CA pool used by the TLS
+// listener. The files are read again by reload, so new connections pick up
+// renewed certificates without restarting the server.
+type certReloader struct {
+	mutex     sync.RWMutex
+	certFile  string
+	keyFile   string
+	caFile    string
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// reload reads the certificate, key, and client CA files from disk. The
+// previously loaded values are kept if any of them fail to load.
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load TLS certificate: %s", err)
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("could not load TLS client CA: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf(
+				"no PEM-encoded certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.mutex.Unlock()
+	return nil
+}
+
+// files returns the paths of all files the reloader reads from
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// watches returns whether the given file is one that the reloader reads from
+func (r *certReloader) watches(file string) bool {
+	file = filepath.Clean(file)
+	for _, f := range r.files() {
+		if filepath.Clean(f) == file {
+			return true
+		}
+	}
+	return false
+}
+
+// dirs returns the directories of the files the reloader reads from
+func (r *certReloader) dirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, f := range r.files() {
+		dir := filepath.Dir(filepath.Clean(f))
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// changedBy returns whether the event in one of the watched directories may
+// have changed the reloader's files. Certificates are often rotated by
+// replacing the files rather than writing to them, which shows up as the
+// files being created again. Kubernetes replaces the files of a secret all
+// at once, by creating a symbolic link whose name starts with "..".
+func (r *certReloader) changedBy(event fsnotify.Event) bool {
+	if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+		return false
+	}
+	if r.watches(event.Name) {
+		return true
+	}
+
+	name := filepath.Clean(event.Name)
+	if event.Op&fsnotify.Create == 0 || !strings.HasPrefix(filepath.Base(name), "..") {
+		return false
+	}
+	for _, dir := range r.dirs() {
+		if filepath.Dir(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.RLock()
+	pool := r.clientCAs
+	r.mutex.RUnlock()
+
+	// Without client verification, the server's own config is enough
+	if pool == nil {
+		return nil, nil
+	}
+
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"h2", "http/1.1"},
+		GetCertificate: r.getCertificate,
+		ClientAuth:     tls.RequireAndVerifyClientCert,
+		ClientCAs:      pool}, nil
+}
+
+func (c *Config) unmarshalTLS(data map[string]interface{}) (err error) {
+	c.certs = nil
+
+	c.TLSCert, err = parse.StringOrDefault(data[LabelTLSCert], "")
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelTLSCert, err)
+	}
+
+	c.TLSKey, err = parse.StringOrDefault(data[LabelTLSKey], "")
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelTLSKey, err)
+	}
+
+	c.TLSClientCA, err = parse.StringOrDefault(data[LabelTLSClientCA], "")
+	if err != nil {
+		return fmt.Errorf(e.ErrConfigItem, LabelTLSClientCA, err)
+	}
+
+	if c.TLSCert == "" && c.TLSKey == "" {
+		if c.TLSClientCA != "" {
+			return fmt.Errorf("%s requires %s and %s to be set",
+				LabelTLSClientCA, LabelTLSCert, LabelTLSKey)
+		}
+		return nil
+	} else if c.TLSCert == "" || c.TLSKey == "" {
+		return fmt.Errorf("%s and %s must be set together",
+			LabelTLSCert, LabelTLSKey)
+	}
+
+	c.certs = &certReloader{
+		certFile: c.TLSCert,
+		keyFile:  c.TLSKey,
+		caFile:   c.TLSClientCA}
+
+	return c.certs.reload()
+}
+
+// TLSEnabled returns whether the server should be served over HTTPS
+func (c *Config) TLSEnabled() bool {
+	return c.certs != nil
+}
+
+// TLSConfig returns the *tls.Config to serve HTTPS with, or nil if TLS is not
+// configured. Certificates are looked up on every handshake, so calling
+// ReloadCertificates affects servers already using this config.
+func (c *Config) TLSConfig() *tls.Config {
+	if c.certs == nil {
+		return nil
+	}
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         []string{"h2", "http/1.1"},
+		GetCertificate:     c.certs.getCertificate,
+		GetConfigForClient: c.certs.getConfigForClient}
+}
+
+// ReloadCertificates reads the TLS certificate, key, and client CA files
+// again. If loading fails, the previous certificates remain in use.
+func (c *Config) ReloadCertificates() error {
+	if c.certs == nil {
+		return errors.New("TLS is not configured")
+	}
+	return c.certs.reload()
+}
+
+// WatchCertificates watches the TLS certificate, key, and client CA files
+// and reloads them on changes. Unlike files added with WatchFile, changes to
+// these files do not cause the whole configuration to be reloaded. The
+// directories holding the files are watched, so that files replaced by new
+// ones are still noticed.
+func (c *Config) WatchCertificates(ch chan string) error {
+	if c.certs == nil {
+		return nil
+	}
+
+	for _, dir := range c.certs.dirs() {
+		if err := c.watch(dir, ch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
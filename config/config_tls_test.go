@@ -0,0 +1,112 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	l "gitlab.com/BluestNight/nebula-forms/log"
+)
+
+// writeCertificate writes a new self-signed certificate and its key with
+// the given common name, replacing each file atomically like certbot or
+// Kubernetes do
+func writeCertificate(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		path  string
+		block *pem.Block
+	}{
+		{keyFile, &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}},
+		{certFile, &pem.Block{Type: "CERTIFICATE", Bytes: der}}}
+	for _, f := range files {
+		tmp := f.path + ".tmp"
+		if err = ioutil.WriteFile(tmp, pem.EncodeToMemory(f.block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(tmp, f.path); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// servedName returns the common name of the certificate served to clients
+func servedName(t *testing.T, c *Config) string {
+	cert, err := c.TLSConfig().GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestWatchCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	c := &Config{Logger: &l.Logger{}}
+	err = c.unmarshalTLS(map[string]interface{}{
+		LabelTLSCert: certFile,
+		LabelTLSKey:  keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.WatchCertificates(make(chan string, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer c.StopWatchingAll()
+
+	if name := servedName(t, c); name != "first" {
+		t.Fatalf("Expected the first certificate, got %s", name)
+	}
+
+	// Replacing the files more than once checks that the watch survives
+	for _, name := range []string{"second", "third"} {
+		writeCertificate(t, certFile, keyFile, name)
+		deadline := time.Now().Add(5 * time.Second)
+		for servedName(t, c) != name {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the %s certificate", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
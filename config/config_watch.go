@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"path/filepath"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -11,6 +12,26 @@ import (
 // Spawns a goroutine that can be ended by calling Config.StopWatching or
 // Config.StopWatchingAll.
 func (c *Config) WatchFile(filename string, ch chan string) error {
+	c.wMutex.Lock()
+	if c.watched == nil {
+		c.watched = make(map[string]bool)
+	}
+	c.watched[filepath.Clean(filename)] = true
+	c.wMutex.Unlock()
+
+	return c.watch(filename, ch)
+}
+
+// isWatched returns whether the file was added with WatchFile
+func (c *Config) isWatched(filename string) bool {
+	c.wMutex.Lock()
+	defer c.wMutex.Unlock()
+	return c.watched[filepath.Clean(filename)]
+}
+
+// watch adds the file or directory to the file watcher, creating the watcher
+// and the goroutine handling its events if necessary
+func (c *Config) watch(filename string, ch chan string) error {
 	if c.fWatcher == nil {
 		var err error
 		c.fWatcher, err = fsnotify.NewWatcher()
@@ -18,13 +39,23 @@ func (c *Config) WatchFile(filename string, ch chan string) error {
 			return fmt.Errorf("error creating file watcher: %s", err)
 		}
 
-		go func(ch chan string) {
+		// The goroutine ends when the watcher is closed, which closes its
+		// channels
+		go func(w *fsnotify.Watcher, ch chan string) {
 			for {
-				if c.fWatcher == nil {
-					break
-				}
 				select {
-				case event := <-c.fWatcher.Events:
+				case event, ok := <-w.Events:
+					if !ok {
+						return
+					}
+					if c.certs != nil && c.certs.changedBy(event) {
+						c.certificateChanged(event)
+						continue
+					}
+					// Other files in the directories of TLS files
+					if !c.isWatched(event.Name) {
+						continue
+					}
 					// Include rename because some editors use swap files,
 					// which causes the rename op to be returned
 					if event.Op&fsnotify.Write == fsnotify.Write ||
@@ -32,15 +63,14 @@ func (c *Config) WatchFile(filename string, ch chan string) error {
 						c.Logger.Logln("Detected file change")
 						ch <- event.Name
 					}
-				case err := <-c.fWatcher.Errors:
-					if err != nil {
-						c.Logger.Errorf("Error while watching file: %s", err)
-					} else {
-						break
+				case err, ok := <-w.Errors:
+					if !ok {
+						return
 					}
+					c.Logger.Errorf("Error while watching file: %s", err)
 				}
 			}
-		}(ch)
+		}(c.fWatcher, ch)
 	}
 
 	c.Logger.Debugf("Adding watcher for %s", filename)
@@ -58,6 +88,9 @@ func (c *Config) WatchFile(filename string, ch chan string) error {
 // For that, use Config.StopWatchingAll.
 func (c *Config) StopWatching(file string) error {
 	c.Logger.Debugf("Removing watcher for %s", file)
+	if c.fWatcher == nil {
+		return nil
+	}
 	return c.fWatcher.Remove(file)
 }
 
@@ -66,7 +99,23 @@ func (c *Config) StopWatching(file string) error {
 // files.
 func (c *Config) StopWatchingAll() error {
 	c.Logger.Debug("Ending watching of all files")
+	// Nothing is watched if WatchFile was never called
+	if c.fWatcher == nil {
+		return nil
+	}
 	err := c.fWatcher.Close()
 	c.fWatcher = nil
 	return err
 }
+
+// certificateChanged reloads the TLS certificates after one of their files
+// changed
+func (c *Config) certificateChanged(event fsnotify.Event) {
+	c.Logger.Logf("Detected change to TLS file %s; reloading certificates",
+		event.Name)
+	if err := c.ReloadCertificates(); err != nil {
+		c.Logger.Errorf(
+			"Error reloading TLS certificates: %s\nReusing old certificates\n",
+			err)
+	}
+}
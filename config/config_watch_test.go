@@ -0,0 +1,17 @@
+package config
+
+import (
+	"testing"
+
+	l "gitlab.com/BluestNight/nebula-forms/log"
+)
+
+func TestStopWatchingWithoutWatcher(t *testing.T) {
+	c := &Config{Logger: &l.Logger{}}
+	if err := c.StopWatching("forms.toml"); err != nil {
+		t.Errorf("Expected no error stopping an unwatched file, got %s", err)
+	}
+	if err := c.StopWatchingAll(); err != nil {
+		t.Errorf("Expected no error when nothing is watched, got %s", err)
+	}
+}
@@ -18,4 +18,8 @@ const DefaultDebugFile = "/var/log/nebula-forms/debug.log"
 
 // DefaultPluginDir contains the default location of handler plugins
 // (on FreeBSD systems)
-const DefaultPluginDir = "/usr/local/lib/nebula-forms/plugins"
\ No newline at end of file
+const DefaultPluginDir = "/usr/local/lib/nebula-forms/plugins"
+
+// DefaultDataDir contains the default location of data stored by the server,
+// such as queued submissions (on FreeBSD systems)
+const DefaultDataDir = "/var/db/nebula-forms"
\ No newline at end of file
@@ -18,4 +18,8 @@ const DefaultDebugFile = "/var/log/nebula-forms/debug.log"
 
 // DefaultPluginDir contains the default location of handler plugins
 // (on Linux systems)
-const DefaultPluginDir = "/usr/lib/nebula-forms/plugins"
\ No newline at end of file
+const DefaultPluginDir = "/usr/lib/nebula-forms/plugins"
+
+// DefaultDataDir contains the default location of data stored by the server,
+// such as queued submissions (on Linux systems)
+const DefaultDataDir = "/var/lib/nebula-forms"
\ No newline at end of file
@@ -1,5 +1,7 @@
 package errors
 
+import "net/http"
+
 // Errors are created here so they can be referenced later
 
 // ErrBaseConfig is a template for an error where a set of configuration
@@ -15,6 +17,9 @@ const ErrConfigItem = "could not parse \"%s\": %s"
 type HTTPError struct {
 	err    string
 	status int
+	code   string
+	fields map[string]string
+	header http.Header
 }
 
 // NewHTTPError returns a new instance of HTTPError
@@ -24,6 +29,22 @@ func NewHTTPError(e string, s int) *HTTPError {
 		status: s}
 }
 
+// NewFieldError returns a new instance of HTTPError describing a problem
+// with the value of a single form field
+func NewFieldError(field string, e string, s int) *HTTPError {
+	err := NewHTTPError(e, s)
+	err.AddFieldError(field, e)
+	return err
+}
+
+// NewCodedError returns a new instance of HTTPError with a machine-readable
+// code, so that clients can tell apart errors with the same status
+func NewCodedError(code string, e string, s int) *HTTPError {
+	err := NewHTTPError(e, s)
+	err.code = code
+	return err
+}
+
 func (e HTTPError) Error() string {
 	return e.err
 }
@@ -33,6 +54,42 @@ func (e HTTPError) Status() int {
 	return e.status
 }
 
+// Code returns the machine-readable code of this Error, or an empty string
+// if it has none
+func (e HTTPError) Code() string {
+	return e.code
+}
+
+// AddFieldError records an error message for the form field with the given
+// name. If the field already has an error, it is replaced.
+func (e *HTTPError) AddFieldError(field string, msg string) {
+	if e.fields == nil {
+		e.fields = make(map[string]string)
+	}
+	e.fields[field] = msg
+}
+
+// FieldErrors returns the error messages for individual form fields, keyed by
+// the name of the field. The returned map must not be modified.
+func (e HTTPError) FieldErrors() map[string]string {
+	return e.fields
+}
+
+// SetHeader sets a header to send with the response to the client, such as
+// Retry-After
+func (e *HTTPError) SetHeader(key string, value string) {
+	if e.header == nil {
+		e.header = make(http.Header)
+	}
+	e.header.Set(key, value)
+}
+
+// Header returns the headers to send with the response to the client. The
+// returned map must not be modified.
+func (e HTTPError) Header() http.Header {
+	return e.header
+}
+
 // HTTPErrorToChan provides a function for sending an HTTPError on a channel,
 // creating the HTTPError if necessary, using `def` as the status code.
 func HTTPErrorToChan(ch chan *HTTPError, err error, def int) {
@@ -2,7 +2,7 @@ package errors
 
 import (
 	"errors"
-	"http"
+	"net/http"
 	"testing"
 )
 
@@ -17,6 +17,17 @@ func TestNewHTTPError(t *testing.T) {
 	}
 }
 
+func TestNewCodedError(t *testing.T) {
+	err := NewCodedError("code", "error", http.StatusBadRequest)
+	if err.Code() != "code" {
+		t.Errorf("Code should be \"code\", not \"%s\"", err.Code())
+	}
+
+	if NewHTTPError("error", http.StatusBadRequest).Code() != "" {
+		t.Error("Errors should have no code by default")
+	}
+}
+
 func TestHTTPErrorToChan(t *testing.T) {
 	// Non-default status code
 	httperr := NewHTTPError("error", http.StatusNoContent)
@@ -24,11 +35,12 @@ func TestHTTPErrorToChan(t *testing.T) {
 	// Very non-default status code
 	def := http.StatusTeapot
 	// Buffered so no goroutines are needed
-	ch := make(chan HTTPError, 2)
+	ch := make(chan *HTTPError, 2)
 
 	// Call for both errors
 	HTTPErrorToChan(ch, httperr, def)
 	HTTPErrorToChan(ch, err, def)
+	close(ch)
 
 	for e := range ch {
 		switch e.Status() {
@@ -47,3 +59,31 @@ func TestHTTPErrorToChan(t *testing.T) {
 		}
 	}
 }
+
+func TestHTTPError_FieldErrors(t *testing.T) {
+	err := NewHTTPError("error", http.StatusBadRequest)
+	if len(err.FieldErrors()) != 0 {
+		t.Errorf("New HTTPError should not have field errors: %#v",
+			err.FieldErrors())
+	}
+
+	err = NewFieldError("email", "not an email address", http.StatusBadRequest)
+	if err.Error() != "not an email address" {
+		t.Errorf("Error string should be the field's message, not \"%s\"",
+			err.Error())
+	}
+
+	err.AddFieldError("name", "required")
+	err.AddFieldError("email", "required")
+	fields := err.FieldErrors()
+	if len(fields) != 2 {
+		t.Errorf("Expected errors for 2 fields, got %#v", fields)
+	}
+	if fields["email"] != "required" {
+		t.Errorf("Adding a field error should replace the existing one, got \"%s\"",
+			fields["email"])
+	}
+	if fields["name"] != "required" {
+		t.Errorf("Wrong error for \"name\": %s", fields["name"])
+	}
+}
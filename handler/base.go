@@ -3,9 +3,13 @@ package handler
 import (
 	"fmt"
 	"net/http"
+	"regexp"
+	"text/template"
+	"time"
 
 	"gitlab.com/BluestNight/nebula-forms/errors"
 	"gitlab.com/BluestNight/nebula-forms/log"
+	"gitlab.com/BluestNight/nebula-forms/ratelimit"
 	"github.com/Shadow53/interparser/parse"
 )
 
@@ -14,9 +18,25 @@ import (
 // required functions of one. It is intended to be anonymously included into
 // another struct that provides the actual handling of the form.
 type Base struct {
-	origins          map[string]struct{}
-	honeypot         string
-	handleConditions map[string]*handleCondition
+	origins           []originMatcher
+	originPatterns    []*regexp.Regexp
+	originFromReferer bool
+	honeypots         []string
+	secret            string
+	timeTrap          *timeTrap
+	spamFilter        *spamFilter
+	token             *formToken
+	captcha           *captcha
+	pow               *proofOfWork
+	handleConditions  map[string]*handleCondition
+	conditions        []condition
+	fields            map[string]FieldSpec
+	cors              CORS
+	limits            Limits
+	timeout           time.Duration
+	rateLimit         *ratelimit.Limiter
+	successRedirect   *template.Template
+	errorRedirect     *template.Template
 }
 
 func (h *Base) Unmarshal(data interface{}) error {
@@ -26,141 +46,192 @@ func (h *Base) Unmarshal(data interface{}) error {
 		return fmt.Errorf(errors.ErrConfigItem, "handler", err)
 	}
 
-	// Parse honeypot field, if exists
-	h.honeypot, err = parse.StringOrDefault(d[LabelHoneypot], "")
-	if err != nil {
-		return fmt.Errorf(errors.ErrConfigItem, LabelHoneypot, err)
+	// Parse honeypot fields and time trap, if they exist
+	if err = h.unmarshalSpam(d); err != nil {
+		return err
+	}
+
+	// Parse the spam filter, which needs the honeypots
+	if err = h.unmarshalSpamFilter(d); err != nil {
+		return err
+	}
+
+	// Parse form token requirement, which needs the secret
+	if err = h.unmarshalToken(d); err != nil {
+		return err
+	}
+
+	// Parse proof of work options, which need the secret
+	if err = h.unmarshalProofOfWork(d); err != nil {
+		return err
+	}
+
+	// Parse CAPTCHA options
+	if err = h.unmarshalCaptcha(d); err != nil {
+		return err
 	}
 
 	// Parse allowed origins
-	origins, err := parse.Slice(d[LabelAllowedOrigins])
+	if err = h.unmarshalOrigins(d); err != nil {
+		return err
+	}
+
+	// Parse CORS options
+	headers, err := parse.SliceOrNil(d[LabelAllowedHeaders])
 	if err != nil {
-		return fmt.Errorf(
-			errors.ErrConfigItem, LabelAllowedOrigins, err)
+		return fmt.Errorf(errors.ErrConfigItem, LabelAllowedHeaders, err)
+	}
+
+	h.cors = CORS{}
+	if headers == nil {
+		h.cors.AllowedHeaders = DefaultAllowedHeaders
 	}
-	h.origins = make(map[string]struct{})
 
-	for _, origin := range origins {
-		o, err := parse.String(origin)
+	for _, header := range headers {
+		hdr, err := parse.String(header)
 		if err != nil {
-			return fmt.Errorf(
-				errors.ErrConfigItem, LabelAllowedOrigins, err)
+			return fmt.Errorf(errors.ErrConfigItem, LabelAllowedHeaders, err)
 		}
-		h.origins[o] = struct{}{}
+		h.cors.AllowedHeaders = append(h.cors.AllowedHeaders,
+			http.CanonicalHeaderKey(hdr))
 	}
 
-	// Parse handling conditions
-	if d[LabelHandleIf] != nil {
-		conditions, err := parse.MapStringKeys(d[LabelHandleIf])
+	h.cors.MaxAge, err = parse.Int64OrDefault(d[LabelCORSMaxAge], 0)
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelCORSMaxAge, err)
+	}
+	if h.cors.MaxAge < 0 {
+		return fmt.Errorf(errors.ErrConfigItem, LabelCORSMaxAge,
+			"must be non-negative")
+	}
+
+	h.cors.AllowCredentials, err = parse.BoolOrDefault(
+		d[LabelAllowCredentials], false)
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelAllowCredentials, err)
+	}
+
+	// Parse size limits, using zero to fall back to the server's limits
+	h.limits = Limits{}
+	limits := []struct {
+		label string
+		value *int64
+	}{
+		{LabelMaxBodySize, &h.limits.MaxBodySize},
+		{LabelMaxFileSize, &h.limits.MaxFileSize},
+		{LabelMaxFiles, &h.limits.MaxFiles}}
+
+	for _, limit := range limits {
+		*limit.value, err = parse.Int64OrDefault(d[limit.label], 0)
 		if err != nil {
-			return fmt.Errorf(errors.ErrConfigItem, LabelHandleIf, err)
+			return fmt.Errorf(errors.ErrConfigItem, limit.label, err)
+		}
+		if *limit.value < 0 {
+			return fmt.Errorf(errors.ErrConfigItem, limit.label,
+				"must be non-negative")
 		}
+	}
 
-		// Parse allowed value slices
-		for key, val := range conditions {
-			cond := handleCondition{}
-
-			cond.MustBeNonEmpty, err = parse.Bool(val)
-			if err != nil {
-				s, err := parse.Slice(val)
-				if err != nil {
-					return fmt.Errorf(errors.ErrConfigItem,
-						fmt.Sprintf("%s (%s)", LabelHandleIf, key), err)
-				}
-
-				// Make sure list of values is not empty
-				if len(s) == 0 {
-					return fmt.Errorf(errors.ErrConfigItem,
-						fmt.Sprintf("%s (%s)", LabelHandleIf, key),
-						"list of values must contain at least one value")
-				}
-
-				// Parse list for values
-				for _, str := range s {
-					allowedVal, err := parse.String(str)
-					if err != nil {
-						return fmt.Errorf(errors.ErrConfigItem,
-							fmt.Sprintf("%s (%s)", LabelHandleIf, key), err)
-					}
-					// Initialize map if nil
-					if cond.AllowedValues == nil {
-						cond.AllowedValues = make(map[string]struct{})
-					}
-					cond.AllowedValues[allowedVal] = struct{}{}
-				}
-			}
+	// Parse the timeout, using zero to fall back to the server's timeout
+	h.timeout, err = DurationOrDefault(d[LabelTimeout], 0)
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelTimeout, err)
+	}
+	if h.timeout < 0 {
+		return fmt.Errorf(errors.ErrConfigItem, LabelTimeout,
+			"must be non-negative")
+	}
 
-			if h.handleConditions == nil {
-				h.handleConditions = make(map[string]*handleCondition)
-			}
+	// Parse the rate limit, if any
+	h.rateLimit, err = ParseRateLimit(LabelRateLimit, d[LabelRateLimit])
+	if err != nil {
+		return err
+	}
+
+	// Parse redirect templates
+	h.successRedirect, err = parseRedirect(d, LabelSuccessRedirect)
+	if err != nil {
+		return err
+	}
+
+	h.errorRedirect, err = parseRedirect(d, LabelErrorRedirect)
+	if err != nil {
+		return err
+	}
+
+	// Parse field definitions
+	if err = h.unmarshalFields(d); err != nil {
+		return err
+	}
 
-			h.handleConditions[key] = &cond
+	// Parse handling conditions
+	h.handleConditions = nil
+	h.conditions = nil
+	if d[LabelHandleIf] != nil {
+		set, err := parseConditionSet("", d[LabelHandleIf])
+		if err != nil {
+			return err
 		}
+		if len(set.fields) > 0 {
+			h.handleConditions = set.fields
+		}
+		h.conditions = set.others
 	}
 
 	return nil
 }
 
 func (h Base) ShouldHandle(req *http.Request, l *log.Logger) (bool, error) {
-	if h.OriginAllowed(req.Header.Get("Origin")) {
-		l.Debugf("Connection from origin %s is allowed", req.Header.Get("Origin"))
+	origin := h.RequestOrigin(req)
+	if h.OriginAllowed(origin) {
+		l.Debugf("Connection from origin %s is allowed", origin)
 		err := req.ParseForm()
 		if err != nil {
 			l.Errorf("Error while parsing form: %s", err)
 			return false, err
 		}
 
-		if req.FormValue(h.Honeypot()) != "" {
-			l.Debug("Request fell into the honeypot")
+		if spam, reason := h.Spam(req); spam {
+			l.Debugf("Request looks like spam: %s", reason)
 			return false, nil
 		}
 
 		for input, cond := range h.handleConditions {
 			l.Debugf("Checking input %s for validity", input)
-			if cond.MustBeNonEmpty && req.FormValue(input) == "" {
-				l.Debugf("Input %s must not be empty but is anyways")
+			if !cond.matches(req.Form[input]) {
+				l.Debugf("Form value(s) %#v of input %s do not meet the conditions",
+					req.Form[input], input)
 				return false, nil
 			}
+		}
 
-			if len(cond.AllowedValues) > 0 {
-				vals := req.Form[input]
-				isAllowed := false
-				if len(vals) > 0 {
-					for _, str := range vals {
-						if _, ok := cond.AllowedValues[str]; ok {
-							isAllowed = true
-							break
-						}
-					}
-				} else if _, ok := cond.AllowedValues[""]; ok {
-					isAllowed = true
-				}
-
-				if !isAllowed {
-					l.Debugf("Form value(s) is %#v, not one of %#v", vals, cond.AllowedValues)
-					return false, nil
-				}
+		for _, cond := range h.conditions {
+			if !cond.matches(req) {
+				l.Debugf("Request does not meet the conditions in %s", LabelHandleIf)
+				return false, nil
 			}
 		}
-		l.Debugf("Connection from %s is allowed", req.Header.Get("Origin"))
+		l.Debugf("Connection from %s is allowed", origin)
 		return true, nil
 	}
-	l.Debugf("Origin %s is not in %#v", req.Header.Get("Origin"), h.origins)
+	l.Debugf("Origin %s is not allowed", origin)
 	return false, nil
 }
 
-// OriginAllowed returns whether the given origin is allowed to access
-// this handler
-func (h Base) OriginAllowed(origin string) bool {
-	_, ok := h.origins[origin]
-	if !ok {
-		_, ok = h.origins["*"]
-	}
-	return ok
+// CORS returns the options for answering cross-origin requests
+// to this handler
+func (h Base) CORS() CORS {
+	return h.cors
+}
+
+// Limits returns the limits on the size of submissions to this handler.
+// Zero values mean the server-wide limits apply.
+func (h Base) Limits() Limits {
+	return h.limits
 }
 
-// Honeypot returns the name of the form field that is the honeypot
-// against spam bots
-func (h Base) Honeypot() string {
-	return h.honeypot
+// Timeout returns the maximum time this handler may take to handle a
+// submission. Zero means the server-wide timeout applies.
+func (h Base) Timeout() time.Duration {
+	return h.timeout
 }
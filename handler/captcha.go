@@ -0,0 +1,225 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options in LabelCaptcha
+var (
+	// LabelCaptchaProvider is the label for the CAPTCHA provider, one of the
+	// keys of CaptchaProviders.
+	LabelCaptchaProvider = "provider"
+	// LabelCaptchaSecret is the label for the secret key given by the
+	// provider for verifying responses.
+	LabelCaptchaSecret = "secret"
+	// LabelCaptchaMinScore is the label for the minimum score, between 0 and
+	// 1, that the provider must give the response. Only some providers, such
+	// as reCAPTCHA v3, return a score; with the others, setting a minimum
+	// score rejects every response.
+	LabelCaptchaMinScore = "min_score"
+	// LabelCaptchaVerifyURL is the label for the URL of the provider's
+	// siteverify API, which defaults to the provider's public one.
+	LabelCaptchaVerifyURL = "verify_url"
+	// LabelCaptchaField is the label for the name of the form field holding
+	// the CAPTCHA response, which defaults to the one the provider's widget
+	// uses.
+	LabelCaptchaField = "field"
+)
+
+// Codes of the errors returned when a submission fails the CAPTCHA
+const (
+	// CodeCaptchaMissing means the submission has no CAPTCHA response
+	CodeCaptchaMissing = "captcha_missing"
+	// CodeCaptchaFailed means the provider rejected the CAPTCHA response
+	CodeCaptchaFailed = "captcha_failed"
+	// CodeCaptchaUnavailable means the provider could not be reached
+	CodeCaptchaUnavailable = "captcha_unavailable"
+)
+
+// CaptchaProvider describes the siteverify API of a CAPTCHA provider
+type CaptchaProvider struct {
+	// VerifyURL is the URL responses are verified at
+	VerifyURL string
+	// Field is the form field the provider's widget puts the response in
+	Field string
+}
+
+// CaptchaProviders are the supported CAPTCHA providers, keyed by the name
+// used for LabelCaptchaProvider
+var CaptchaProviders = map[string]CaptchaProvider{
+	"hcaptcha": {
+		VerifyURL: "https://hcaptcha.com/siteverify",
+		Field:     "h-captcha-response"},
+	"recaptcha": {
+		VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		Field:     "g-recaptcha-response"},
+	"turnstile": {
+		VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		Field:     "cf-turnstile-response"}}
+
+// captchaClient is used to call the providers' siteverify APIs
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+// captcha holds the options for verifying CAPTCHA responses
+type captcha struct {
+	provider  string
+	secret    string
+	minScore  float64
+	verifyURL string
+	field     string
+}
+
+// siteverifyResponse is the part of the siteverify APIs' responses common to
+// all providers
+type siteverifyResponse struct {
+	Success    bool     `json:"success"`
+	Score      *float64 `json:"score"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+func (h *Base) unmarshalCaptcha(d map[string]interface{}) error {
+	h.captcha = nil
+	if d[LabelCaptcha] == nil {
+		return nil
+	}
+
+	conf, err := parse.MapStringKeys(d[LabelCaptcha])
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelCaptcha, err)
+	}
+	itemError := func(item string, err interface{}) error {
+		return fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", LabelCaptcha, item), err)
+	}
+
+	c := &captcha{}
+	c.provider, err = parse.String(conf[LabelCaptchaProvider])
+	if err != nil {
+		return itemError(LabelCaptchaProvider, err)
+	}
+	c.provider = strings.ToLower(c.provider)
+	provider, ok := CaptchaProviders[c.provider]
+	if !ok {
+		names := make([]string, 0, len(CaptchaProviders))
+		for name := range CaptchaProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return itemError(LabelCaptchaProvider, fmt.Sprintf(
+			"unknown provider \"%s\"; expected one of %s", c.provider,
+			strings.Join(names, ", ")))
+	}
+
+	c.secret, err = parse.String(conf[LabelCaptchaSecret])
+	if err != nil {
+		return itemError(LabelCaptchaSecret, err)
+	}
+	if c.secret == "" {
+		return itemError(LabelCaptchaSecret, "must not be empty")
+	}
+
+	if conf[LabelCaptchaMinScore] != nil {
+		c.minScore, err = parse.Float64(conf[LabelCaptchaMinScore])
+		if err != nil {
+			return itemError(LabelCaptchaMinScore, err)
+		}
+		if c.minScore < 0 || c.minScore > 1 {
+			return itemError(LabelCaptchaMinScore, "must be between 0 and 1")
+		}
+	}
+
+	c.verifyURL, err = parse.StringOrDefault(conf[LabelCaptchaVerifyURL],
+		provider.VerifyURL)
+	if err != nil {
+		return itemError(LabelCaptchaVerifyURL, err)
+	}
+	if u, err := url.Parse(c.verifyURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return itemError(LabelCaptchaVerifyURL, "must be an http or https URL")
+	}
+
+	c.field, err = parse.StringOrDefault(conf[LabelCaptchaField], provider.Field)
+	if err != nil {
+		return itemError(LabelCaptchaField, err)
+	}
+
+	h.captcha = c
+	return nil
+}
+
+// verify asks the provider whether the response is valid
+func (c *captcha) verify(req *http.Request, response string) *errors.HTTPError {
+	form := url.Values{
+		"secret":   {c.secret},
+		"response": {response},
+		"remoteip": {ClientIP(req)}}
+	vReq, err := http.NewRequest(http.MethodPost, c.verifyURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.NewCodedError(CodeCaptchaUnavailable, err.Error(),
+			http.StatusInternalServerError)
+	}
+	vReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := captchaClient.Do(vReq.WithContext(req.Context()))
+	if err != nil {
+		return errors.NewCodedError(CodeCaptchaUnavailable, fmt.Sprintf(
+			"could not reach %s: %s", c.provider, err), http.StatusBadGateway)
+	}
+	defer resp.Body.Close()
+
+	result := siteverifyResponse{}
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("status %s", resp.Status)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&result)
+	}
+	if err != nil {
+		return errors.NewCodedError(CodeCaptchaUnavailable, fmt.Sprintf(
+			"invalid response from %s: %s", c.provider, err),
+			http.StatusBadGateway)
+	}
+
+	if !result.Success {
+		return errors.NewCodedError(CodeCaptchaFailed,
+			"CAPTCHA verification failed", http.StatusBadRequest)
+	}
+	if c.minScore > 0 && (result.Score == nil || *result.Score < c.minScore) {
+		return errors.NewCodedError(CodeCaptchaFailed,
+			"CAPTCHA score is too low", http.StatusBadRequest)
+	}
+	return nil
+}
+
+// VerifyCaptcha checks the submission's CAPTCHA response with the provider,
+// if the handler requires one. It returns a 400 (Bad Request) error with
+// CodeCaptchaMissing or CodeCaptchaFailed if the response is missing or not
+// valid. Responses can only be verified once, so the result is shared by all
+// handlers that check the same response.
+func (h Base) VerifyCaptcha(req *http.Request) *errors.HTTPError {
+	if h.captcha == nil {
+		return nil
+	}
+
+	response := req.FormValue(h.captcha.field)
+	if response == "" {
+		return errors.NewCodedError(CodeCaptchaMissing,
+			"Please complete the CAPTCHA", http.StatusBadRequest)
+	}
+
+	key := strings.Join([]string{"captcha", h.captcha.verifyURL,
+		h.captcha.secret, response}, "\x00")
+	err, _ := SubmissionFromRequest(req).memo(key, func() interface{} {
+		return h.captcha.verify(req, response)
+	}).(*errors.HTTPError)
+	return err
+}
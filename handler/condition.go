@@ -0,0 +1,524 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// The following labels have special meanings inside LabelHandleIf. Any other
+// key is the name of a form field, mapped to a condition on its value(s).
+// Configurations written before these labels existed used them as form
+// fields mapped to a string, list, or true, so those values keep that
+// meaning; see legacyField.
+var (
+	// LabelConditionAnyOf is the label for a list of condition tables, of
+	// which at least one must hold.
+	LabelConditionAnyOf = "any_of"
+	// LabelConditionAllOf is the label for a list of condition tables, all
+	// of which must hold.
+	LabelConditionAllOf = "all_of"
+	// LabelConditionNot is the label for a condition table that must not
+	// hold.
+	LabelConditionNot = "not"
+	// LabelConditionField is the label for a table of form field names mapped
+	// to conditions on their values. Use it for fields whose names are used
+	// by other labels here, such as a field named "header".
+	LabelConditionField = "field"
+	// LabelConditionHeader is the label for a table of request header names
+	// mapped to conditions on their values, such as Accept-Language.
+	LabelConditionHeader = "header"
+	// LabelConditionFile is the label for a table of form field names mapped
+	// to whether a file must (true) or must not (false) be uploaded with them.
+	LabelConditionFile = "file"
+	// LabelConditionMeta is the label for a table of request metadata mapped
+	// to conditions on their values. See MetaValues for the available names.
+	LabelConditionMeta = "meta"
+)
+
+// Operators that can be used in a table of conditions on a single value. A
+// value condition given as true is the same as {non_empty = true}, a list is
+// the same as {in = [...]}, and a string is the same as {eq = "..."}.
+var (
+	opEq       = "eq"
+	opNe       = "ne"
+	opIn       = "in"
+	opNotIn    = "not_in"
+	opMatches  = "matches"
+	opGt       = "gt"
+	opGte      = "gte"
+	opLt       = "lt"
+	opLte      = "lte"
+	opNonEmpty = "non_empty"
+	opEmpty    = "empty"
+	opNot      = "not"
+)
+
+// MetaValues are the names of request metadata that can be checked with
+// LabelConditionMeta, along with functions returning their values.
+var MetaValues = map[string]func(*http.Request) string{
+	"method": func(req *http.Request) string { return req.Method },
+	"host":   func(req *http.Request) string { return req.Host },
+	"path":   func(req *http.Request) string { return req.URL.Path },
+	"query":  func(req *http.Request) string { return req.URL.RawQuery },
+	"origin": func(req *http.Request) string { return req.Header.Get("Origin") },
+	"remote_addr": func(req *http.Request) string {
+		return req.RemoteAddr
+	},
+	"client_ip": ClientIP,
+}
+
+// comparison is a numeric comparison of a value against a number
+type comparison struct {
+	op    string
+	value float64
+}
+
+func (c comparison) holds(f float64) bool {
+	switch c.op {
+	case opGt:
+		return f > c.value
+	case opGte:
+		return f >= c.value
+	case opLt:
+		return f < c.value
+	case opLte:
+		return f <= c.value
+	}
+	return false
+}
+
+// matches returns whether the given values satisfy the condition. A missing
+// value is treated as the empty string.
+func (cond *handleCondition) matches(vals []string) bool {
+	if len(vals) == 0 {
+		vals = []string{""}
+	}
+
+	if cond.MustBeNonEmpty && vals[0] == "" {
+		return false
+	}
+
+	if len(cond.AllowedValues) > 0 {
+		isAllowed := false
+		for _, str := range vals {
+			if _, ok := cond.AllowedValues[str]; ok {
+				isAllowed = true
+				break
+			}
+		}
+		if !isAllowed {
+			return false
+		}
+	}
+
+	if cond.Pattern != nil {
+		isMatch := false
+		for _, str := range vals {
+			if cond.Pattern.MatchString(str) {
+				isMatch = true
+				break
+			}
+		}
+		if !isMatch {
+			return false
+		}
+	}
+
+	if len(cond.Comparisons) > 0 {
+		isMatch := false
+		for _, str := range vals {
+			f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+			if err != nil {
+				continue
+			}
+			isMatch = true
+			for _, c := range cond.Comparisons {
+				if !c.holds(f) {
+					isMatch = false
+					break
+				}
+			}
+			if isMatch {
+				break
+			}
+		}
+		if !isMatch {
+			return false
+		}
+	}
+
+	for _, not := range cond.Not {
+		if not.matches(vals) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// condition is a check on a request other than a condition on the value of
+// a form field
+type condition interface {
+	matches(req *http.Request) bool
+}
+
+// conditionSet holds all conditions from a single condition table, all of
+// which must hold
+type conditionSet struct {
+	fields map[string]*handleCondition
+	others []condition
+}
+
+func (s conditionSet) matches(req *http.Request) bool {
+	for input, cond := range s.fields {
+		if !cond.matches(req.Form[input]) {
+			return false
+		}
+	}
+	for _, c := range s.others {
+		if !c.matches(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// groupCondition holds if any (or all) of its condition sets hold
+type groupCondition struct {
+	any  bool
+	sets []conditionSet
+}
+
+func (g groupCondition) matches(req *http.Request) bool {
+	for _, s := range g.sets {
+		if s.matches(req) == g.any {
+			return g.any
+		}
+	}
+	return !g.any
+}
+
+// notCondition holds if its condition set does not
+type notCondition struct {
+	set conditionSet
+}
+
+func (n notCondition) matches(req *http.Request) bool {
+	return !n.set.matches(req)
+}
+
+// headerCondition checks the values of a request header
+type headerCondition struct {
+	name string
+	cond *handleCondition
+}
+
+func (h headerCondition) matches(req *http.Request) bool {
+	return h.cond.matches(req.Header[h.name])
+}
+
+// fileCondition checks whether a file was uploaded with a form field
+type fileCondition struct {
+	field   string
+	present bool
+}
+
+func (f fileCondition) matches(req *http.Request) bool {
+	present := req.MultipartForm != nil && len(req.MultipartForm.File[f.field]) > 0
+	return present == f.present
+}
+
+// metaCondition checks a value from MetaValues
+type metaCondition struct {
+	value func(*http.Request) string
+	cond  *handleCondition
+}
+
+func (m metaCondition) matches(req *http.Request) bool {
+	return m.cond.matches([]string{m.value(req)})
+}
+
+// conditionError formats an error in the condition at the given path inside
+// LabelHandleIf
+func conditionError(path string, err interface{}) error {
+	return fmt.Errorf(errors.ErrConfigItem,
+		fmt.Sprintf("%s (%s)", LabelHandleIf, path), err)
+}
+
+// conditionList parses a list of condition tables. TOML decodes arrays of
+// tables as []map[string]interface{}, so that is accepted along with
+// []interface{}.
+func conditionList(d interface{}) ([]interface{}, error) {
+	if maps, ok := d.([]map[string]interface{}); ok {
+		list := make([]interface{}, len(maps))
+		for i, m := range maps {
+			list[i] = m
+		}
+		return list, nil
+	}
+	return parse.Slice(d)
+}
+
+// parseNumber parses a number from configuration, which may be either an
+// integer or a float
+func parseNumber(d interface{}) (float64, error) {
+	if i, err := parse.Int64(d); err == nil {
+		return float64(i), nil
+	}
+	return parse.Float64(d)
+}
+
+// parseValues parses a list of strings into a set
+func parseValues(path string, d interface{}) (map[string]struct{}, error) {
+	s, err := parse.Slice(d)
+	if err != nil {
+		return nil, conditionError(path, err)
+	}
+
+	// Make sure list of values is not empty
+	if len(s) == 0 {
+		return nil, conditionError(path,
+			"list of values must contain at least one value")
+	}
+
+	values := make(map[string]struct{})
+	for _, str := range s {
+		val, err := parse.String(str)
+		if err != nil {
+			return nil, conditionError(path, err)
+		}
+		values[val] = struct{}{}
+	}
+	return values, nil
+}
+
+// parseValueCondition parses a condition on a single value, found at the
+// given path in the configuration
+func parseValueCondition(path string, d interface{}) (*handleCondition, error) {
+	cond := &handleCondition{}
+
+	switch val := d.(type) {
+	case bool:
+		cond.MustBeNonEmpty = val
+		return cond, nil
+	case string:
+		cond.AllowedValues = map[string]struct{}{val: {}}
+		return cond, nil
+	case []interface{}:
+		var err error
+		cond.AllowedValues, err = parseValues(path, val)
+		return cond, err
+	}
+
+	ops, err := parse.MapStringKeys(d)
+	if err != nil {
+		return nil, conditionError(path,
+			"must be a boolean, string, list of strings, or table of conditions")
+	}
+	if len(ops) == 0 {
+		return nil, conditionError(path, "table of conditions cannot be empty")
+	}
+
+	// Sort so that errors are reported consistently
+	keys := make([]string, 0, len(ops))
+	for op := range ops {
+		keys = append(keys, op)
+	}
+	sort.Strings(keys)
+
+	for _, op := range keys {
+		opPath := path + "." + op
+		switch op {
+		case opEq, opNe:
+			s, err := parse.String(ops[op])
+			if err != nil {
+				return nil, conditionError(opPath, err)
+			}
+			values := map[string]struct{}{s: {}}
+			if op == opEq {
+				cond.AllowedValues = values
+			} else {
+				cond.Not = append(cond.Not, &handleCondition{AllowedValues: values})
+			}
+		case opIn, opNotIn:
+			values, err := parseValues(opPath, ops[op])
+			if err != nil {
+				return nil, err
+			}
+			if op == opIn {
+				cond.AllowedValues = values
+			} else {
+				cond.Not = append(cond.Not, &handleCondition{AllowedValues: values})
+			}
+		case opMatches:
+			s, err := parse.String(ops[op])
+			if err != nil {
+				return nil, conditionError(opPath, err)
+			}
+			cond.Pattern, err = regexp.Compile(s)
+			if err != nil {
+				return nil, conditionError(opPath, err)
+			}
+		case opGt, opGte, opLt, opLte:
+			f, err := parseNumber(ops[op])
+			if err != nil {
+				return nil, conditionError(opPath, "must be a number")
+			}
+			cond.Comparisons = append(cond.Comparisons, comparison{op: op, value: f})
+		case opNonEmpty, opEmpty:
+			b, err := parse.Bool(ops[op])
+			if err != nil {
+				return nil, conditionError(opPath, err)
+			}
+			if b == (op == opNonEmpty) {
+				cond.MustBeNonEmpty = true
+			} else {
+				cond.Not = append(cond.Not, &handleCondition{MustBeNonEmpty: true})
+			}
+		case opNot:
+			not, err := parseValueCondition(opPath, ops[op])
+			if err != nil {
+				return nil, err
+			}
+			cond.Not = append(cond.Not, not)
+		default:
+			return nil, conditionError(opPath, fmt.Sprintf(
+				"unknown condition; expected one of %s", strings.Join([]string{
+					opEq, opNe, opIn, opNotIn, opMatches, opGt, opGte, opLt,
+					opLte, opNonEmpty, opEmpty, opNot}, ", ")))
+		}
+	}
+
+	return cond, nil
+}
+
+// legacyField returns whether a label with a special meaning inside
+// LabelHandleIf is instead a form field of the same name, because its value
+// is not the table (or list of tables) the label expects.
+func legacyField(key string, val interface{}) bool {
+	switch key {
+	case LabelConditionAnyOf, LabelConditionAllOf:
+		list, err := conditionList(val)
+		if err != nil {
+			return true
+		}
+		for _, item := range list {
+			if _, err := parse.MapStringKeys(item); err != nil {
+				return true
+			}
+		}
+	case LabelConditionNot, LabelConditionField, LabelConditionHeader,
+		LabelConditionMeta, LabelConditionFile:
+		_, err := parse.MapStringKeys(val)
+		return err != nil
+	}
+	return false
+}
+
+// parseConditionSet parses a table of conditions, found at the given path in
+// the configuration. The path is empty for LabelHandleIf itself.
+func parseConditionSet(path string, d interface{}) (conditionSet, error) {
+	set := conditionSet{fields: make(map[string]*handleCondition)}
+
+	conditions, err := parse.MapStringKeys(d)
+	if err != nil {
+		if path == "" {
+			return set, fmt.Errorf(errors.ErrConfigItem, LabelHandleIf, err)
+		}
+		return set, conditionError(path, err)
+	}
+
+	prefix := ""
+	if path != "" {
+		prefix = path + "."
+	}
+
+	for key, val := range conditions {
+		keyPath := prefix + key
+		if legacyField(key, val) {
+			cond, err := parseValueCondition(keyPath, val)
+			if err != nil {
+				return set, err
+			}
+			set.fields[key] = cond
+			continue
+		}
+
+		switch key {
+		case LabelConditionAnyOf, LabelConditionAllOf:
+			list, err := conditionList(val)
+			if err != nil {
+				return set, conditionError(keyPath, err)
+			}
+			if len(list) == 0 {
+				return set, conditionError(keyPath,
+					"list of conditions must contain at least one table")
+			}
+			group := groupCondition{any: key == LabelConditionAnyOf}
+			for i, item := range list {
+				s, err := parseConditionSet(fmt.Sprintf("%s[%d]", keyPath, i), item)
+				if err != nil {
+					return set, err
+				}
+				group.sets = append(group.sets, s)
+			}
+			set.others = append(set.others, group)
+		case LabelConditionNot:
+			s, err := parseConditionSet(keyPath, val)
+			if err != nil {
+				return set, err
+			}
+			set.others = append(set.others, notCondition{set: s})
+		case LabelConditionField, LabelConditionHeader, LabelConditionMeta,
+			LabelConditionFile:
+			m, err := parse.MapStringKeys(val)
+			if err != nil {
+				return set, conditionError(keyPath, err)
+			}
+			for name, v := range m {
+				namePath := keyPath + "." + name
+				if key == LabelConditionFile {
+					present, err := parse.Bool(v)
+					if err != nil {
+						return set, conditionError(namePath, err)
+					}
+					set.others = append(set.others, fileCondition{field: name, present: present})
+					continue
+				}
+
+				cond, err := parseValueCondition(namePath, v)
+				if err != nil {
+					return set, err
+				}
+				switch key {
+				case LabelConditionField:
+					set.fields[name] = cond
+				case LabelConditionHeader:
+					set.others = append(set.others, headerCondition{
+						name: http.CanonicalHeaderKey(name), cond: cond})
+				case LabelConditionMeta:
+					value, ok := MetaValues[name]
+					if !ok {
+						return set, conditionError(namePath, "unknown request metadata")
+					}
+					set.others = append(set.others, metaCondition{value: value, cond: cond})
+				}
+			}
+		default:
+			cond, err := parseValueCondition(keyPath, val)
+			if err != nil {
+				return set, err
+			}
+			set.fields[key] = cond
+		}
+	}
+
+	return set, nil
+}
@@ -0,0 +1,385 @@
+package handler
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the definition of a single field in LabelFields
+var (
+	// LabelFieldLabel is the label for the human-readable name of the field,
+	// which defaults to the name of the field.
+	LabelFieldLabel = "label"
+	// LabelFieldRequired is the label for whether the field must have a
+	// non-empty value, or for file fields, at least one file.
+	LabelFieldRequired = "required"
+	// LabelFieldType is the label for the type of value the field must have.
+	// See FieldTypes for the supported types.
+	LabelFieldType = "type"
+	// LabelFieldMinLength is the label for the minimum number of characters in
+	// each value of the field.
+	LabelFieldMinLength = "min_length"
+	// LabelFieldMaxLength is the label for the maximum number of characters in
+	// each value of the field.
+	LabelFieldMaxLength = "max_length"
+	// LabelFieldPattern is the label for a regular expression that each value
+	// of the field must match completely, like the HTML pattern attribute.
+	LabelFieldPattern = "pattern"
+	// LabelFieldAllowedValues is the label for the list of values that the
+	// field may have.
+	LabelFieldAllowedValues = "allowed_values"
+	// LabelFieldMaxFileSize is the label for the maximum size in bytes of
+	// each file uploaded with a file field.
+	LabelFieldMaxFileSize = "max_file_size"
+	// LabelFieldMIMETypes is the label for the list of MIME types that files
+	// uploaded with a file field may have, as declared by the client. Types
+	// may end in "/*" to allow all subtypes, as in "image/*".
+	LabelFieldMIMETypes = "mime_types"
+)
+
+// Field types supported by LabelFieldType
+const (
+	FieldTypeText   = "text"
+	FieldTypeEmail  = "email"
+	FieldTypeURL    = "url"
+	FieldTypeNumber = "number"
+	FieldTypeDate   = "date"
+	FieldTypeTel    = "tel"
+	FieldTypeFile   = "file"
+)
+
+// FieldTypes are the types a field can be declared as
+var FieldTypes = []string{FieldTypeText, FieldTypeEmail, FieldTypeURL,
+	FieldTypeNumber, FieldTypeDate, FieldTypeTel, FieldTypeFile}
+
+// telRegexp matches phone numbers in most common notations
+var telRegexp = regexp.MustCompile(`^\+?[0-9][0-9 ().\-/]{2,}[0-9]$`)
+
+// FieldSpec is the definition of a single form field, used to validate its
+// values before any handler runs. Zero values mean no restriction.
+type FieldSpec struct {
+	Name          string
+	Label         string
+	Required      bool
+	Type          string
+	MinLength     int64
+	MaxLength     int64
+	Pattern       *regexp.Regexp
+	AllowedValues []string
+	MaxFileSize   int64
+	MIMETypes     []string
+}
+
+// IsFile returns whether the field is used to upload files
+func (f FieldSpec) IsFile() bool {
+	return f.Type == FieldTypeFile
+}
+
+// parseFieldSpec parses the definition of the field with the given name
+func parseFieldSpec(name string, d interface{}) (FieldSpec, error) {
+	spec := FieldSpec{Name: name}
+	label := fmt.Sprintf("%s (%s)", LabelFields, name)
+	data, err := parse.MapStringKeys(d)
+	if err != nil {
+		return spec, fmt.Errorf(errors.ErrConfigItem, label, err)
+	}
+
+	itemError := func(item string, err interface{}) error {
+		return fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s.%s)", LabelFields, name, item), err)
+	}
+
+	spec.Label, err = parse.StringOrDefault(data[LabelFieldLabel], name)
+	if err != nil {
+		return spec, itemError(LabelFieldLabel, err)
+	}
+
+	spec.Required, err = parse.BoolOrDefault(data[LabelFieldRequired], false)
+	if err != nil {
+		return spec, itemError(LabelFieldRequired, err)
+	}
+
+	spec.Type, err = parse.StringOrDefault(data[LabelFieldType], FieldTypeText)
+	if err != nil {
+		return spec, itemError(LabelFieldType, err)
+	}
+	known := false
+	for _, t := range FieldTypes {
+		if spec.Type == t {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return spec, itemError(LabelFieldType, fmt.Sprintf(
+			"unknown type \"%s\"; expected one of %s", spec.Type,
+			strings.Join(FieldTypes, ", ")))
+	}
+
+	lengths := []struct {
+		label string
+		value *int64
+	}{
+		{LabelFieldMinLength, &spec.MinLength},
+		{LabelFieldMaxLength, &spec.MaxLength},
+		{LabelFieldMaxFileSize, &spec.MaxFileSize}}
+	for _, l := range lengths {
+		*l.value, err = parse.Int64OrDefault(data[l.label], 0)
+		if err != nil {
+			return spec, itemError(l.label, err)
+		}
+		if *l.value < 0 {
+			return spec, itemError(l.label, "must be non-negative")
+		}
+	}
+	if spec.MaxLength > 0 && spec.MinLength > spec.MaxLength {
+		return spec, itemError(LabelFieldMinLength,
+			fmt.Sprintf("must not be greater than %s", LabelFieldMaxLength))
+	}
+
+	pattern, err := parse.StringOrDefault(data[LabelFieldPattern], "")
+	if err != nil {
+		return spec, itemError(LabelFieldPattern, err)
+	}
+	if pattern != "" {
+		spec.Pattern, err = regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return spec, itemError(LabelFieldPattern, err)
+		}
+	}
+
+	lists := []struct {
+		label string
+		value *[]string
+	}{
+		{LabelFieldAllowedValues, &spec.AllowedValues},
+		{LabelFieldMIMETypes, &spec.MIMETypes}}
+	for _, l := range lists {
+		vals, err := parse.SliceOrNil(data[l.label])
+		if err != nil {
+			return spec, itemError(l.label, err)
+		}
+		for _, v := range vals {
+			s, err := parse.String(v)
+			if err != nil {
+				return spec, itemError(l.label, err)
+			}
+			*l.value = append(*l.value, s)
+		}
+	}
+
+	// File options only make sense for file fields and vice versa
+	if !spec.IsFile() && (spec.MaxFileSize > 0 || len(spec.MIMETypes) > 0) {
+		return spec, fmt.Errorf(errors.ErrConfigItem, label, fmt.Sprintf(
+			"%s and %s require %s to be \"%s\"", LabelFieldMaxFileSize,
+			LabelFieldMIMETypes, LabelFieldType, FieldTypeFile))
+	}
+
+	for key := range data {
+		switch key {
+		case LabelFieldLabel, LabelFieldRequired, LabelFieldType,
+			LabelFieldMinLength, LabelFieldMaxLength, LabelFieldPattern,
+			LabelFieldAllowedValues, LabelFieldMaxFileSize, LabelFieldMIMETypes:
+		default:
+			return spec, itemError(key, "unknown field option")
+		}
+	}
+
+	return spec, nil
+}
+
+// validFileType returns whether the declared content type is one of the
+// allowed MIME types
+func (f FieldSpec) validFileType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range f.MIMETypes {
+		t = strings.ToLower(t)
+		if t == mediaType || (strings.HasSuffix(t, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFiles returns an error message if the files uploaded with the field
+// do not meet its definition
+func (f FieldSpec) validateFiles(req *http.Request) string {
+	var files int
+	if req.MultipartForm != nil {
+		files = len(req.MultipartForm.File[f.Name])
+	}
+
+	if files == 0 {
+		if f.Required {
+			return "is required"
+		}
+		return ""
+	}
+
+	for _, fh := range req.MultipartForm.File[f.Name] {
+		if f.MaxFileSize > 0 && fh.Size > f.MaxFileSize {
+			return fmt.Sprintf("files must be at most %d bytes", f.MaxFileSize)
+		}
+		if len(f.MIMETypes) > 0 && !f.validFileType(fh.Header.Get("Content-Type")) {
+			return fmt.Sprintf("files must be of type %s",
+				strings.Join(f.MIMETypes, ", "))
+		}
+	}
+
+	return ""
+}
+
+// validateValue returns an error message if a single non-empty value does
+// not meet the field's definition
+func (f FieldSpec) validateValue(val string) string {
+	switch f.Type {
+	case FieldTypeEmail:
+		if !TemplateContext.Regexp.Email.MatchString(val) {
+			return "must be a valid email address"
+		}
+	case FieldTypeURL:
+		u, err := url.ParseRequestURI(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return "must be a valid URL"
+		}
+	case FieldTypeNumber:
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return "must be a number"
+		}
+	case FieldTypeDate:
+		// The format used by <input type="date">
+		if _, err := time.Parse("2006-01-02", val); err != nil {
+			return "must be a date in the format YYYY-MM-DD"
+		}
+	case FieldTypeTel:
+		if !telRegexp.MatchString(val) {
+			return "must be a valid phone number"
+		}
+	}
+
+	length := int64(utf8.RuneCountInString(val))
+	if f.MinLength > 0 && length < f.MinLength {
+		return fmt.Sprintf("must be at least %d characters", f.MinLength)
+	}
+	if f.MaxLength > 0 && length > f.MaxLength {
+		return fmt.Sprintf("must be at most %d characters", f.MaxLength)
+	}
+
+	if f.Pattern != nil && !f.Pattern.MatchString(val) {
+		return "is not in the expected format"
+	}
+
+	if len(f.AllowedValues) > 0 {
+		allowed := false
+		for _, v := range f.AllowedValues {
+			if v == val {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "is not one of the allowed values"
+		}
+	}
+
+	return ""
+}
+
+// validate returns an error message if the submitted values of the field do
+// not meet its definition
+func (f FieldSpec) validate(req *http.Request) string {
+	if f.IsFile() {
+		return f.validateFiles(req)
+	}
+
+	empty := true
+	for _, val := range req.Form[f.Name] {
+		if strings.TrimSpace(val) == "" {
+			continue
+		}
+		empty = false
+		if msg := f.validateValue(strings.TrimSpace(val)); msg != "" {
+			return msg
+		}
+	}
+
+	if empty && f.Required {
+		return "is required"
+	}
+	return ""
+}
+
+func (h *Base) unmarshalFields(d map[string]interface{}) error {
+	h.fields = nil
+	if d[LabelFields] == nil {
+		return nil
+	}
+
+	fields, err := parse.MapStringKeys(d[LabelFields])
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelFields, err)
+	}
+
+	h.fields = make(map[string]FieldSpec, len(fields))
+	for name, conf := range fields {
+		h.fields[name], err = parseFieldSpec(name, conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Fields returns the definitions of the fields declared for this handler,
+// keyed by field name. The returned map must not be modified.
+func (h Base) Fields() map[string]FieldSpec {
+	return h.fields
+}
+
+// Validate checks the submitted form against the fields declared for this
+// handler. If any field is invalid, it returns a 400 (Bad Request) error with
+// a message for each invalid field.
+func (h Base) Validate(req *http.Request) *errors.HTTPError {
+	names := make([]string, 0, len(h.fields))
+	for name := range h.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	invalid := make(map[string]string)
+	var msgs []string
+	for _, name := range names {
+		spec := h.fields[name]
+		if msg := spec.validate(req); msg != "" {
+			invalid[name] = msg
+			msgs = append(msgs, spec.Label+" "+msg)
+		}
+	}
+
+	if len(invalid) == 0 {
+		return nil
+	}
+
+	err := errors.NewHTTPError(strings.Join(msgs, "; "), http.StatusBadRequest)
+	for name, msg := range invalid {
+		err.AddFieldError(name, msg)
+	}
+	return err
+}
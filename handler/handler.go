@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"regexp"
 	"sync"
+	"time"
 
 	"gitlab.com/BluestNight/nebula-forms/errors"
 	"gitlab.com/BluestNight/nebula-forms/log"
@@ -16,25 +17,116 @@ var (
 	LabelHandlers = "handler"
 	// LabelHandlerPath is the label for the path that a handler handles
 	LabelHandlerPath = "path"
-	// LabelAllowedDomain represents the domain a request is expected to come
-	// from. Use "*" to represent all domains (dangerous).
+	// LabelAllowedOrigins is the label for the list of origins a request is
+	// expected to come from. Origins may leave out the scheme to allow any
+	// scheme, and may start with "*." to allow any subdomain, as in
+	// "https://*.example.com". Ports must match exactly, except that
+	// subdomains are allowed on any port unless one is given, as in
+	// "https://*.example.com:8443". Use "*" to represent all origins
+	// (dangerous).
 	LabelAllowedOrigins = "allowed_origins"
-	// LabelHoneypot is the label for the honeypot input field. If the honeypot
-	// has a value when the form is submitted, the form submission will be
-	// discarded
+	// LabelAllowedOriginPatterns is the label for a list of regular
+	// expressions that allowed origins may also match, such as
+	// `https://pr-[0-9]+\.preview\.example\.com`. Each expression must match
+	// the whole origin, which is converted to lowercase first.
+	LabelAllowedOriginPatterns = "allowed_origin_patterns"
+	// LabelOriginFromReferer is the label for whether the origin of a request
+	// without an Origin header is taken from its Referer header instead.
+	// Some older browsers and privacy tools leave out the Origin header.
+	LabelOriginFromReferer = "origin_from_referer"
+	// LabelHoneypot is the label for the honeypot input field, or a list of
+	// them. If any honeypot has a value when the form is submitted, the form
+	// submission will be discarded
 	LabelHoneypot = "honeypot"
+	// LabelTimeTrap is the label for the time trap options, or true to use
+	// the defaults. The time trap discards submissions made too soon or too
+	// long after the form's signed timestamp field was issued, either by a
+	// GET request to the handler's path or with TimeTrapToken.
+	LabelTimeTrap = "time_trap"
+	// LabelSpamFilter is the label for the options of the spam filter, which
+	// classifies submissions with a model trained by the train command.
+	LabelSpamFilter = "spam_filter"
+	// LabelRequireToken is the label for the form token options, or true to
+	// use the defaults. Submissions must then carry a single-use token,
+	// issued by a GET request to the handler's path, that is bound to the
+	// path and the submitting origin.
+	LabelRequireToken = "require_token"
+	// LabelProofOfWork is the label for the proof of work options, or true to
+	// use the defaults. Submissions must then carry the solution to a
+	// challenge issued by a GET request to the handler's path.
+	LabelProofOfWork = "proof_of_work"
+	// LabelCaptcha is the label for the CAPTCHA options. If set, submissions
+	// must carry a CAPTCHA response that the provider verifies before any
+	// handler runs.
+	LabelCaptcha = "captcha"
+	// LabelSecret is the label for the key used to sign values such as time
+	// trap timestamps, form tokens, and proof of work challenges. The server
+	// sets it from its own configuration unless the handler sets its own.
+	LabelSecret = "secret"
 	// LabelHandleIf is the label for the mapping of form input names to
 	// what kind of values they must have for the handler to handle. A value of
 	// `true` indicates any non-empty value, while an array/slice of string values
 	// indicate valid values - intended for checkboxes and radio buttons with
 	// predefined values. A value of `""` indicates a value may be empty. An array
-	// containing only `""` indicates the value *must* be empty.
+	// containing only `""` indicates the value *must* be empty. A table of
+	// operators (eq, ne, in, not_in, matches, gt, gte, lt, lte, non_empty,
+	// empty, not) allows more specific conditions, and conditions on headers,
+	// files, request metadata, and groups of conditions are available under
+	// the labels listed with LabelConditionAnyOf.
 	// All conditions must be met for the handler to handle. If validation is
 	// desired instead (i.e. return an error if the field is empty), allow all
 	// values and use the "Errorf" function in a template instead.
 	LabelHandleIf = "handle_if"
+	// LabelAllowedHeaders is the label for the list of request headers that
+	// browsers may send with cross-origin submissions, returned in the
+	// Access-Control-Allow-Headers header of preflight responses.
+	LabelAllowedHeaders = "allowed_headers"
+	// LabelCORSMaxAge is the label for the number of seconds browsers may
+	// cache the result of a preflight request.
+	LabelCORSMaxAge = "cors_max_age"
+	// LabelAllowCredentials is the label for whether browsers may send
+	// cookies and other credentials with cross-origin submissions.
+	LabelAllowCredentials = "allow_credentials"
+	// LabelMaxBodySize is the label for the maximum size of a request body
+	// this handler accepts, overriding the server-wide limit.
+	LabelMaxBodySize = "max_body_size"
+	// LabelMaxFileSize is the label for the maximum size of each file
+	// uploaded to this handler, overriding the server-wide limit.
+	LabelMaxFileSize = "max_file_size"
+	// LabelMaxFiles is the label for the maximum number of files uploaded
+	// to this handler, overriding the server-wide limit.
+	LabelMaxFiles = "max_files"
+	// LabelSuccessRedirect is the label for the template of the URL that
+	// clients are redirected to (303 See Other) after a successful submission.
+	// The template can use the FormValue, FormValues, and QueryEscape
+	// functions, and is passed a RedirectContext.
+	LabelSuccessRedirect = "success_redirect"
+	// LabelErrorRedirect is the label for the template of the URL that
+	// clients are redirected to after a failed submission. The error message
+	// is available as {{ .Error }}.
+	LabelErrorRedirect = "error_redirect"
+	// LabelFields is the label for the table of form field names mapped to
+	// their definitions, which submissions are validated against before any
+	// handler runs. See FieldSpec and the labels listed with LabelFieldLabel.
+	LabelFields = "fields"
+	// LabelTimeout is the label for the maximum time this handler may take
+	// to handle a submission, overriding the server-wide timeout.
+	LabelTimeout = "timeout"
+	// LabelRateLimit is the label for the limit on the rate of submissions
+	// from each client to this handler. See LabelRateLimitRequests and
+	// LabelRateLimitPer.
+	LabelRateLimit = "rate_limit"
 )
 
+// NextField is the name of the form field that may contain the URL to
+// redirect to after a successful submission, such as from a hidden input.
+// The URL is only used if its origin is allowed to access the handler.
+var NextField = "_next"
+
+// DefaultAllowedHeaders are the request headers allowed in cross-origin
+// submissions when a handler does not set LabelAllowedHeaders.
+var DefaultAllowedHeaders = []string{"Accept", "Content-Type"}
+
 type regexpContext struct {
 	Email *regexp.Regexp
 }
@@ -53,15 +145,67 @@ var TemplateContext = templateContext{
 type Handler interface {
 	Handle(*http.Request, chan *errors.HTTPError, *sync.WaitGroup)
 	OriginAllowed(string) bool
-	Honeypot() string
+	Honeypots() []string
+	Spam(*http.Request) (bool, string)
+	SpamScore(*http.Request) float64
+	SpamAction(*http.Request) string
+	CheckToken(*http.Request) *errors.HTTPError
+	CheckRateLimit(*http.Request) *errors.HTTPError
+	VerifyProofOfWork(*http.Request) *errors.HTTPError
+	VerifyCaptcha(*http.Request) *errors.HTTPError
+	IssueFields(*http.Request) (map[string]string, error)
+	RequestOrigin(*http.Request) string
+	CORS() CORS
+	Limits() Limits
+	Timeout() time.Duration
+	Fields() map[string]FieldSpec
+	Validate(*http.Request) *errors.HTTPError
+	Redirect(*http.Request, *errors.HTTPError) (string, error)
 	ShouldHandle(*http.Request, *log.Logger) (bool, error)
 }
 
+// CORS contains the options used to answer cross-origin requests for
+// a handler, including preflight (OPTIONS) requests.
+type CORS struct {
+	AllowedHeaders   []string
+	MaxAge           int64
+	AllowCredentials bool
+}
+
+// Limits restricts the size of form submissions. A value of 0 for any field
+// means no limit, or for a handler, that the server-wide limit applies.
+type Limits struct {
+	MaxBodySize int64
+	MaxFileSize int64
+	MaxFiles    int64
+}
+
+// WithDefaults returns a copy of the Limits where unset (zero) values are
+// replaced with those from def.
+func (lim Limits) WithDefaults(def Limits) Limits {
+	if lim.MaxBodySize == 0 {
+		lim.MaxBodySize = def.MaxBodySize
+	}
+	if lim.MaxFileSize == 0 {
+		lim.MaxFileSize = def.MaxFileSize
+	}
+	if lim.MaxFiles == 0 {
+		lim.MaxFiles = def.MaxFiles
+	}
+	return lim
+}
+
 // handleCondition indicates constraints on form values to determine if the
-// handler can handle.
+// handler can handle. It is also used for header and metadata values. Every
+// constraint that is set must be met, where constraints on the values are
+// met if any of the values meets them.
 type handleCondition struct {
 	MustBeNonEmpty bool
 	AllowedValues  map[string]struct{}
+	Pattern        *regexp.Regexp
+	Comparisons    []comparison
+	// Not holds the conditions that must not be met
+	Not []*handleCondition
 }
 
 // FormValuesFunc generates a "FormValues" function that returns the full
@@ -85,4 +229,14 @@ func ErrorfFunc(err *errors.HTTPError) func(format string, v ...interface{}) (in
 		*err = *errors.NewHTTPError(fmt.Sprintf(format, v...), 400)
 		return nil, err
 	}
-}
\ No newline at end of file
+}
+
+// FieldErrorfFunc works like ErrorfFunc, but also records the error message
+// for the named form field, so clients requesting JSON responses can show it
+// next to the field.
+func FieldErrorfFunc(err *errors.HTTPError) func(field string, format string, v ...interface{}) (interface{}, error) {
+	return func(field string, format string, v ...interface{}) (interface{}, error) {
+		*err = *errors.NewFieldError(field, fmt.Sprintf(format, v...), 400)
+		return nil, err
+	}
+}
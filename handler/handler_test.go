@@ -1,19 +1,26 @@
 package handler
 
 import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/log"
 )
 
 func config() interface{} {
 	return map[string]interface{} {
 		LabelHoneypot: "pot",
-		LabelAllowedDomain: "example.com",
+		LabelAllowedOrigins: []interface{}{"https://example.com"},
 		LabelHandleIf: map[string]interface{} {
 			"name": true,
 			"email": true,
@@ -38,7 +45,7 @@ func fakeRequest(body url.Values) *http.Request {
 	req := httptest.NewRequest(
 		http.MethodPost, "https://example.com/forms/test", strings.NewReader(body.Encode()))
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Origin", "example.com")
+	req.Header.Set("Origin", "https://example.com")
 	return req
 }
 
@@ -69,26 +76,35 @@ func TestBase_Unmarshal(t *testing.T) {
 			LabelHoneypot, err)
 	}
 
-	// Domain must be a string
-	conf.(map[string]interface{})[LabelAllowedDomain] = 12
+	// Origins must be strings
+	conf.(map[string]interface{})[LabelAllowedOrigins] = []interface{}{12}
 	err = h.Unmarshal(conf)
 	if err == nil {
-		t.Errorf("Unmarshaling should fail if %s is not a string",
-			LabelAllowedDomain)
+		t.Errorf("Unmarshaling should fail if %s is not a list of strings",
+			LabelAllowedOrigins)
 	} else {
-		t.Logf("Following error should be because %s was not a string: %s",
-			LabelAllowedDomain, err)
+		t.Logf("Following error should be because %s was not a list of strings: %s",
+			LabelAllowedOrigins, err)
 	}
 
-	// Domain must be provided
-	delete(conf.(map[string]interface{}), LabelAllowedDomain)
+	// Origins must be provided
+	delete(conf.(map[string]interface{}), LabelAllowedOrigins)
 	err = h.Unmarshal(conf)
 	if err == nil {
 		t.Errorf("Unmarshaling should fail if %s is not present",
-			LabelAllowedDomain)
+			LabelAllowedOrigins)
 	} else {
 		t.Logf("Following error should be because %s was not present: %s",
-			LabelAllowedDomain, err)
+			LabelAllowedOrigins, err)
+	}
+
+	// Origin patterns are enough on their own
+	conf.(map[string]interface{})[LabelAllowedOriginPatterns] =
+		[]interface{}{`https://[a-z]+\.example\.com`}
+	err = h.Unmarshal(conf)
+	if err != nil {
+		t.Errorf("Unmarshal should succeed with only %s, failed with error: %s",
+			LabelAllowedOriginPatterns, err)
 	}
 
 	// Handler conditions should be correct
@@ -108,8 +124,8 @@ func TestBase_Unmarshal(t *testing.T) {
 
 func TestBase_ShouldHandle(t *testing.T) {
 	h := Base{}
-	h.domain = "*"
-	h.honeypot = "pot"
+	h.origins = []originMatcher{{any: true}}
+	h.honeypots = []string{"pot"}
 	h.handleConditions = make(map[string]*handleCondition)
 	h.handleConditions["name"] = &handleCondition{MustBeNonEmpty: true}
 	h.handleConditions["email"] = &handleCondition{MustBeNonEmpty: true}
@@ -123,7 +139,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	body := fakeBody()
 	req := fakeRequest(body)
 
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if !ok {
 		t.Error("Handler with fulfilled conditions failed to handle")
@@ -133,7 +149,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	body.Del("name")
 	req = fakeRequest(body)
 
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if ok {
 		t.Error("Handler with empty non-empty field should not handle")
@@ -145,7 +161,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	body.Add("favorite-nums", "19")
 	req = fakeRequest(body)
 
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if !ok {
 		t.Error("Handler with some of allowed values failed to handle")
@@ -155,7 +171,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	body.Set("favorite-nums", "19")
 	req = fakeRequest(body)
 
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if ok {
 		t.Error("Handler with none of allowed values should not handle")
@@ -166,7 +182,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	body.Set("empty", "non-empty")
 	req = fakeRequest(body)
 
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if ok {
 		t.Error("Non-empty value when expecting only empty should not handle")
@@ -175,16 +191,16 @@ func TestBase_ShouldHandle(t *testing.T) {
 	// Domain does not match, should not handle
 	body.Del("empty")
 	req = fakeRequest(body)
-	h.domain = "baddomain.com"
-	if ok, err := h.ShouldHandle(req); err != nil {
+	h.origins = []originMatcher{{scheme: "https", host: "baddomain.com"}}
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if ok {
 		t.Error("Handler shouldn't handle when domains don't match")
 	}
 
 	// Domain matches, should handle
-	h.domain = "example.com"
-	if ok, err := h.ShouldHandle(req); err != nil {
+	h.origins = []originMatcher{{scheme: "https", host: "example.com"}}
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if !ok {
 		t.Error("Handler should handle when domains match")
@@ -193,7 +209,7 @@ func TestBase_ShouldHandle(t *testing.T) {
 	// Should not handle if honeypot has value
 	body.Set("pot", "spamminess")
 	req = fakeRequest(body)
-	if ok, err := h.ShouldHandle(req); err != nil {
+	if ok, err := h.ShouldHandle(req, &log.Logger{}); err != nil {
 		t.Error(err)
 	} else if ok {
 		t.Error("Should not handle when honeypot has value")
@@ -204,11 +220,13 @@ func TestBase_ShouldHandle(t *testing.T) {
 func TestFormValuesFunc(t *testing.T) {
 	body := fakeBody()
 	req := fakeRequest(nil)
+	// Handlers are given requests with the form already parsed
+	if err := req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
 	f := FormValuesFunc(req)
-	s, err := f("name")
-	if err != nil {
-		t.Error(err)
-	} else if len(s) != 1 {
+	s := f("name")
+	if len(s) != 1 {
 		t.Errorf(
 			"Received wrong number of values for \"name\": expected %#v, got %#v",
 			body.Get("name"), s)
@@ -217,10 +235,8 @@ func TestFormValuesFunc(t *testing.T) {
 			string(body.Get("name")[0]), s[0])
 	}
 
-	s, err = f("favorite-nums")
-	if err != nil {
-		t.Error(err)
-	} else if len(s) != 3 {
+	s = f("favorite-nums")
+	if len(s) != 3 {
 		t.Errorf(
 			"Received wrong number of values for \"favorite-nums\": expected %#v, got %#v",
 			body.Get("favorite_nums"), s)
@@ -233,10 +249,8 @@ func TestFormValuesFunc(t *testing.T) {
 		}
 	}
 
-	s, err = f("no_exist")
-	if err != nil {
-		t.Error(err)
-	} else if len(s) != 0 {
+	s = f("no_exist")
+	if len(s) != 0 {
 		t.Errorf(
 			"Received wrong number of values for \"no_exist\": expected %#v, got %#v",
 			body.Get("no_exist"), s)
@@ -295,3 +309,586 @@ func TestErrorfFunc(t *testing.T) {
 		t.Errorf("errorf represents invalid form inputs (400), not %d", err.Status())
 	}
 }
+
+func TestBase_OriginAllowed(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{
+			"https://example.com", "example.org", "https://*.preview.example.com",
+			"http://localhost:1313", "https://*.staging.example.com:8443"},
+		LabelAllowedOriginPatterns: []interface{}{`https://pr-[0-9]+\.example\.net`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"https://example.com":                   true,
+		"HTTPS://Example.com":                   true,
+		"http://example.com":                    false,
+		"https://www.example.com":               false,
+		"https://example.com:8443":              false,
+		"http://example.org":                    true,
+		"https://example.org":                   true,
+		"https://pr-123.preview.example.com":    true,
+		"https://a.b.preview.example.com":       true,
+		"https://preview.example.com":           false,
+		"https://evilpreview.example.com":       false,
+		"http://pr-123.preview.example.com":     false,
+		"https://pr-1.preview.example.com:8443": true,
+		"https://a.staging.example.com:8443":    true,
+		"https://a.staging.example.com:9443":    false,
+		"https://a.staging.example.com":         false,
+		"http://localhost:1313":                 true,
+		"http://localhost":                      false,
+		"https://pr-42.example.net":             true,
+		"HTTPS://PR-42.Example.net":             true,
+		"https://pr-42.example.net.evil.com":    false,
+		"https://pr-x.example.net":              false,
+		"":                                      false}
+
+	for origin, allowed := range tests {
+		if h.OriginAllowed(origin) != allowed {
+			t.Errorf("OriginAllowed(%q) should be %t", origin, allowed)
+		}
+	}
+
+	for _, origin := range []string{"https://", "://example.com", "https://*.*.example.com", "https://example.com/path"} {
+		if _, err := newOriginMatcher(origin); err == nil {
+			t.Errorf("Expected error parsing origin %q", origin)
+		}
+	}
+}
+
+func TestBase_RequestOrigin(t *testing.T) {
+	h := Base{}
+	req := fakeRequest(nil)
+	req.Header.Del("Origin")
+	req.Header.Set("Referer", "https://example.com/contact/?from=home")
+
+	if origin := h.RequestOrigin(req); origin != "" {
+		t.Errorf("Referer should not be used unless enabled, got %s", origin)
+	}
+
+	h.originFromReferer = true
+	if origin := h.RequestOrigin(req); origin != "https://example.com" {
+		t.Errorf("Expected origin from Referer, got %s", origin)
+	}
+
+	req.Header.Set("Origin", "https://example.org")
+	if origin := h.RequestOrigin(req); origin != "https://example.org" {
+		t.Errorf("Origin header should take precedence, got %s", origin)
+	}
+}
+
+func TestBase_HandleIfConditions(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"https://example.com"},
+		LabelHandleIf: map[string]interface{}{
+			"email":  map[string]interface{}{"matches": `@example\.(com|org)$`},
+			"budget": map[string]interface{}{"gte": int64(1000), "lt": 5e4},
+			"topic":  map[string]interface{}{"not_in": []interface{}{"spam"}},
+			LabelConditionAnyOf: []map[string]interface{}{
+				{LabelConditionHeader: map[string]interface{}{
+					"accept-language": map[string]interface{}{"matches": `^de\b`}}},
+				{"country": "DE"}},
+			LabelConditionNot: map[string]interface{}{
+				LabelConditionMeta: map[string]interface{}{
+					"path": map[string]interface{}{"eq": "/blocked"}}},
+			LabelConditionFile: map[string]interface{}{"resume": false}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := &log.Logger{}
+	tests := []struct {
+		name   string
+		modify func(url.Values, *http.Request)
+		handle bool
+	}{
+		{"all conditions met", func(url.Values, *http.Request) {}, true},
+		{"country instead of header", func(body url.Values, req *http.Request) {
+			req.Header.Del("Accept-Language")
+			body.Set("country", "DE")
+		}, true},
+		{"neither group member", func(body url.Values, req *http.Request) {
+			req.Header.Set("Accept-Language", "en-US,de;q=0.5")
+		}, false},
+		{"pattern not matched", func(body url.Values, req *http.Request) {
+			body.Set("email", "joe@example.net")
+		}, false},
+		{"number too large", func(body url.Values, req *http.Request) {
+			body.Set("budget", "50000")
+		}, false},
+		{"not a number", func(body url.Values, req *http.Request) {
+			body.Set("budget", "lots")
+		}, false},
+		{"excluded value", func(body url.Values, req *http.Request) {
+			body.Set("topic", "spam")
+		}, false},
+		{"negated metadata", func(body url.Values, req *http.Request) {
+			req.URL.Path = "/blocked"
+		}, false}}
+
+	for _, test := range tests {
+		body := url.Values{}
+		body.Set("email", "joe@example.com")
+		body.Set("budget", "1000")
+		body.Set("topic", "sales")
+		req := fakeRequest(body)
+		req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+		test.modify(body, req)
+		// Rebuild the body in case it was modified
+		r := fakeRequest(body)
+		r.Header = req.Header
+		r.URL = req.URL
+
+		if ok, err := h.ShouldHandle(r, l); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if ok != test.handle {
+			t.Errorf("%s: ShouldHandle should return %t", test.name, test.handle)
+		}
+	}
+
+	// Errors point to the faulty condition
+	bad := map[string]string{
+		"budget.gte":          `{"budget": {"gte": "many"}}`,
+		"email.like":          `{"email": {"like": "x"}}`,
+		"any_of[1].x.matches": `{"any_of": [{"x": true}, {"x": {"matches": "("}}]}`,
+		"meta.user":           `{"meta": {"user": "x"}}`}
+	for path, conf := range bad {
+		var cond interface{}
+		if err := json.Unmarshal([]byte(conf), &cond); err != nil {
+			t.Fatal(err)
+		}
+		err = h.Unmarshal(map[string]interface{}{
+			LabelAllowedOrigins: []interface{}{"*"},
+			LabelHandleIf:       cond})
+		if err == nil {
+			t.Errorf("Expected error for condition %s", conf)
+		} else if !strings.Contains(err.Error(), "("+path+")") {
+			t.Errorf("Error for %s should mention %s, got: %s", conf, path, err)
+		}
+	}
+
+	// Labels given a plain value are form fields, as before they had a
+	// special meaning
+	err = h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelHandleIf: map[string]interface{}{
+			LabelConditionFile:  "pdf",
+			LabelConditionNot:   []interface{}{"a", "b"},
+			LabelConditionAnyOf: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := url.Values{"file": {"pdf"}, "not": {"b"}, "any_of": {"x"}}
+	if ok, err := h.ShouldHandle(fakeRequest(body), l); err != nil || !ok {
+		t.Errorf("Fields named like labels should be checked, got %t (%v)", ok, err)
+	}
+	body.Set("file", "doc")
+	if ok, _ := h.ShouldHandle(fakeRequest(body), l); ok {
+		t.Error("Field named like a label with the wrong value should not match")
+	}
+}
+
+func TestBase_Validate(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelFields: map[string]interface{}{
+			"name":    map[string]interface{}{"required": true, "max_length": int64(10)},
+			"email":   map[string]interface{}{"required": true, "type": "email", "label": "Email"},
+			"website": map[string]interface{}{"type": "url"},
+			"age":     map[string]interface{}{"type": "number"},
+			"date":    map[string]interface{}{"type": "date"},
+			"phone":   map[string]interface{}{"type": "tel"},
+			"zip":     map[string]interface{}{"pattern": "[0-9]{5}"},
+			"size":    map[string]interface{}{"allowed_values": []interface{}{"S", "M", "L"}},
+			"resume": map[string]interface{}{"type": "file", "max_file_size": int64(8),
+				"mime_types": []interface{}{"application/pdf", "text/*"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := url.Values{
+		"name":    {"Joe Smith"},
+		"email":   {"joe@example.com"},
+		"website": {"https://example.com/joe"},
+		"age":     {"42"},
+		"date":    {"2018-06-01"},
+		"phone":   {"+1 (555) 123-4567"},
+		"zip":     {"12345"},
+		"size":    {"M"}}
+
+	req := fakeRequest(valid)
+	req.ParseForm()
+	if err := h.Validate(req); err != nil {
+		t.Errorf("Valid submission failed validation: %s", err)
+	}
+
+	invalid := map[string]string{
+		"name":    "Joseph Smithers",
+		"email":   "joe",
+		"website": "example.com",
+		"age":     "forty-two",
+		"date":    "06/01/2018",
+		"phone":   "call me",
+		"zip":     "123456",
+		"size":    "XL"}
+	for field, val := range invalid {
+		body := url.Values{}
+		for k, v := range valid {
+			body[k] = v
+		}
+		body.Set(field, val)
+		req = fakeRequest(body)
+		req.ParseForm()
+
+		err := h.Validate(req)
+		if err == nil {
+			t.Errorf("Expected %s=%q to fail validation", field, val)
+			continue
+		}
+		if err.Status() != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", err.Status())
+		}
+		if errs := err.FieldErrors(); len(errs) != 1 || errs[field] == "" {
+			t.Errorf("Expected only %s to be invalid, got %#v", field, errs)
+		}
+	}
+
+	// Missing required fields are reported together, using their labels
+	req = fakeRequest(url.Values{"name": {" "}})
+	req.ParseForm()
+	missing := h.Validate(req)
+	if missing == nil || len(missing.FieldErrors()) != 2 {
+		t.Fatalf("Expected name and email to be required, got %v", missing)
+	}
+	if missing.Error() != "Email is required; name is required" {
+		t.Errorf("Unexpected message: %s", missing.Error())
+	}
+
+	// File fields check each uploaded file
+	for _, test := range []struct {
+		contentType string
+		content     string
+		valid       bool
+	}{
+		{"text/plain", "resume", true},
+		{"image/png", "resume", false},
+		{"application/pdf", "too large resume", false}} {
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		for k, v := range valid {
+			w.WriteField(k, v[0])
+		}
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="resume"; filename="resume"`)
+		header.Set("Content-Type", test.contentType)
+		part, _ := w.CreatePart(header)
+		part.Write([]byte(test.content))
+		w.Close()
+
+		req = httptest.NewRequest(http.MethodPost, "https://example.com/forms/test", buf)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		if err := req.ParseMultipartForm(1024); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Validate(req); (err == nil) != test.valid {
+			t.Errorf("Validation of %s file with %d bytes should be %t, got %v",
+				test.contentType, len(test.content), test.valid, err)
+		}
+	}
+
+	// Configuration errors name the field and option
+	err = h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelFields: map[string]interface{}{
+			"email": map[string]interface{}{"type": "mail"}}})
+	if err == nil || !strings.Contains(err.Error(), "fields (email.type)") {
+		t.Errorf("Expected error about email.type, got %v", err)
+	}
+}
+
+func TestBase_Spam(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelHoneypot:       []interface{}{"pot", "url"},
+		LabelSecret:         "s3cret",
+		LabelTimeTrap: map[string]interface{}{
+			LabelTimeTrapMinTime: "2s",
+			LabelTimeTrapMaxAge:  "1h"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Honeypot() != "pot" {
+		t.Errorf("Honeypot should return the first honeypot, got %q", h.Honeypot())
+	}
+
+	token := func(age time.Duration) string {
+		return TimeTrapToken("s3cret", "/forms/test", time.Now().Add(-age))
+	}
+	tests := []struct {
+		name string
+		body url.Values
+		spam bool
+	}{
+		{"valid", url.Values{"_ts": {token(time.Minute)}}, false},
+		{"first honeypot", url.Values{"_ts": {token(time.Minute)}, "pot": {"x"}}, true},
+		{"second honeypot", url.Values{"_ts": {token(time.Minute)}, "url": {"x"}}, true},
+		{"missing token", url.Values{}, true},
+		{"too fast", url.Values{"_ts": {token(0)}}, true},
+		{"too old", url.Values{"_ts": {token(2 * time.Hour)}}, true},
+		{"other secret", url.Values{"_ts": {TimeTrapToken("other", "/forms/test",
+			time.Now().Add(-time.Minute))}}, true},
+		{"other path", url.Values{"_ts": {TimeTrapToken("s3cret", "/forms/other",
+			time.Now().Add(-time.Minute))}}, true}}
+
+	for _, test := range tests {
+		req := fakeRequest(test.body)
+		req.ParseForm()
+		if spam, reason := h.Spam(req); spam != test.spam {
+			t.Errorf("%s: expected spam to be %t, got %t (%s)", test.name,
+				test.spam, spam, reason)
+		}
+	}
+
+	fields, err := h.IssueFields(fakeRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTimeTrapToken("s3cret", "/forms/test", fields["_ts"]); err != nil {
+		t.Errorf("Issued time trap token is invalid: %s", err)
+	}
+
+	err = (&Base{}).Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelTimeTrap:       true})
+	if err == nil {
+		t.Error("Time trap without a secret should not be allowed")
+	}
+}
+
+func TestBase_CheckToken(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelSecret:         "s3cret",
+		LabelRequireToken:   true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(token, origin string) *http.Request {
+		req := fakeRequest(url.Values{DefaultTokenField: {token}})
+		req.Header.Set("Origin", origin)
+		req, _, err := NewSubmission(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ParseForm()
+		return req
+	}
+
+	fields, err := h.IssueFields(fakeRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := fields[DefaultTokenField]
+
+	if err := h.CheckToken(submit(token, "https://evil.com")); err == nil {
+		t.Error("Token should be bound to the origin it was issued to")
+	}
+
+	req := submit(token, "https://example.com")
+	if err := h.CheckToken(req); err != nil {
+		t.Errorf("Issued token should be valid: %s", err)
+	}
+	// Other handlers checking the same submission do not reuse the token
+	if err := h.CheckToken(req); err != nil {
+		t.Errorf("Token should be valid for the same submission: %s", err)
+	}
+	if err := h.CheckToken(submit(token, "https://example.com")); err == nil {
+		t.Error("Token should not be valid for another submission")
+	}
+
+	old, err := FormToken("s3cret", "/forms/test", "https://example.com",
+		time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CheckToken(submit(old, "https://example.com")); err == nil {
+		t.Error("Expired token should not be valid")
+	}
+	if err := h.CheckToken(submit("", "https://example.com")); err == nil ||
+		err.Code() != CodeInvalidToken || err.Status() != http.StatusForbidden {
+		t.Errorf("Missing token should return a coded 403, got %#v", err)
+	}
+}
+
+func TestBase_UnmarshalCaptcha(t *testing.T) {
+	tests := []struct {
+		conf  map[string]interface{}
+		valid bool
+	}{
+		{map[string]interface{}{"provider": "hcaptcha", "secret": "s"}, true},
+		{map[string]interface{}{"provider": "Turnstile", "secret": "s"}, true},
+		{map[string]interface{}{"provider": "recaptcha", "secret": "s",
+			"min_score": 0.5, "verify_url": "http://localhost:8080/verify"}, true},
+		{map[string]interface{}{"provider": "unknown", "secret": "s"}, false},
+		{map[string]interface{}{"provider": "hcaptcha"}, false},
+		{map[string]interface{}{"provider": "recaptcha", "secret": "s",
+			"min_score": 1.5}, false},
+		{map[string]interface{}{"provider": "hcaptcha", "secret": "s",
+			"verify_url": "localhost"}, false}}
+
+	for _, test := range tests {
+		h := Base{}
+		err := h.Unmarshal(map[string]interface{}{
+			LabelAllowedOrigins: []interface{}{"*"},
+			LabelCaptcha:        test.conf})
+		if test.valid && err != nil {
+			t.Errorf("%#v should be valid: %s", test.conf, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%#v should not be valid", test.conf)
+		}
+	}
+}
+
+// solvePoW finds a nonce that solves the challenge
+func solvePoW(challenge string) string {
+	for i := 0; ; i++ {
+		nonce := strconv.Itoa(i)
+		if PoWSolved(challenge, nonce) {
+			return nonce
+		}
+	}
+}
+
+func TestBase_VerifyProofOfWork(t *testing.T) {
+	h := Base{}
+	err := h.Unmarshal(map[string]interface{}{
+		LabelAllowedOrigins: []interface{}{"*"},
+		LabelSecret:         "s3cret",
+		LabelProofOfWork: map[string]interface{}{
+			LabelPoWDifficulty:    int64(4),
+			LabelPoWMaxDifficulty: int64(6),
+			LabelPoWRateThreshold: int64(2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	submit := func(challenge, nonce string) *http.Request {
+		req := fakeRequest(url.Values{
+			PoWChallengeField: {challenge},
+			PoWNonceField:     {nonce}})
+		req, _, err := NewSubmission(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ParseForm()
+		return req
+	}
+	code := func(err *errors.HTTPError) string {
+		if err == nil {
+			return ""
+		}
+		return err.Code()
+	}
+
+	challenge, err := h.PoWChallenge(fakeRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(challenge, "4.") {
+		t.Errorf("Challenge should have the configured difficulty, got %s", challenge)
+	}
+	nonce := solvePoW(challenge)
+
+	if c := code(h.VerifyProofOfWork(submit(challenge, ""))); c != CodePoWMissing {
+		t.Errorf("Expected code %s for a missing solution, got \"%s\"", CodePoWMissing, c)
+	}
+	if err := h.VerifyProofOfWork(submit(challenge, nonce)); err != nil {
+		t.Errorf("Solved challenge should be valid: %s", err)
+	}
+	if c := code(h.VerifyProofOfWork(submit(challenge, nonce))); c != CodePoWInvalid {
+		t.Errorf("Expected code %s for a reused challenge, got \"%s\"", CodePoWInvalid, c)
+	}
+
+	forged := "1" + strings.TrimPrefix(challenge, "4")
+	if c := code(h.VerifyProofOfWork(submit(forged, solvePoW(forged)))); c != CodePoWInvalid {
+		t.Errorf("Expected code %s for a forged difficulty, got \"%s\"", CodePoWInvalid, c)
+	}
+
+	old, err := newPoWChallenge("s3cret", "/forms/test", 4, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := code(h.VerifyProofOfWork(submit(old, solvePoW(old)))); c != CodePoWExpired {
+		t.Errorf("Expected code %s for an old challenge, got \"%s\"", CodePoWExpired, c)
+	}
+
+	// The submissions above are over the rate threshold, so the difficulty
+	// rises up to the maximum
+	if d := h.pow.currentDifficulty(time.Now()); d != 6 {
+		t.Errorf("Expected difficulty to rise to 6, got %d", d)
+	}
+
+	// Challenges issued before the difficulty rose must meet the current
+	// difficulty
+	easy, err := newPoWChallenge("s3cret", "/forms/test", 4, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var easyNonce string
+	for i := 0; easyNonce == ""; i++ {
+		nonce := strconv.Itoa(i)
+		if PoWSolved(easy, nonce) && !powSolvedAt(easy, nonce, 6) {
+			easyNonce = nonce
+		}
+	}
+	if c := code(h.VerifyProofOfWork(submit(easy, easyNonce))); c != CodePoWExpired {
+		t.Errorf("Expected code %s for a challenge below the current difficulty, got \"%s\"",
+			CodePoWExpired, c)
+	}
+	hard, err := h.PoWChallenge(fakeRequest(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.VerifyProofOfWork(submit(hard, solvePoW(hard))); err != nil {
+		t.Errorf("Challenge at the current difficulty should be valid: %s", err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	newHandler := func(d interface{}) (Handler, error) {
+		return nil, nil
+	}
+	Register("test-registry", Factory{NewHandler: newHandler,
+		Metadata: Metadata{Name: "test-registry", Version: "1.0.0"}})
+
+	p, ok := Registered("test-registry")
+	if !ok {
+		t.Fatal("Registered handler type should be found")
+	}
+	if p.Metadata.Version != "1.0.0" {
+		t.Errorf("Registered handler type should keep its metadata, got %#v",
+			p.Metadata)
+	}
+	if err := p.Configure(map[string]interface{}{}); err != nil {
+		t.Errorf("Missing Configure should do nothing, got %s", err)
+	}
+	if _, ok := Registered("test-missing"); ok {
+		t.Error("Unregistered handler type should not be found")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Registering the same name twice should panic")
+		}
+	}()
+	Register("test-registry", Factory{NewHandler: newHandler})
+}
@@ -0,0 +1,38 @@
+package handler
+
+import "context"
+
+// Closer is implemented by handlers that hold resources, like connections or
+// open files, which must be released once the configuration that created
+// the handler is replaced or the server exits.
+type Closer interface {
+	Close() error
+}
+
+// Shutdowner is implemented by handlers that need time to finish work in
+// progress before releasing their resources. Shutdown should return once
+// the context is done, even if the work is not finished. Handlers that
+// implement both only have Shutdown called.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// Shutdown releases the resources of a handler or *Plugin using its
+// Shutdown hook, or its Close hook if it has no Shutdown hook. It does
+// nothing if there is neither.
+func Shutdown(ctx context.Context, v interface{}) error {
+	switch h := v.(type) {
+	case *Plugin:
+		if h.Shutdown != nil {
+			return h.Shutdown(ctx)
+		}
+		if h.Close != nil {
+			return h.Close()
+		}
+	case Shutdowner:
+		return h.Shutdown(ctx)
+	case Closer:
+		return h.Close()
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// originMatcher matches origins against a single entry of LabelAllowedOrigins
+type originMatcher struct {
+	// scheme is empty if the entry matches any scheme
+	scheme string
+	// host is the host and port to match, or the suffix (starting with ".")
+	// that subdomains must end with if wildcard is set
+	host string
+	// port is the port that subdomains must use if wildcard is set, or
+	// empty to allow any port
+	port     string
+	wildcard bool
+	any      bool
+}
+
+// splitPort splits the port, if any, off a lowercase host
+func splitPort(host string) (string, string) {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
+// newOriginMatcher parses an allowed origin. "*" allows any origin, while
+// "https://example.com" allows only the given scheme, host, and port, and
+// "example.com" allows the given host and port with any scheme. Hosts
+// starting with "*." allow any subdomain on any port, as in
+// "https://*.example.com", or only on the given port, as in
+// "https://*.example.com:8443".
+func newOriginMatcher(origin string) (originMatcher, error) {
+	m := originMatcher{}
+	if origin == "*" {
+		m.any = true
+		return m, nil
+	}
+
+	host := origin
+	if i := strings.Index(origin, "://"); i >= 0 {
+		m.scheme = strings.ToLower(origin[:i])
+		host = origin[i+3:]
+		if m.scheme == "" {
+			return m, fmt.Errorf("missing scheme in origin \"%s\"", origin)
+		}
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "/"))
+
+	if strings.HasPrefix(host, "*.") {
+		m.wildcard = true
+		host, m.port = splitPort(host[1:])
+	}
+	if host == "" || host == "." || strings.ContainsAny(host, "*/?#@") {
+		return m, fmt.Errorf("invalid origin \"%s\"", origin)
+	}
+
+	m.host = host
+	return m, nil
+}
+
+// matches returns whether the scheme and host of an origin match
+func (m originMatcher) matches(scheme, host string) bool {
+	if m.any {
+		return true
+	}
+	if m.scheme != "" && m.scheme != scheme {
+		return false
+	}
+	if m.wildcard {
+		host, port := splitPort(host)
+		return len(host) > len(m.host) && strings.HasSuffix(host, m.host) &&
+			(m.port == "" || m.port == port)
+	}
+	return host == m.host
+}
+
+// splitOrigin returns the lowercase scheme and host of an origin. Origins
+// without a scheme have an empty scheme.
+func splitOrigin(origin string) (string, string) {
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	if i := strings.Index(origin, "://"); i >= 0 {
+		return origin[:i], origin[i+3:]
+	}
+	return "", origin
+}
+
+func (h *Base) unmarshalOrigins(d map[string]interface{}) error {
+	origins, err := parse.SliceOrNil(d[LabelAllowedOrigins])
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOrigins, err)
+	}
+
+	h.origins = nil
+	for _, origin := range origins {
+		o, err := parse.String(origin)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOrigins, err)
+		}
+		m, err := newOriginMatcher(o)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOrigins, err)
+		}
+		h.origins = append(h.origins, m)
+	}
+
+	patterns, err := parse.SliceOrNil(d[LabelAllowedOriginPatterns])
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOriginPatterns, err)
+	}
+
+	h.originPatterns = nil
+	for _, pattern := range patterns {
+		p, err := parse.String(pattern)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOriginPatterns, err)
+		}
+		// Patterns must match the whole origin
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOriginPatterns, err)
+		}
+		h.originPatterns = append(h.originPatterns, re)
+	}
+
+	if len(h.origins) == 0 && len(h.originPatterns) == 0 {
+		return fmt.Errorf(errors.ErrConfigItem, LabelAllowedOrigins,
+			fmt.Sprintf("at least one origin must be set in %s or %s",
+				LabelAllowedOrigins, LabelAllowedOriginPatterns))
+	}
+
+	h.originFromReferer, err = parse.BoolOrDefault(d[LabelOriginFromReferer], false)
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelOriginFromReferer, err)
+	}
+
+	return nil
+}
+
+// OriginAllowed returns whether the given origin is allowed to access
+// this handler. Origins are compared in lowercase.
+func (h Base) OriginAllowed(origin string) bool {
+	scheme, host := splitOrigin(origin)
+	for _, m := range h.origins {
+		if m.matches(scheme, host) {
+			return true
+		}
+	}
+
+	origin = strings.ToLower(origin)
+	for _, re := range h.originPatterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RequestOrigin returns the origin that the request came from. This is the
+// Origin header, or if the handler allows it and the header is missing, the
+// scheme and host of the Referer header.
+func (h Base) RequestOrigin(req *http.Request) string {
+	origin := req.Header.Get("Origin")
+	if origin != "" || !h.originFromReferer {
+		return origin
+	}
+
+	ref, err := url.Parse(req.Header.Get("Referer"))
+	if err != nil || ref.Scheme == "" || ref.Host == "" {
+		return ""
+	}
+	return ref.Scheme + "://" + ref.Host
+}
@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Duration parses the given interface{} as a time.Duration. Strings are parsed
+// with time.ParseDuration (e.g. "1m30s"), while integers are treated as a
+// number of seconds.
+func Duration(d interface{}) (time.Duration, error) {
+	if s, ok := d.(string); ok {
+		return time.ParseDuration(s)
+	}
+
+	secs, err := parse.Int64(d)
+	if err != nil {
+		return 0, fmt.Errorf(
+			"could not parse \"%#v\" as duration or number of seconds", d)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// DurationOrDefault returns the default value if the interface is nil,
+// otherwise it parses the interface with Duration.
+func DurationOrDefault(d interface{}, def time.Duration) (time.Duration, error) {
+	if d == nil {
+		return def, nil
+	}
+	return Duration(d)
+}
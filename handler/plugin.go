@@ -1,15 +1,52 @@
 package handler
 
 import (
+	"context"
 		"plugin"
 	"fmt"
 )
 
+// APIVersion is the version of the plugin API, which changes whenever a
+// change to this package breaks plugins built against an older version.
+// Plugins built with Go's plugin package export the version they were built
+// against as a variable named APIVersion, and are refused by servers with
+// another version.
+const APIVersion = 1
+
+// ConfigOption describes one option in the configuration of a handler type
+type ConfigOption struct {
+	Name        string
+	Type        string
+	Required    bool
+	Description string
+}
+
+// Metadata describes a handler type. Plugins built with Go's plugin package
+// may export it as a variable named Metadata.
+type Metadata struct {
+	Name        string
+	Version     string
+	Description string
+	// Config lists the options specific to the handler type, in addition to
+	// those common to all handlers
+	Config []ConfigOption
+}
+
 // Plugin wraps a plugin.Plugin to turn it into a Handler
 type Plugin struct {
 	p          *plugin.Plugin
 	NewHandler func(interface{}) (Handler, error)
 	Configure  func(interface{}) error
+	// Metadata describes the handler type. It is empty if the plugin does
+	// not provide any.
+	Metadata Metadata
+	// Close releases the plugin's resources, such as the process of a
+	// plugin running separately. It is nil if there is nothing to release.
+	Close func() error
+	// Shutdown releases the plugin's resources like Close, giving work in
+	// progress until the context is done to finish. If it is set, it is
+	// used instead of Close.
+	Shutdown func(context.Context) error
 }
 
 // LoadPlugin loads a plugin from the given path as a Handler
@@ -19,15 +56,67 @@ func LoadPlugin(path string) (*Plugin, error) {
 
 	p.p, err = plugin.Open(path)
 	if err != nil {
-		return nil, err
+		// Most often the plugin was built with another version of Go or of
+		// the packages it shares with the server
+		return nil, fmt.Errorf("plugin is not compatible with this server: %s", err)
+	}
+
+	sym, err := p.p.Lookup("APIVersion")
+	if err != nil {
+		return nil, fmt.Errorf(
+			"plugin does not export APIVersion, so it was built for an older "+
+				"plugin API; rebuild it against API version %d", APIVersion)
+	}
+	version, ok := sym.(*int)
+	if !ok {
+		return nil, fmt.Errorf(
+			"plugin's APIVersion has the wrong type: want %s got %T", "int", sym)
+	}
+	if *version != APIVersion {
+		return nil, fmt.Errorf(
+			"plugin was built for plugin API version %d, but this server "+
+				"supports version %d", *version, APIVersion)
+	}
+
+	// Metadata is optional
+	if sym, err = p.p.Lookup("Metadata"); err == nil {
+		meta, ok := sym.(*Metadata)
+		if !ok {
+			return nil, fmt.Errorf(
+				"plugin's Metadata has the wrong type: want %s got %T",
+				"handler.Metadata", sym)
+		}
+		p.Metadata = *meta
+	}
+
+	// Plugins that export New get separate state for each configuration load,
+	// and NewHandler and Configure are not needed
+	if sym, err = p.p.Lookup("New"); err == nil {
+		newPlugin, ok := sym.(func() *Plugin)
+		if !ok {
+			return nil, fmt.Errorf(
+				"plugin's New does not implement the right interface: want %s got %T",
+				"func() *handler.Plugin", sym)
+		}
+		loaded := newPlugin()
+		if loaded == nil || loaded.NewHandler == nil {
+			return nil, fmt.Errorf("plugin's New returned no NewHandler function")
+		}
+		loaded.p = p.p
+		if loaded.Configure == nil {
+			loaded.Configure = func(interface{}) error { return nil }
+		}
+		if loaded.Metadata.Name == "" {
+			loaded.Metadata = p.Metadata
+		}
+		return loaded, nil
 	}
 
-	sym, err := p.p.Lookup("NewHandler")
+	sym, err = p.p.Lookup("NewHandler")
 	if err != nil {
 		return nil, err
 	}
 
-	var ok bool
 	p.NewHandler, ok = sym.(func(interface{}) (Handler, error))
 	if !ok {
 		return nil, fmt.Errorf(
@@ -0,0 +1,355 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options in LabelProofOfWork
+var (
+	// LabelPoWDifficulty is the label for the number of leading zero bits the
+	// hash of a solution must have. Each bit doubles the average work.
+	// Defaults to DefaultPoWDifficulty.
+	LabelPoWDifficulty = "difficulty"
+	// LabelPoWMaxDifficulty is the label for the highest difficulty that the
+	// rate threshold can raise the difficulty to. Defaults to 8 more than
+	// the difficulty.
+	LabelPoWMaxDifficulty = "max_difficulty"
+	// LabelPoWRateThreshold is the label for the number of submissions per
+	// rate window above which the difficulty rises by one, and by one more
+	// each time the rate doubles. Zero, the default, keeps the difficulty
+	// fixed.
+	LabelPoWRateThreshold = "rate_threshold"
+	// LabelPoWRateWindow is the label for the period over which the rate of
+	// submissions is measured. Defaults to one minute.
+	LabelPoWRateWindow = "rate_window"
+	// LabelPoWMaxAge is the label for how long a challenge can be solved
+	// after it was issued. Defaults to DefaultPoWMaxAge.
+	LabelPoWMaxAge = "max_age"
+)
+
+// Names of the form fields holding the challenge and its solution
+var (
+	PoWChallengeField = "_pow_challenge"
+	PoWNonceField     = "_pow_nonce"
+)
+
+// DefaultPoWDifficulty is the default difficulty of challenges, which takes
+// a fraction of a second to solve in a browser
+var DefaultPoWDifficulty = 16
+
+// DefaultPoWMaxAge is the default time a challenge is valid for
+var DefaultPoWMaxAge = 10 * time.Minute
+
+// maxPoWDifficulty is the highest difficulty that can be configured, which
+// already takes hours to solve in a browser
+const maxPoWDifficulty = 40
+
+// Codes of the errors returned when a submission fails the proof of work
+const (
+	// CodePoWMissing means the submission has no challenge or solution
+	CodePoWMissing = "pow_missing"
+	// CodePoWInvalid means the challenge or its solution is not valid
+	CodePoWInvalid = "pow_invalid"
+	// CodePoWExpired means the challenge is too old, and the client should
+	// fetch and solve a new one
+	CodePoWExpired = "pow_expired"
+)
+
+// proofOfWork requires submissions to carry the solution to a hashcash-style
+// challenge, whose difficulty rises with the rate of submissions
+type proofOfWork struct {
+	difficulty    int
+	maxDifficulty int
+	rateThreshold int64
+	rateWindow    time.Duration
+	maxAge        time.Duration
+
+	// The number of submissions in the current and previous rate windows
+	mutex       sync.Mutex
+	windowStart time.Time
+	count       int64
+	prevCount   int64
+}
+
+// record counts a submission in the current rate window
+func (p *proofOfWork) record(now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advance(now)
+	p.count++
+}
+
+// advance starts a new rate window if the current one is over. Must be
+// called with the mutex held.
+func (p *proofOfWork) advance(now time.Time) {
+	elapsed := now.Sub(p.windowStart)
+	if elapsed < p.rateWindow {
+		return
+	}
+	if elapsed < 2*p.rateWindow {
+		p.prevCount = p.count
+	} else {
+		p.prevCount = 0
+	}
+	p.count = 0
+	p.windowStart = now
+}
+
+// currentDifficulty returns the difficulty of new challenges, based on the
+// rate of submissions
+func (p *proofOfWork) currentDifficulty(now time.Time) int {
+	if p.rateThreshold <= 0 {
+		return p.difficulty
+	}
+
+	p.mutex.Lock()
+	p.advance(now)
+	// Weigh the previous window by how much of it is still within one
+	// window's time, for a smoother estimate than the current window alone
+	remaining := 1 - float64(now.Sub(p.windowStart))/float64(p.rateWindow)
+	rate := float64(p.count) + float64(p.prevCount)*remaining
+	p.mutex.Unlock()
+
+	difficulty := p.difficulty
+	for threshold := float64(p.rateThreshold); rate > threshold; threshold *= 2 {
+		if difficulty >= p.maxDifficulty {
+			break
+		}
+		difficulty++
+	}
+	return difficulty
+}
+
+// leadingZeroBits returns the number of leading zero bits in the hash
+func leadingZeroBits(hash []byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// PoWSolved returns whether the nonce solves the challenge, which is when
+// the SHA-256 hash of the challenge followed by the nonce starts with at
+// least as many zero bits as the challenge's difficulty. The difficulty is
+// the part of the challenge before the first ".".
+func PoWSolved(challenge, nonce string) bool {
+	difficulty, err := strconv.Atoi(strings.SplitN(challenge, ".", 2)[0])
+	if err != nil {
+		return false
+	}
+	return powSolvedAt(challenge, nonce, difficulty)
+}
+
+// powSolvedAt returns whether the nonce solves the challenge at the given
+// difficulty, regardless of the difficulty the challenge was issued with
+func powSolvedAt(challenge, nonce string, difficulty int) bool {
+	hash := sha256.Sum256([]byte(challenge + nonce))
+	return leadingZeroBits(hash[:]) >= difficulty
+}
+
+// newPoWChallenge returns a challenge with the given difficulty for the form
+// at the given path
+func newPoWChallenge(secret, path string, difficulty int, issued time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	d := strconv.Itoa(difficulty)
+	ts := strconv.FormatInt(issued.Unix(), 10)
+	salt := hex.EncodeToString(b)
+	return d + "." + ts + "." + salt + "." +
+		sign([]byte(secret), "proof_of_work", path, d, ts, salt), nil
+}
+
+// parsePoWChallenge returns the difficulty, issue time, and salt of a
+// challenge, if it was issued for the form at the given path
+func parsePoWChallenge(secret, path, challenge string) (int, time.Time, string, error) {
+	parts := strings.SplitN(challenge, ".", 4)
+	if len(parts) != 4 {
+		return 0, time.Time{}, "", fmt.Errorf("malformed challenge")
+	}
+
+	expected := sign([]byte(secret), "proof_of_work", path, parts[0], parts[1], parts[2])
+	if !hmac.Equal([]byte(parts[3]), []byte(expected)) {
+		return 0, time.Time{}, "", fmt.Errorf("invalid signature")
+	}
+
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, time.Time{}, "", fmt.Errorf("malformed difficulty")
+	}
+	secs, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, "", fmt.Errorf("malformed timestamp")
+	}
+	return difficulty, time.Unix(secs, 0), parts[2], nil
+}
+
+func (h *Base) unmarshalProofOfWork(d map[string]interface{}) error {
+	h.pow = nil
+	if d[LabelProofOfWork] == nil {
+		return nil
+	}
+
+	pow := &proofOfWork{
+		difficulty: DefaultPoWDifficulty,
+		rateWindow: time.Minute,
+		maxAge:     DefaultPoWMaxAge}
+
+	// A value of true requires proof of work with the default options
+	if enabled, err := parse.Bool(d[LabelProofOfWork]); err == nil {
+		if !enabled {
+			return nil
+		}
+	} else {
+		conf, err := parse.MapStringKeys(d[LabelProofOfWork])
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelProofOfWork,
+				"must be a boolean or table of options")
+		}
+		itemError := func(item string, err interface{}) error {
+			return fmt.Errorf(errors.ErrConfigItem,
+				fmt.Sprintf("%s (%s)", LabelProofOfWork, item), err)
+		}
+
+		difficulty, err := parse.Int64OrDefault(conf[LabelPoWDifficulty],
+			int64(DefaultPoWDifficulty))
+		if err != nil {
+			return itemError(LabelPoWDifficulty, err)
+		}
+		if difficulty < 1 || difficulty > maxPoWDifficulty {
+			return itemError(LabelPoWDifficulty, fmt.Sprintf(
+				"must be between 1 and %d", maxPoWDifficulty))
+		}
+		pow.difficulty = int(difficulty)
+
+		maxDifficulty, err := parse.Int64OrDefault(conf[LabelPoWMaxDifficulty],
+			difficulty+8)
+		if err != nil {
+			return itemError(LabelPoWMaxDifficulty, err)
+		}
+		if maxDifficulty < difficulty {
+			return itemError(LabelPoWMaxDifficulty, fmt.Sprintf(
+				"must not be less than %s", LabelPoWDifficulty))
+		}
+		if maxDifficulty > maxPoWDifficulty {
+			maxDifficulty = maxPoWDifficulty
+		}
+		pow.maxDifficulty = int(maxDifficulty)
+
+		pow.rateThreshold, err = parse.Int64OrDefault(conf[LabelPoWRateThreshold], 0)
+		if err != nil {
+			return itemError(LabelPoWRateThreshold, err)
+		}
+		if pow.rateThreshold < 0 {
+			return itemError(LabelPoWRateThreshold, "must be non-negative")
+		}
+
+		pow.rateWindow, err = DurationOrDefault(conf[LabelPoWRateWindow], time.Minute)
+		if err != nil {
+			return itemError(LabelPoWRateWindow, err)
+		}
+		if pow.rateWindow <= 0 {
+			return itemError(LabelPoWRateWindow, "must be positive")
+		}
+
+		pow.maxAge, err = DurationOrDefault(conf[LabelPoWMaxAge], DefaultPoWMaxAge)
+		if err != nil {
+			return itemError(LabelPoWMaxAge, err)
+		}
+		if pow.maxAge <= 0 {
+			return itemError(LabelPoWMaxAge, "must be positive")
+		}
+	}
+	if pow.maxDifficulty == 0 {
+		pow.maxDifficulty = pow.difficulty + 8
+	}
+
+	if h.secret == "" {
+		return fmt.Errorf(errors.ErrConfigItem, LabelProofOfWork,
+			fmt.Sprintf("requires %s to be set", LabelSecret))
+	}
+
+	h.pow = pow
+	return nil
+}
+
+// PoWChallenge returns a new proof of work challenge for the form at the
+// request's path, or an empty string if the handler does not require one.
+func (h Base) PoWChallenge(req *http.Request) (string, error) {
+	if h.pow == nil {
+		return "", nil
+	}
+	now := time.Now()
+	return newPoWChallenge(h.secret, req.URL.Path, h.pow.currentDifficulty(now), now)
+}
+
+// VerifyProofOfWork checks the submission's solution to its proof of work
+// challenge, if the handler requires one. It returns a 400 (Bad Request)
+// error with CodePoWMissing, CodePoWInvalid, or CodePoWExpired if the
+// solution is not valid. Each challenge can only be used for one submission.
+// The solution must also meet the current difficulty if it rose since the
+// challenge was issued, so that clients cannot hoard easy challenges.
+func (h Base) VerifyProofOfWork(req *http.Request) *errors.HTTPError {
+	if h.pow == nil {
+		return nil
+	}
+	now := time.Now()
+	// The difficulty of a challenge issued just before this submission
+	current := h.pow.currentDifficulty(now)
+	h.pow.record(now)
+
+	challenge := req.FormValue(PoWChallengeField)
+	nonce := req.FormValue(PoWNonceField)
+	if challenge == "" || nonce == "" {
+		return errors.NewCodedError(CodePoWMissing,
+			"The proof of work challenge was not solved", http.StatusBadRequest)
+	}
+
+	difficulty, issued, salt, err := parsePoWChallenge(h.secret, req.URL.Path, challenge)
+	if err != nil || difficulty < h.pow.difficulty {
+		return errors.NewCodedError(CodePoWInvalid,
+			"The proof of work challenge is not valid", http.StatusBadRequest)
+	}
+
+	expires := issued.Add(h.pow.maxAge)
+	if now.After(expires) {
+		return errors.NewCodedError(CodePoWExpired,
+			"The proof of work challenge expired", http.StatusBadRequest)
+	}
+
+	if len(nonce) > 64 || !powSolvedAt(challenge, nonce, difficulty) {
+		return errors.NewCodedError(CodePoWInvalid,
+			"The proof of work solution is not valid", http.StatusBadRequest)
+	}
+	if !powSolvedAt(challenge, nonce, current) {
+		// The solution was valid when the challenge was issued, so the
+		// client should solve a new one at the current difficulty
+		return errors.NewCodedError(CodePoWExpired,
+			"The proof of work difficulty rose since the challenge was issued",
+			http.StatusBadRequest)
+	}
+
+	if !usedNonces.use("proof_of_work\x00"+salt, SubmissionID(req), expires) {
+		return errors.NewCodedError(CodePoWInvalid,
+			"The proof of work challenge was already used", http.StatusBadRequest)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package handler
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/ratelimit"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options of a rate limit
+var (
+	// LabelRateLimitRequests is the label for the number of submissions each
+	// client can make at once, before having to wait.
+	LabelRateLimitRequests = "requests"
+	// LabelRateLimitPer is the label for the time it takes for a client to be
+	// allowed the full number of submissions again. Defaults to one minute.
+	LabelRateLimitPer = "per"
+)
+
+// CodeRateLimited is the code of the error returned when a client made too
+// many submissions
+const CodeRateLimited = "rate_limited"
+
+// ParseRateLimit parses the options of a rate limit, returning nil if there
+// are none. The label is used in error messages.
+func ParseRateLimit(label string, data interface{}) (*ratelimit.Limiter, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	conf, err := parse.MapStringKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf(errors.ErrConfigItem, label, err)
+	}
+
+	requests, err := parse.Int64(conf[LabelRateLimitRequests])
+	if err != nil {
+		return nil, fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", label, LabelRateLimitRequests), err)
+	}
+	if requests < 1 {
+		return nil, fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", label, LabelRateLimitRequests),
+			"must be positive")
+	}
+
+	per, err := DurationOrDefault(conf[LabelRateLimitPer], time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", label, LabelRateLimitPer), err)
+	}
+	if per <= 0 {
+		return nil, fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", label, LabelRateLimitPer), "must be positive")
+	}
+
+	return ratelimit.New(requests, per), nil
+}
+
+// RateLimited takes a token from the key's bucket in the limiter, returning
+// a 429 (Too Many Requests) error with a Retry-After header if there was
+// none. A nil limiter allows everything.
+func RateLimited(l *ratelimit.Limiter, key string) *errors.HTTPError {
+	if l == nil {
+		return nil
+	}
+
+	ok, wait := l.Allow(key)
+	if ok {
+		return nil
+	}
+
+	err := errors.NewCodedError(CodeRateLimited,
+		"Too many submissions, please try again later",
+		http.StatusTooManyRequests)
+	err.SetHeader("Retry-After",
+		strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	return err
+}
+
+// CheckRateLimit returns a 429 (Too Many Requests) error if the client that
+// made the submission exceeded the handler's rate limit, if it has one.
+func (h Base) CheckRateLimit(req *http.Request) *errors.HTTPError {
+	return RateLimited(h.rateLimit, ClientIP(req))
+}
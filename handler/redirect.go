@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"text/template"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// ServerErrorMessage is the message shown to clients in place of the actual
+// error when a server error (5xx) occurs
+var ServerErrorMessage = "A server error occurred. Please try again later."
+
+// RedirectContext is passed as data to the success_redirect and
+// error_redirect templates
+type RedirectContext struct {
+	// Status is the HTTP status code the submission would have been answered
+	// with, had there been no redirect
+	Status int
+	// Error is the message describing what went wrong, or an empty string if
+	// the submission was handled successfully
+	Error string
+	// ID is the ID of the submission
+	ID string
+}
+
+// redirectFuncs returns the functions available in redirect templates
+func redirectFuncs(req *http.Request) template.FuncMap {
+	return template.FuncMap{
+		"FormValue":   req.FormValue,
+		"FormValues":  FormValuesFunc(req),
+		"QueryEscape": url.QueryEscape}
+}
+
+// parseRedirect parses the redirect template found at the given label, if any
+func parseRedirect(d map[string]interface{}, label string) (*template.Template, error) {
+	str, err := parse.StringOrDefault(d[label], "")
+	if err != nil {
+		return nil, fmt.Errorf(errors.ErrConfigItem, label, err)
+	}
+
+	if str == "" {
+		return nil, nil
+	}
+
+	t, err := template.New(label).
+		Funcs(redirectFuncs(&http.Request{})).Parse(str)
+	if err != nil {
+		return nil, fmt.Errorf(errors.ErrConfigItem, label, err)
+	}
+
+	return t, nil
+}
+
+// nextURL returns the value of the NextField form field if it is an absolute
+// http(s) URL whose origin is allowed to access this handler.
+func (h Base) nextURL(req *http.Request) string {
+	next := req.FormValue(NextField)
+	if next == "" {
+		return ""
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+
+	if !h.OriginAllowed(u.Scheme + "://" + u.Host) {
+		return ""
+	}
+
+	return u.String()
+}
+
+// Redirect returns the URL the client should be redirected to after the
+// submission was answered with the given status, or an empty string if the
+// client should not be redirected.
+//
+// Successful submissions are redirected to the URL in the NextField form
+// field, if its origin is allowed, or else to the success_redirect template.
+// Failed submissions are redirected to the error_redirect template.
+func (h Base) Redirect(req *http.Request, status *errors.HTTPError) (string, error) {
+	ctx := RedirectContext{Status: status.Status(), ID: SubmissionID(req)}
+
+	var t *template.Template
+	if status.Status() < 400 {
+		if next := h.nextURL(req); next != "" {
+			return next, nil
+		}
+		t = h.successRedirect
+	} else {
+		ctx.Error = status.Error()
+		if status.Status() >= 500 {
+			ctx.Error = ServerErrorMessage
+		}
+		t = h.errorRedirect
+	}
+
+	if t == nil {
+		return "", nil
+	}
+
+	t, err := t.Clone()
+	if err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	err = t.Funcs(redirectFuncs(req)).Execute(buf, ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates the handlers of one type, like the functions exported by
+// a plugin
+type Factory struct {
+	// NewHandler creates a handler from its configuration
+	NewHandler func(interface{}) (Handler, error)
+	// Configure configures the handler type with its section of the
+	// configuration file, if there is one. It may be nil.
+	Configure func(interface{}) error
+	// New, if set, is used instead of NewHandler and Configure. It is called
+	// each time the configuration is loaded, and returns a Plugin holding
+	// the handler type's state for that configuration only. The Plugin's
+	// Close or Shutdown hook releases the state once the configuration is
+	// replaced.
+	New func() *Plugin
+	// Metadata describes the handler type
+	Metadata Metadata
+}
+
+var (
+	registryMutex sync.RWMutex
+	registry      = make(map[string]Factory)
+)
+
+// Register makes a handler type available under the given name without
+// loading a plugin. Handler types built into the binary call it from an
+// init function. It panics if the name is already registered or the factory
+// has neither a NewHandler nor a New function.
+func Register(name string, f Factory) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+
+	if f.NewHandler == nil && f.New == nil {
+		panic(fmt.Sprintf("handler: Register of %s without NewHandler or New", name))
+	}
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("handler: Register called twice for %s", name))
+	}
+	registry[name] = f
+}
+
+// Registered returns the handler type registered under the given name as a
+// Plugin, and whether there is one. Each call returns a new Plugin, created
+// with the factory's New function if it has one.
+func Registered(name string) (*Plugin, bool) {
+	registryMutex.RLock()
+	f, ok := registry[name]
+	registryMutex.RUnlock()
+	if !ok {
+		return nil, false
+	}
+
+	var p *Plugin
+	if f.New != nil {
+		p = f.New()
+	} else {
+		p = &Plugin{NewHandler: f.NewHandler, Configure: f.Configure}
+	}
+	p.Metadata = f.Metadata
+	if p.Configure == nil {
+		p.Configure = func(interface{}) error { return nil }
+	}
+	return p, true
+}
+
+// RegisteredNames returns the sorted names of the registered handler types
+func RegisteredNames() []string {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
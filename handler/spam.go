@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options in LabelTimeTrap
+var (
+	// LabelTimeTrapField is the label for the name of the form field holding
+	// the signed timestamp. Defaults to DefaultTimeTrapField.
+	LabelTimeTrapField = "field"
+	// LabelTimeTrapMinTime is the label for the minimum time between issuing
+	// the timestamp and submitting the form. Defaults to
+	// DefaultTimeTrapMinTime.
+	LabelTimeTrapMinTime = "min_time"
+	// LabelTimeTrapMaxAge is the label for the maximum time between issuing
+	// the timestamp and submitting the form. A value of 0 disables the
+	// limit. Defaults to DefaultTimeTrapMaxAge.
+	LabelTimeTrapMaxAge = "max_age"
+)
+
+// DefaultTimeTrapField is the default name of the time-trap form field
+var DefaultTimeTrapField = "_ts"
+
+// DefaultTimeTrapMinTime is the default minimum time to fill out a form
+var DefaultTimeTrapMinTime = 3 * time.Second
+
+// DefaultTimeTrapMaxAge is the default maximum age of a time-trap timestamp
+var DefaultTimeTrapMaxAge = 24 * time.Hour
+
+// timeTrap rejects forms that were filled out too fast or too long after
+// the page was loaded
+type timeTrap struct {
+	field   string
+	minTime time.Duration
+	maxAge  time.Duration
+}
+
+// sign returns the HMAC of the given parts, which are joined with a
+// separator that cannot appear in them
+func sign(secret []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TimeTrapToken returns the value of a time-trap field for the form at the
+// given path, issued at the given time. Use it to embed tokens in pages when
+// they are built instead of fetching them from the server.
+func TimeTrapToken(secret, path string, issued time.Time) string {
+	ts := strconv.FormatInt(issued.Unix(), 10)
+	return ts + "." + sign([]byte(secret), "time_trap", path, ts)
+}
+
+// parseTimeTrapToken returns the time a time-trap token was issued, if the
+// token is valid for the form at the given path
+func parseTimeTrapToken(secret, path, token string) (time.Time, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, fmt.Errorf("malformed token")
+	}
+
+	expected := sign([]byte(secret), "time_trap", path, parts[0])
+	if !hmac.Equal([]byte(parts[1]), []byte(expected)) {
+		return time.Time{}, fmt.Errorf("invalid signature")
+	}
+
+	secs, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed timestamp")
+	}
+	return time.Unix(secs, 0), nil
+}
+
+func (h *Base) unmarshalSpam(d map[string]interface{}) error {
+	// Parse honeypot fields, if any. A single field may be given as a string.
+	h.honeypots = nil
+	switch pot := d[LabelHoneypot].(type) {
+	case nil:
+	case string:
+		if pot != "" {
+			h.honeypots = []string{pot}
+		}
+	default:
+		pots, err := parse.Slice(pot)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelHoneypot,
+				"must be a string or list of strings")
+		}
+		for _, p := range pots {
+			s, err := parse.String(p)
+			if err != nil {
+				return fmt.Errorf(errors.ErrConfigItem, LabelHoneypot, err)
+			}
+			h.honeypots = append(h.honeypots, s)
+		}
+	}
+
+	var err error
+	h.secret, err = parse.StringOrDefault(d[LabelSecret], "")
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelSecret, err)
+	}
+
+	h.timeTrap = nil
+	if d[LabelTimeTrap] == nil {
+		return nil
+	}
+
+	// A value of true enables the time trap with default options
+	if enabled, err := parse.Bool(d[LabelTimeTrap]); err == nil {
+		if enabled {
+			h.timeTrap = &timeTrap{
+				field:   DefaultTimeTrapField,
+				minTime: DefaultTimeTrapMinTime,
+				maxAge:  DefaultTimeTrapMaxAge}
+		}
+	} else {
+		conf, err := parse.MapStringKeys(d[LabelTimeTrap])
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelTimeTrap,
+				"must be a boolean or table of options")
+		}
+
+		trap := &timeTrap{}
+		trap.field, err = parse.StringOrDefault(conf[LabelTimeTrapField],
+			DefaultTimeTrapField)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelTimeTrap, LabelTimeTrapField), err)
+		}
+		trap.minTime, err = DurationOrDefault(conf[LabelTimeTrapMinTime],
+			DefaultTimeTrapMinTime)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelTimeTrap, LabelTimeTrapMinTime), err)
+		}
+		trap.maxAge, err = DurationOrDefault(conf[LabelTimeTrapMaxAge],
+			DefaultTimeTrapMaxAge)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelTimeTrap, LabelTimeTrapMaxAge), err)
+		}
+		if trap.maxAge != 0 && trap.maxAge <= trap.minTime {
+			return fmt.Errorf(errors.ErrConfigItem, LabelTimeTrap, fmt.Sprintf(
+				"%s must be greater than %s", LabelTimeTrapMaxAge,
+				LabelTimeTrapMinTime))
+		}
+		h.timeTrap = trap
+	}
+
+	if h.timeTrap != nil && h.secret == "" {
+		return fmt.Errorf(errors.ErrConfigItem, LabelTimeTrap,
+			fmt.Sprintf("requires %s to be set", LabelSecret))
+	}
+
+	return nil
+}
+
+// Honeypots returns the names of the form fields that are honeypots
+// against spam bots
+func (h Base) Honeypots() []string {
+	return h.honeypots
+}
+
+// Honeypot returns the name of the first honeypot field, or an empty string
+// if there is none.
+//
+// Deprecated: handlers may have several honeypots; use Honeypots.
+func (h Base) Honeypot() string {
+	if len(h.honeypots) == 0 {
+		return ""
+	}
+	return h.honeypots[0]
+}
+
+// Spam returns whether the submission was detected as spam by the honeypots,
+// time trap, or spam filter set to drop spam, along with the reason. Spam is
+// answered as if it was handled successfully, so that bots do not learn that
+// they were caught.
+func (h Base) Spam(req *http.Request) (bool, string) {
+	for _, pot := range h.honeypots {
+		if req.FormValue(pot) != "" {
+			return true, fmt.Sprintf("honeypot %s was filled out", pot)
+		}
+	}
+
+	if h.timeTrap != nil {
+		issued, err := parseTimeTrapToken(h.secret, req.URL.Path,
+			req.FormValue(h.timeTrap.field))
+		if err != nil {
+			return true, fmt.Sprintf("time trap: %s", err)
+		}
+		age := time.Since(issued)
+		if age < h.timeTrap.minTime {
+			return true, fmt.Sprintf("time trap: form filled out in %s", age)
+		}
+		if h.timeTrap.maxAge != 0 && age > h.timeTrap.maxAge {
+			return true, fmt.Sprintf("time trap: form is %s old", age)
+		}
+	}
+
+	if h.SpamAction(req) == SpamActionDrop {
+		return true, fmt.Sprintf("spam filter: score %.2f", h.SpamScore(req))
+	}
+
+	return false, ""
+}
+
+// IssueFields returns the names and values of hidden form fields that the
+// handler expects in submissions, such as the time trap's signed timestamp,
+// the form token, and the proof of work challenge. The server returns them
+// in answer to GET requests on the handler's path.
+func (h Base) IssueFields(req *http.Request) (map[string]string, error) {
+	fields := make(map[string]string)
+	if h.timeTrap != nil {
+		fields[h.timeTrap.field] = TimeTrapToken(h.secret, req.URL.Path, time.Now())
+	}
+	if h.token != nil {
+		token, err := FormToken(h.secret, req.URL.Path, h.RequestOrigin(req),
+			time.Now())
+		if err != nil {
+			return nil, err
+		}
+		fields[h.token.field] = token
+	}
+	if h.pow != nil {
+		challenge, err := h.PoWChallenge(req)
+		if err != nil {
+			return nil, err
+		}
+		fields[PoWChallengeField] = challenge
+	}
+	return fields, nil
+}
@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gitlab.com/BluestNight/nebula-forms/bayes"
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options in LabelSpamFilter
+var (
+	// LabelSpamFilterModel is the label for the path to the model file
+	// created by the train command.
+	LabelSpamFilterModel = "model"
+	// LabelSpamFilterThreshold is the label for the probability, between 0
+	// and 1, at or above which a submission is treated as spam. Defaults to
+	// DefaultSpamThreshold.
+	LabelSpamFilterThreshold = "threshold"
+	// LabelSpamFilterAction is the label for what happens to spam, one of
+	// SpamActions. Defaults to SpamActionDrop.
+	LabelSpamFilterAction = "action"
+	// LabelSpamFilterFields is the label for the list of form fields whose
+	// values are classified. Defaults to all fields except honeypots and
+	// those starting with "_", such as the time trap.
+	LabelSpamFilterFields = "fields"
+)
+
+// Actions taken on submissions that the spam filter classifies as spam
+const (
+	// SpamActionDrop discards the submission, answering as if it was handled
+	SpamActionDrop = "drop"
+	// SpamActionQuarantine stores the submission in the data directory
+	// instead of handling it, answering as if it was handled
+	SpamActionQuarantine = "quarantine"
+	// SpamActionTag handles the submission, letting templates check
+	// whether it is spam with the IsSpam function
+	SpamActionTag = "tag"
+)
+
+// SpamActions are the actions that can be taken on spam
+var SpamActions = []string{SpamActionDrop, SpamActionQuarantine, SpamActionTag}
+
+// DefaultSpamThreshold is the default probability at which a submission is
+// treated as spam
+var DefaultSpamThreshold = 0.9
+
+// spamFilter classifies submissions with a trained model
+type spamFilter struct {
+	model     *bayes.Model
+	threshold float64
+	action    string
+	fields    []string
+}
+
+func (h *Base) unmarshalSpamFilter(d map[string]interface{}) error {
+	h.spamFilter = nil
+	if d[LabelSpamFilter] == nil {
+		return nil
+	}
+
+	conf, err := parse.MapStringKeys(d[LabelSpamFilter])
+	if err != nil {
+		return fmt.Errorf(errors.ErrConfigItem, LabelSpamFilter, err)
+	}
+	itemError := func(item string, err interface{}) error {
+		return fmt.Errorf(errors.ErrConfigItem,
+			fmt.Sprintf("%s (%s)", LabelSpamFilter, item), err)
+	}
+
+	filter := &spamFilter{threshold: DefaultSpamThreshold}
+	path, err := parse.String(conf[LabelSpamFilterModel])
+	if err != nil {
+		return itemError(LabelSpamFilterModel, err)
+	}
+	filter.model, err = bayes.Load(path)
+	if err != nil {
+		return itemError(LabelSpamFilterModel, err)
+	}
+
+	if conf[LabelSpamFilterThreshold] != nil {
+		filter.threshold, err = parse.Float64(conf[LabelSpamFilterThreshold])
+		if err != nil {
+			return itemError(LabelSpamFilterThreshold, err)
+		}
+		if filter.threshold <= 0 || filter.threshold > 1 {
+			return itemError(LabelSpamFilterThreshold,
+				"must be greater than 0 and at most 1")
+		}
+	}
+
+	filter.action, err = parse.StringOrDefault(conf[LabelSpamFilterAction],
+		SpamActionDrop)
+	if err != nil {
+		return itemError(LabelSpamFilterAction, err)
+	}
+	known := false
+	for _, action := range SpamActions {
+		if filter.action == action {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return itemError(LabelSpamFilterAction, fmt.Sprintf(
+			"unknown action \"%s\"; expected one of %s", filter.action,
+			strings.Join(SpamActions, ", ")))
+	}
+
+	fields, err := parse.SliceOrNil(conf[LabelSpamFilterFields])
+	if err != nil {
+		return itemError(LabelSpamFilterFields, err)
+	}
+	for _, f := range fields {
+		field, err := parse.String(f)
+		if err != nil {
+			return itemError(LabelSpamFilterFields, err)
+		}
+		filter.fields = append(filter.fields, field)
+	}
+
+	h.spamFilter = filter
+	return nil
+}
+
+// spamText returns the text of the submission that the spam filter
+// classifies
+func (h Base) spamText(req *http.Request) string {
+	skip := make(map[string]bool, len(h.honeypots))
+	for _, pot := range h.honeypots {
+		skip[pot] = true
+	}
+	return bayes.FormText(req.Form, h.spamFilter.fields, skip)
+}
+
+// SpamScore returns the probability, between 0 and 1, that the submission
+// is spam according to the handler's spam filter, or 0 if it has none. The
+// score is only calculated once per submission and spam filter.
+func (h Base) SpamScore(req *http.Request) float64 {
+	if h.spamFilter == nil {
+		return 0
+	}
+	key := fmt.Sprintf("spam\x00%p", h.spamFilter)
+	score, _ := SubmissionFromRequest(req).memo(key, func() interface{} {
+		return h.spamFilter.model.SpamProbability(h.spamText(req))
+	}).(float64)
+	return score
+}
+
+// SpamAction returns the action to take on the submission if the spam
+// filter classifies it as spam, or an empty string otherwise.
+func (h Base) SpamAction(req *http.Request) string {
+	if h.spamFilter == nil || h.SpamScore(req) < h.spamFilter.threshold {
+		return ""
+	}
+	return h.spamFilter.action
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// submissionKey is the context key for the *Submission of a request
+type submissionKey struct{}
+
+// Submission holds information about a single form submission that is
+// shared by all handlers processing it.
+type Submission struct {
+	// ID identifies the submission in logs and responses
+	ID string
+	// ClientIP is the IP address of the client that made the submission,
+	// which may differ from the request's RemoteAddr behind a proxy
+	ClientIP string
+
+	mutex   sync.Mutex
+	results map[string]interface{}
+}
+
+// memo returns the result of check for the given key, calling it only the
+// first time the key is seen for this submission. This keeps checks that
+// must only run once, like verifying a CAPTCHA, or that are expensive, like
+// the spam filter, from running again for each handler. Without a
+// submission, check is always called.
+func (s *Submission) memo(key string, check func() interface{}) interface{} {
+	if s == nil {
+		return check()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if result, ok := s.results[key]; ok {
+		return result
+	}
+	if s.results == nil {
+		s.results = make(map[string]interface{})
+	}
+	result := check()
+	s.results[key] = result
+	return result
+}
+
+// newSubmissionID returns a random identifier for a submission
+func newSubmissionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewSubmission creates a Submission with a new ID and returns a shallow copy
+// of the request carrying it in its context.
+func NewSubmission(req *http.Request) (*http.Request, *Submission, error) {
+	id, err := newSubmissionID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &Submission{ID: id}
+	return WithSubmission(req, s), s, nil
+}
+
+// WithSubmission returns a shallow copy of the request carrying the given
+// Submission in its context, such as when recreating a queued submission.
+func WithSubmission(req *http.Request, s *Submission) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), submissionKey{}, s))
+}
+
+// SubmissionFromRequest returns the Submission attached to the request by
+// NewSubmission, or nil if there is none.
+func SubmissionFromRequest(req *http.Request) *Submission {
+	s, _ := req.Context().Value(submissionKey{}).(*Submission)
+	return s
+}
+
+// SubmissionID returns the ID of the submission made with the given request,
+// or an empty string if the request has no Submission attached.
+func SubmissionID(req *http.Request) string {
+	if s := SubmissionFromRequest(req); s != nil {
+		return s.ID
+	}
+	return ""
+}
+
+// remoteIP returns the IP address of the connection the request came from
+func remoteIP(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
+
+// ClientIP returns the IP address of the client that made the submission,
+// falling back to the address the request came from if the submission does
+// not record one.
+func ClientIP(req *http.Request) string {
+	if s := SubmissionFromRequest(req); s != nil && s.ClientIP != "" {
+		return s.ClientIP
+	}
+	return remoteIP(req)
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/errors"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Labels for the options in LabelRequireToken
+var (
+	// LabelTokenField is the label for the name of the form field holding the
+	// form token. Defaults to DefaultTokenField.
+	LabelTokenField = "field"
+	// LabelTokenMaxAge is the label for how long a form token is valid after
+	// it was issued. Defaults to DefaultTokenMaxAge.
+	LabelTokenMaxAge = "max_age"
+)
+
+// CodeInvalidToken is the code of the error returned when a submission's
+// form token is missing, invalid, expired, or was already used. The client
+// should fetch a new token and submit again.
+const CodeInvalidToken = "invalid_token"
+
+// DefaultTokenField is the default name of the form token field
+var DefaultTokenField = "_token"
+
+// DefaultTokenMaxAge is the default time a form token is valid for
+var DefaultTokenMaxAge = time.Hour
+
+// formToken requires submissions to carry a token issued by the server for
+// the handler's path and the submitting origin
+type formToken struct {
+	field  string
+	maxAge time.Duration
+}
+
+// nonceUse records which submission used a token's nonce, and until when
+// the token would be valid
+type nonceUse struct {
+	submission string
+	expires    time.Time
+}
+
+// nonceCache remembers the nonces of used form tokens and proof of work
+// challenges until they expire, so that they cannot be replayed. It is
+// shared by all handlers so that it survives configuration reloads.
+type nonceCache struct {
+	mutex  sync.Mutex
+	used   map[string]nonceUse
+	pruned time.Time
+}
+
+var usedNonces = &nonceCache{used: make(map[string]nonceUse)}
+
+// use marks the nonce as used by the given submission and returns whether it
+// was unused or only used by the same submission, as happens when several
+// handlers on one path check the same token.
+func (c *nonceCache) use(nonce, submission string, expires time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.pruned) > time.Minute {
+		for n, u := range c.used {
+			if now.After(u.expires) {
+				delete(c.used, n)
+			}
+		}
+		c.pruned = now
+	}
+
+	if u, ok := c.used[nonce]; ok {
+		return submission != "" && u.submission == submission
+	}
+	c.used[nonce] = nonceUse{submission: submission, expires: expires}
+	return true
+}
+
+// FormToken returns a new form token for submissions from the given origin
+// to the form at the given path, issued at the given time. Each token can
+// only be used for one submission.
+func FormToken(secret, path, origin string, issued time.Time) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+	ts := strconv.FormatInt(issued.Unix(), 10)
+	return nonce + "." + ts + "." +
+		sign([]byte(secret), "form_token", path, origin, nonce, ts), nil
+}
+
+// parseFormToken returns the nonce of a form token and the time it was
+// issued, if the token is valid for the given origin and path
+func parseFormToken(secret, path, origin, token string) (string, time.Time, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return "", time.Time{}, fmt.Errorf("malformed token")
+	}
+
+	expected := sign([]byte(secret), "form_token", path, origin, parts[0], parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return "", time.Time{}, fmt.Errorf("invalid signature")
+	}
+
+	secs, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("malformed timestamp")
+	}
+	return parts[0], time.Unix(secs, 0), nil
+}
+
+func (h *Base) unmarshalToken(d map[string]interface{}) error {
+	h.token = nil
+	if d[LabelRequireToken] == nil {
+		return nil
+	}
+
+	// A value of true requires tokens with the default options
+	if required, err := parse.Bool(d[LabelRequireToken]); err == nil {
+		if required {
+			h.token = &formToken{field: DefaultTokenField, maxAge: DefaultTokenMaxAge}
+		}
+	} else {
+		conf, err := parse.MapStringKeys(d[LabelRequireToken])
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, LabelRequireToken,
+				"must be a boolean or table of options")
+		}
+
+		token := &formToken{}
+		token.field, err = parse.StringOrDefault(conf[LabelTokenField],
+			DefaultTokenField)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelRequireToken, LabelTokenField), err)
+		}
+		token.maxAge, err = DurationOrDefault(conf[LabelTokenMaxAge],
+			DefaultTokenMaxAge)
+		if err != nil {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelRequireToken, LabelTokenMaxAge), err)
+		}
+		if token.maxAge <= 0 {
+			return fmt.Errorf(errors.ErrConfigItem, fmt.Sprintf("%s (%s)",
+				LabelRequireToken, LabelTokenMaxAge), "must be positive")
+		}
+		h.token = token
+	}
+
+	if h.token != nil && h.secret == "" {
+		return fmt.Errorf(errors.ErrConfigItem, LabelRequireToken,
+			fmt.Sprintf("requires %s to be set", LabelSecret))
+	}
+
+	return nil
+}
+
+// CheckToken returns a 403 (Forbidden) error if the handler requires a form
+// token and the submission's token is missing, invalid, expired, or was
+// already used by another submission. It uses up the token, so the server
+// calls it after every other check has passed.
+func (h Base) CheckToken(req *http.Request) *errors.HTTPError {
+	if h.token == nil {
+		return nil
+	}
+
+	invalid := func(reason string) *errors.HTTPError {
+		return errors.NewCodedError(CodeInvalidToken,
+			fmt.Sprintf("The form token %s; reload the form and try again", reason),
+			http.StatusForbidden)
+	}
+
+	nonce, issued, err := parseFormToken(h.secret, req.URL.Path,
+		h.RequestOrigin(req), req.FormValue(h.token.field))
+	if err != nil {
+		return invalid(fmt.Sprintf("is not valid (%s)", err))
+	}
+
+	expires := issued.Add(h.token.maxAge)
+	if time.Now().After(expires) {
+		return invalid("expired")
+	}
+	if !usedNonces.use(nonce, SubmissionID(req), expires) {
+		return invalid("was already used")
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,9 +12,45 @@ import (
 	"time"
 
 	"gitlab.com/BluestNight/nebula-forms/config"
+	// Built-in handler types
+	_ "gitlab.com/BluestNight/nebula-forms/plugins/email"
+	_ "gitlab.com/BluestNight/nebula-forms/plugins/exec"
 )
 
+// shutdown gracefully shuts down the server, waiting at most the given time
+// for requests in progress to finish. A timeout of zero waits indefinitely.
+func shutdown(s *http.Server, timeout time.Duration) error {
+	if timeout <= 0 {
+		return s.Shutdown(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// shutdownConfig releases the resources of the configuration's handlers and
+// plugins, waiting at most the given time for them to finish work in
+// progress. A timeout of zero waits indefinitely.
+func shutdownConfig(c *config.Config, timeout time.Duration) error {
+	if timeout <= 0 {
+		return c.Shutdown(context.Background())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.Shutdown(ctx)
+}
+
 func main() {
+	// Subcommands come before any flags
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "train":
+			os.Exit(train(os.Args[2:]))
+		case "plugins":
+			os.Exit(listPlugins(os.Args[2:]))
+		}
+	}
+
 	// Set flags
 	configFile := flag.String("conf", config.DefaultConfigFile,
 		"the configuration file to use")
@@ -43,6 +80,8 @@ func main() {
 	// Create empty pointers
 	var c *config.Config
 	var server *http.Server
+	// Sockets stay open across reloads
+	sockets := &config.ListenerSet{}
 
 	for {
 	ChanSel:
@@ -60,6 +99,8 @@ func main() {
 			// (Re)load config
 			files, err := c.ParseConfigTOMLFile(file)
 			if err != nil {
+				// Release any handlers and plugins created before the error
+				shutdownConfig(c, c.ShutdownTimeout)
 				if oldConf == nil {
 					// Exit with error if no backed up config
 					fmt.Fprintf(os.Stderr,
@@ -73,10 +114,29 @@ func main() {
 					break ChanSel
 				}
 			}
+			// Open any new sockets before touching the old configuration, so a
+			// failure leaves the running server as it was
+			listeners, err := sockets.Listen(c)
+			if err != nil {
+				shutdownConfig(c, c.ShutdownTimeout)
+				if oldConf == nil {
+					fmt.Fprintf(os.Stderr, "Error starting server: %s\n", err)
+					os.Exit(1)
+				} else {
+					c = oldConf
+					c.Logger.Errorf(
+						"Error reloading config: %s\nReusing old config\n", err)
+					break ChanSel
+				}
+			}
 			c.Logger.Debugf("Configuration loaded from following files: %#v", files)
 			for _, file := range files {
 				c.WatchFile(file, fCh)
 			}
+			if err = c.WatchCertificates(fCh); err != nil {
+				c.Logger.Errorf(
+					"Error while watching TLS certificates: %s\n", err)
+			}
 			c.Logger.Logf("Loaded configuration file at %s", file)
 			// Stop watching stuff with old config
 			if oldConf != nil {
@@ -87,28 +147,51 @@ func main() {
 						"Error while stopping file watching: %s\n", err)
 				}
 			}
+			// Hand the queued submissions over to the new configuration
+			if oldConf != nil {
+				oldConf.StopQueue()
+			}
+			c.StartQueue()
 			// Configuration (re)load worked, make and load server
+			// The new server accepts on the same sockets as the old one, so
+			// there is no gap between them. Requests already in progress
+			// finish on the old server with the old configuration.
 			server = c.CreateServer()
-			go func(s *http.Server, ch chan error) {
-				c.Logger.Logln("Starting server")
-				err := s.ListenAndServe()
-				if err != http.ErrServerClosed {
-					ch <- err
-				} else {
-					ch <- nil
-				}
-			}(server, errCh)
+			for _, ln := range listeners {
+				go func(s *http.Server, ln net.Listener, ch chan error) {
+					var err error
+					if s.TLSConfig != nil {
+						c.Logger.Logf("Starting server with TLS on %s", ln.Addr())
+						err = s.ServeTLS(ln, "", "")
+					} else {
+						c.Logger.Logf("Starting server on %s", ln.Addr())
+						err = s.Serve(ln)
+					}
+					if err != http.ErrServerClosed {
+						ch <- err
+					} else {
+						ch <- nil
+					}
+				}(server, ln, errCh)
+			}
 			// Close previous server
 			if oldServ != nil {
 				c.Logger.Logln("Shutting down old server")
-				ctx, cancel := context.WithTimeout(
-					context.Background(), time.Duration(1)*time.Minute)
-				err = oldServ.Shutdown(ctx)
-				cancel()
+				err = shutdown(oldServ, oldConf.ShutdownTimeout)
 				if err != nil {
 					c.Logger.Errorf(
 						"Error while shutting down old server: %s\n", err)
 				}
+				// The old handlers are done once the old server drained
+				err = shutdownConfig(oldConf, oldConf.ShutdownTimeout)
+				if err != nil {
+					c.Logger.Errorf(
+						"Error while shutting down old handlers: %s\n", err)
+				}
+			}
+			// Close sockets for addresses no longer listened on
+			if err = sockets.Prune(c); err != nil {
+				c.Logger.Errorf("Error while closing old listeners: %s\n", err)
 			}
 		case err := <-errCh:
 			if err != nil {
@@ -120,10 +203,13 @@ func main() {
 		case sig := <-sigch:
 			if sig == os.Interrupt || sig == syscall.SIGTERM {
 				c.Logger.Logln("Received interrupt signal. Exiting...")
-				ctx, cancel := context.WithTimeout(
-					context.Background(), time.Duration(1)*time.Minute)
-				err := server.Shutdown(ctx)
-				cancel()
+				err := shutdown(server, c.ShutdownTimeout)
+				sockets.Close()
+				// Queued submissions are kept for the next start
+				c.StopQueue()
+				if hErr := shutdownConfig(c, c.ShutdownTimeout); hErr != nil {
+					c.Logger.Errorf("Error while shutting down handlers: %s\n", hErr)
+				}
 				if err != nil {
 					c.Logger.Errorf("Server exited with error: %s\n", err)
 					os.Exit(1)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	stdlog "log"
+	"os"
+	"text/tabwriter"
+
+	"gitlab.com/BluestNight/nebula-forms/config"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/log"
+)
+
+// listPlugins runs the plugins command with the given arguments, returning
+// the exit code. It lists the built-in handler types and the plugins in the
+// plugins directory, and fails if any plugin cannot be loaded.
+func listPlugins(args []string) int {
+	flags := flag.NewFlagSet("plugins", flag.ContinueOnError)
+	configFile := flags.String("conf", config.DefaultConfigFile,
+		"the configuration file to read plugins_dir from")
+	dir := flags.String("dir", "",
+		"the plugins directory to list, instead of the configured one")
+	verbose := flags.Bool("v", false, "also list the options of each handler type")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s plugins [-conf FILE | -dir DIR] [-v]\n\n",
+			os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	if *dir == "" {
+		var err error
+		*dir, err = config.PluginDirFromTOMLFile(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading configuration file %s: %s\n",
+				*configFile, err)
+			return 1
+		}
+	}
+
+	// Plugins running as processes log to standard error
+	logger := &log.Logger{}
+	logger.AddLogger(stdlog.New(os.Stderr, "", 0))
+	logger.AddErrorLogger(stdlog.New(os.Stderr, "", 0))
+
+	plugins, err := config.ListPlugins(*dir, logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading plugins directory %s: %s\n", *dir, err)
+	}
+
+	code := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKIND\tVERSION\tDESCRIPTION")
+	for _, p := range plugins {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Name, p.Kind, p.Metadata.Version,
+			p.Metadata.Description)
+	}
+	w.Flush()
+
+	for _, p := range plugins {
+		if p.Err == nil && !(*verbose && len(p.Metadata.Config) > 0) {
+			continue
+		}
+		fmt.Printf("\n%s (%s):\n", p.Name, p.Kind)
+		if p.Err != nil {
+			fmt.Printf("  error: %s\n", p.Err)
+			code = 1
+		}
+		if *verbose {
+			for _, opt := range p.Metadata.Config {
+				required := ""
+				if opt.Required {
+					required = ", required"
+				}
+				fmt.Printf("  %s (%s%s): %s\n", opt.Name, opt.Type, required,
+					opt.Description)
+			}
+		}
+	}
+
+	fmt.Printf("\nThis server supports plugin API version %d.\n", handler.APIVersion)
+	if err != nil {
+		return 1
+	}
+	return code
+}
@@ -1,4 +1,7 @@
-package main
+// Package email provides the email handler type, which sends an email for
+// each form submission. It registers itself as a built-in handler type when
+// imported.
+package email
 
 import (
 	"bytes"
@@ -11,7 +14,6 @@ import (
 	"regexp"
 	"sync"
 	"text/template"
-	"time"
 
 	e "gitlab.com/BluestNight/nebula-forms/errors"
 	"gitlab.com/BluestNight/nebula-forms/handler"
@@ -19,14 +21,58 @@ import (
 	"gopkg.in/gomail.v2"
 )
 
-func main() {}
-
 // Type tells the main configuration which are email handlers
 const Type = "email"
 
-// "Global" varibles to help keep track of things
-var senders = make(map[string]Sender)
-var senderMux sync.Mutex // RWMutex?
+// Version is the version of the email handler type
+const Version = "1.0.0"
+
+// Metadata describes the email handler type and its options
+var Metadata = handler.Metadata{
+	Name:        Type,
+	Version:     Version,
+	Description: "Sends an email for each submission, over SMTP or with sendmail",
+	Config: []handler.ConfigOption{
+		{Name: LabelSender, Type: "string", Required: true,
+			Description: "the name of an SMTP sender, or \"sendmail\""},
+		{Name: LabelSubject, Type: "template", Required: true,
+			Description: "the subject of the email"},
+		{Name: LabelBody, Type: "template", Required: true,
+			Description: "the body of the email"},
+		{Name: LabelTo, Type: "template", Required: true,
+			Description: "the addresses to send the email to"},
+		{Name: LabelFrom, Type: "template",
+			Description: "the sender's address, required with sendmail"},
+		{Name: LabelReplyTo, Type: "template",
+			Description: "the address that replies go to"},
+		{Name: LabelCC, Type: "template",
+			Description: "the addresses to copy the email to"},
+		{Name: LabelBCC, Type: "template",
+			Description: "the addresses to blind copy the email to"},
+		{Name: LabelFiles, Type: "list of strings",
+			Description: "the file fields to attach to the email"}}}
+
+func init() {
+	handler.Register(Type, handler.Factory{New: New, Metadata: Metadata})
+}
+
+// emailType holds the senders created from one configuration. Each
+// configuration load gets its own, so senders removed from the configuration
+// are not kept around.
+type emailType struct {
+	mutex   sync.Mutex
+	senders map[string]Sender
+}
+
+// New returns the email handler type without any senders, to be configured
+// with one configuration
+func New() *handler.Plugin {
+	t := &emailType{senders: make(map[string]Sender)}
+	return &handler.Plugin{
+		NewHandler: t.newHandler,
+		Configure:  t.configure,
+		Metadata:   Metadata}
+}
 
 // Configuration labels to avoid mistypes
 // As public variables for easy customization by programs using this as
@@ -67,53 +113,55 @@ type Handler struct {
 	files   []string
 }
 
-// NewSender creates a Sender that can be referenced later using the given name
-func NewSender(name string, d interface{}) error {
+// NewSender creates a Sender from the configuration of the sender with the
+// given name
+func NewSender(name string, d interface{}) (Sender, error) {
 	data, err := parse.MapStringKeys(d)
 	if err != nil {
-		return fmt.Errorf(e.ErrBaseConfig, name, err)
+		return nil, fmt.Errorf(e.ErrBaseConfig, name, err)
 	}
 
 	senderType, err := parse.String(data[LabelSenderType])
 	if err != nil {
-		return fmt.Errorf(e.ErrConfigItem,
+		return nil, fmt.Errorf(e.ErrConfigItem,
 			fmt.Sprintf("%s (%s)", LabelSenderType, name), err)
 	}
 
 	switch senderType {
 	default:
-		return errors.New("invalid email sender type")
+		return nil, errors.New("invalid email sender type")
 	case "smtp":
 		sender, err := NewSMTPSender(d)
 		if err != nil {
-			return fmt.Errorf(e.ErrBaseConfig, name, err)
+			return nil, fmt.Errorf(e.ErrBaseConfig, name, err)
 		}
-		// Got the SMTP sender, add to map
-		senderMux.Lock()
-		senders[name] = sender
-		senderMux.Unlock()
+		return sender, nil
 	}
-	return nil
 }
 
-func Configure(data interface{}) error {
+// configure creates the senders defined in the email section of the
+// configuration file
+func (t *emailType) configure(data interface{}) error {
 	conf, err := parse.MapStringKeys(data)
 	if err != nil {
 		return err
 	}
 
 	for name, d := range conf {
-		err = NewSender(name, d)
+		sender, err := NewSender(name, d)
 		if err != nil {
 			return err
 		}
+		t.mutex.Lock()
+		t.senders[name] = sender
+		t.mutex.Unlock()
 	}
 
 	return nil
 }
 
-// NewHandler returns a Handler that sends an email on a form submission
-func NewHandler(d interface{}) (handler.Handler, error) {
+// newHandler returns a Handler that sends an email on a form submission
+func (t *emailType) newHandler(d interface{}) (handler.Handler, error) {
 	data, err := parse.MapStringKeys(d)
 	if err != nil {
 		return nil, fmt.Errorf(e.ErrConfigItem, "handler", err)
@@ -180,15 +228,15 @@ func NewHandler(d interface{}) (handler.Handler, error) {
 				"sendmail requires handlers to provide \"From\" address")
 		}
 
-		senderMux.Lock()
-		if senders["sendmail"] == nil {
-			senders["sendmail"], err = NewSendmailSender()
+		t.mutex.Lock()
+		if t.senders["sendmail"] == nil {
+			t.senders["sendmail"], err = NewSendmailSender()
 		}
-		senderMux.Unlock()
+		t.mutex.Unlock()
 		if err != nil {
 			return nil, err
 		}
-	} else if s, ok := senders[sender].(SMTPSender); ok {
+	} else if s, ok := t.senders[sender].(SMTPSender); ok {
 		if s.from == "" {
 			return nil, fmt.Errorf(
 				"\"from\" needs to be set on handler and/or SMTP sender %s",
@@ -197,9 +245,9 @@ func NewHandler(d interface{}) (handler.Handler, error) {
 	}
 
 	var ok bool
-	senderMux.Lock()
-	h.sender, ok = senders[sender]
-	senderMux.Unlock()
+	t.mutex.Lock()
+	h.sender, ok = t.senders[sender]
+	t.mutex.Unlock()
 	if !ok {
 		return nil, fmt.Errorf(e.ErrConfigItem, LabelSender,
 			"no sender exists with name "+sender)
@@ -236,10 +284,14 @@ func (h Handler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGr
 	// FormValue method from the current Request
 	// First define the FuncMap
 	funcMap := template.FuncMap{
-		"Errorf":     handler.ErrorfFunc(tErr),
-		"FormValue":  req.PostFormValue,
-		"FormValues": handler.FormValuesFunc(req),
-		"Matches":    regexp.MatchString}
+		"Errorf":      handler.ErrorfFunc(tErr),
+		"FieldErrorf": handler.FieldErrorfFunc(tErr),
+		"Fields":      h.Fields,
+		"FormValue":   req.PostFormValue,
+		"FormValues":  handler.FormValuesFunc(req),
+		"IsSpam":      func() bool { return h.SpamAction(req) != "" },
+		"Matches":     regexp.MatchString,
+		"SpamScore":   func() float64 { return h.SpamScore(req) }}
 
 	// Parse subject line template
 	sTemp, err := template.New("subject").Funcs(funcMap).Parse(h.subject)
@@ -418,9 +470,8 @@ func (h Handler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGr
 	}
 
 	// Send email
-	ctx, cancel := context.WithTimeout(req.Context(), 10*time.Second)
-	err = h.sender.Send(ctx, msg)
-	cancel()
+	// The server sets the deadline for handling the submission
+	err = h.sender.Send(req.Context(), msg)
 	if err != nil {
 		e.HTTPErrorToChan(ch, err, http.StatusInternalServerError)
 		return
@@ -0,0 +1,37 @@
+package email
+
+import (
+	"testing"
+
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+func TestNew(t *testing.T) {
+	configured := New()
+	err := configured.Configure(map[string]interface{}{
+		"mailtrap": map[string]interface{}{
+			LabelSenderType: "smtp",
+			LabelHost:       SMTPConf[LabelHost],
+			LabelPort:       SMTPConf[LabelPort],
+			LabelUsername:   SMTPConf[LabelUsername],
+			LabelPassword:   SMTPConf[LabelPassword],
+			LabelFrom:       SMTPConf[LabelFrom]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conf := map[string]interface{}{
+		handler.LabelAllowedOrigins: []interface{}{"*"},
+		LabelSender:                 "mailtrap",
+		LabelSubject:                "Subject",
+		LabelBody:                   "Body",
+		LabelTo:                     "admin@example.com"}
+	if _, err = configured.NewHandler(conf); err != nil {
+		t.Errorf("Handler should use the configured sender, got %s", err)
+	}
+
+	// Senders belong to the configuration that created them
+	if _, err = New().NewHandler(conf); err == nil {
+		t.Error("Senders should not be shared between instances")
+	}
+}
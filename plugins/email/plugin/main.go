@@ -0,0 +1,24 @@
+// Command plugin builds the email handler type as a plugin for servers that
+// do not have it built in:
+//
+//	go build -buildmode=plugin -o email.so ./plugins/email/plugin
+package main
+
+import (
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/plugins/email"
+)
+
+func main() {}
+
+// APIVersion is the version of the plugin API the plugin was built against
+var APIVersion = handler.APIVersion
+
+// Metadata describes the email handler type
+var Metadata = email.Metadata
+
+// New returns the email handler type without any senders, to be configured
+// with one configuration
+func New() *handler.Plugin {
+	return email.New()
+}
@@ -1,4 +1,4 @@
-package main
+package email
 
 import (
 	"context"
@@ -94,10 +94,20 @@ func (s SMTPSender) Send(ctx context.Context, msg *gomail.Message) *e.HTTPError
 		msg.SetHeader("From", s.from)
 	}
 
-	// Attempt to send the message
-	err := s.d.DialAndSend(msg)
-	if err != nil {
-		return e.NewHTTPError(err.Error(), http.StatusInternalServerError)
+	// Attempt to send the message, giving up once the context is done. The
+	// dialer cannot be interrupted, so the attempt may still finish later.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.d.DialAndSend(msg)
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return e.NewHTTPError(err.Error(), http.StatusInternalServerError)
+		}
+		return nil
+	case <-ctx.Done():
+		return e.NewHTTPError(ctx.Err().Error(), http.StatusGatewayTimeout)
 	}
-	return nil
 }
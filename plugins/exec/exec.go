@@ -0,0 +1,594 @@
+// Package exec provides the exec handler type, which runs a command for each
+// form submission so that forms can be handled by scripts. It registers
+// itself as a built-in handler type when imported.
+package exec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"github.com/Shadow53/interparser/parse"
+)
+
+// Type tells the main configuration which are exec handlers
+const Type = "exec"
+
+// Version is the version of the exec handler type
+const Version = "1.0.0"
+
+// Configuration labels to avoid mistypes
+// As public variables for easy customization by programs using this as
+// a library
+var (
+	// LabelCommand is the label for the command to run, as a list of the
+	// program and its arguments. A string runs a program without arguments.
+	LabelCommand = "command"
+	// LabelStdin is the label for whether the submission is written to the
+	// command's standard input as JSON. Defaults to true.
+	LabelStdin = "stdin"
+	// LabelEnv is the label for whether the submitted fields are passed to
+	// the command as environment variables, named EnvPrefix followed by the
+	// field name in upper case. Defaults to false.
+	LabelEnv = "env"
+	// LabelPassEnv is the label for the list of the server's environment
+	// variables passed to the command, in addition to DefaultPassEnv. No
+	// others are passed, so that the command does not see secrets such as
+	// SMTP passwords.
+	LabelPassEnv = "pass_env"
+	// LabelTimeout is the label for how long the command may run before it
+	// is killed. Defaults to DefaultTimeout.
+	LabelTimeout = "timeout"
+	// LabelWorkDir is the label for the directory the command runs in.
+	// Defaults to the server's working directory.
+	LabelWorkDir = "work_dir"
+	// LabelUser is the label for the user name or ID to run the command as.
+	// The server must run as root to use it.
+	LabelUser = "user"
+	// LabelGroup is the label for the group name or ID to run the command
+	// as. Defaults to the primary group of LabelUser.
+	LabelGroup = "group"
+	// LabelExitCodes is the label for the table of HTTP statuses to answer
+	// with for each exit code of the command. Statuses below 400 count as
+	// success. Other non-zero exit codes are answered with
+	// DefaultExitStatus.
+	LabelExitCodes = "exit_codes"
+	// LabelStderrMessage is the label for whether what the command writes to
+	// its standard error is used as the error message when it fails, which
+	// shows it to the client. Defaults to false.
+	LabelStderrMessage = "stderr_message"
+)
+
+// DefaultTimeout is the default time a command may run
+var DefaultTimeout = 30 * time.Second
+
+// DefaultExitStatus is the HTTP status for non-zero exit codes without an
+// entry in LabelExitCodes
+var DefaultExitStatus = http.StatusInternalServerError
+
+// DefaultPassEnv are the server's environment variables that are always
+// passed to commands
+var DefaultPassEnv = []string{"PATH", "HOME", "LANG", "TMPDIR"}
+
+// EnvPrefix is the prefix of the environment variables holding the
+// submitted fields
+var EnvPrefix = "FORM_"
+
+// maxStderr is the number of bytes of the command's standard error kept for
+// the error message
+const maxStderr = 4096
+
+// Error codes for the reasons a command failed
+const (
+	CodeExecFailed  = "exec_failed"
+	CodeExecTimeout = "exec_timeout"
+)
+
+// Metadata describes the exec handler type and its options
+var Metadata = handler.Metadata{
+	Name:        Type,
+	Version:     Version,
+	Description: "Runs a command for each submission",
+	Config: []handler.ConfigOption{
+		{Name: LabelCommand, Type: "list of strings", Required: true,
+			Description: "the program to run and its arguments"},
+		{Name: LabelStdin, Type: "boolean",
+			Description: "whether to write the submission as JSON to standard input"},
+		{Name: LabelEnv, Type: "boolean",
+			Description: "whether to pass the fields as " + EnvPrefix +
+				"<NAME> environment variables"},
+		{Name: LabelPassEnv, Type: "list of strings",
+			Description: "the server's environment variables to pass to the command"},
+		{Name: LabelTimeout, Type: "duration",
+			Description: "how long the command may run"},
+		{Name: LabelWorkDir, Type: "string",
+			Description: "the directory to run the command in"},
+		{Name: LabelUser, Type: "string",
+			Description: "the user name or ID to run the command as"},
+		{Name: LabelGroup, Type: "string",
+			Description: "the group name or ID to run the command as"},
+		{Name: LabelExitCodes, Type: "table",
+			Description: "the HTTP status to answer with for each exit code"},
+		{Name: LabelStderrMessage, Type: "boolean",
+			Description: "whether to show standard error to the client on failure"}}}
+
+func init() {
+	handler.Register(Type, handler.Factory{
+		NewHandler: NewHandler,
+		Metadata:   Metadata})
+}
+
+// File is an uploaded file, written to a temporary directory for the
+// command
+type File struct {
+	Filename    string `json:"filename"`
+	Path        string `json:"path"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+}
+
+// Submission is the JSON written to the command's standard input
+type Submission struct {
+	ID       string              `json:"id"`
+	Path     string              `json:"path"`
+	ClientIP string              `json:"client_ip"`
+	Fields   map[string][]string `json:"fields"`
+	Files    map[string][]File   `json:"files,omitempty"`
+}
+
+// Handler represents a handler for a particular form where the expected
+// behavior is to run a command.
+type Handler struct {
+	handler.Base
+	command       []string
+	stdin         bool
+	env           bool
+	passEnv       []string
+	timeout       time.Duration
+	workDir       string
+	credential    *syscall.Credential
+	exitCodes     map[int]int
+	stderrMessage bool
+	// running counts the commands in progress, for Shutdown
+	running *sync.WaitGroup
+}
+
+// lookupID returns the numeric ID given, or looks it up by name
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err == nil {
+		return uint32(id), nil
+	}
+	s, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err = strconv.ParseUint(s, 10, 32)
+	return uint32(id), err
+}
+
+// parseCredential returns the credential to run commands as, or nil if
+// neither a user nor a group is set
+func parseCredential(data map[string]interface{}) (*syscall.Credential, error) {
+	userName, err := parse.StringOrDefault(data[LabelUser], "")
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelUser, err)
+	}
+	group, err := parse.StringOrDefault(data[LabelGroup], "")
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelGroup, err)
+	}
+	if userName == "" && group == "" {
+		return nil, nil
+	}
+
+	cred := &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	if userName != "" {
+		cred.Uid, err = lookupID(userName, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelUser, err)
+		}
+	}
+
+	if group != "" {
+		cred.Gid, err = lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelGroup, err)
+		}
+	} else {
+		// Use the user's primary group rather than the server's
+		u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelGroup, fmt.Sprintf(
+				"must be set because the group of %s is unknown: %s", userName, err))
+		}
+		gid, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelGroup, err)
+		}
+		cred.Gid = uint32(gid)
+	}
+
+	return cred, nil
+}
+
+// parseExitCodes parses the table of HTTP statuses for exit codes
+func parseExitCodes(d interface{}) (map[int]int, error) {
+	codes := make(map[int]int)
+	if d == nil {
+		return codes, nil
+	}
+
+	conf, err := parse.MapStringKeys(d)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelExitCodes, err)
+	}
+	for code, s := range conf {
+		label := fmt.Sprintf("%s (%s)", LabelExitCodes, code)
+		exitCode, err := strconv.Atoi(code)
+		if err != nil || exitCode <= 0 || exitCode > 255 {
+			return nil, fmt.Errorf(e.ErrConfigItem, label,
+				"exit codes must be between 1 and 255")
+		}
+		status, err := parse.Int64(s)
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, label, err)
+		}
+		if status < 200 || status > 599 {
+			return nil, fmt.Errorf(e.ErrConfigItem, label,
+				"must be an HTTP status between 200 and 599")
+		}
+		codes[exitCode] = int(status)
+	}
+	return codes, nil
+}
+
+// NewHandler returns a Handler that runs a command on a form submission
+func NewHandler(d interface{}) (handler.Handler, error) {
+	data, err := parse.MapStringKeys(d)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, "handler", err)
+	}
+
+	h := &Handler{running: &sync.WaitGroup{}}
+	err = h.Unmarshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse command, which may be a single program
+	if program, ok := data[LabelCommand].(string); ok {
+		h.command = []string{program}
+	} else {
+		args, err := parse.Slice(data[LabelCommand])
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelCommand, err)
+		}
+		for _, arg := range args {
+			s, err := parse.String(arg)
+			if err != nil {
+				return nil, fmt.Errorf(e.ErrConfigItem, LabelCommand, err)
+			}
+			h.command = append(h.command, s)
+		}
+	}
+	if len(h.command) == 0 || h.command[0] == "" {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelCommand,
+			"must name a program to run")
+	}
+
+	h.stdin, err = parse.BoolOrDefault(data[LabelStdin], true)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelStdin, err)
+	}
+
+	h.env, err = parse.BoolOrDefault(data[LabelEnv], false)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelEnv, err)
+	}
+
+	passEnv, err := parse.SliceOrNil(data[LabelPassEnv])
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelPassEnv, err)
+	}
+	h.passEnv = append(h.passEnv, DefaultPassEnv...)
+	for _, name := range passEnv {
+		s, err := parse.String(name)
+		if err != nil {
+			return nil, fmt.Errorf(e.ErrConfigItem, LabelPassEnv, err)
+		}
+		h.passEnv = append(h.passEnv, s)
+	}
+
+	h.timeout, err = handler.DurationOrDefault(data[LabelTimeout], DefaultTimeout)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelTimeout, err)
+	}
+	if h.timeout <= 0 {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelTimeout, "must be positive")
+	}
+
+	h.workDir, err = parse.StringOrDefault(data[LabelWorkDir], "")
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelWorkDir, err)
+	}
+
+	h.credential, err = parseCredential(data)
+	if err != nil {
+		return nil, err
+	}
+
+	h.exitCodes, err = parseExitCodes(data[LabelExitCodes])
+	if err != nil {
+		return nil, err
+	}
+
+	h.stderrMessage, err = parse.BoolOrDefault(data[LabelStderrMessage], false)
+	if err != nil {
+		return nil, fmt.Errorf(e.ErrConfigItem, LabelStderrMessage, err)
+	}
+
+	return h, nil
+}
+
+// envName returns the name of the environment variable for a field
+func envName(field string) string {
+	name := []rune(strings.ToUpper(field))
+	for i, r := range name {
+		if !(r >= 'A' && r <= 'Z') && !(r >= '0' && r <= '9') {
+			name[i] = '_'
+		}
+	}
+	return EnvPrefix + string(name)
+}
+
+// writeFiles writes the files uploaded with the submission to the given
+// directory, owned by the user running the command
+func (h Handler) writeFiles(req *http.Request, dir string) (map[string][]File, error) {
+	if req.MultipartForm == nil || len(req.MultipartForm.File) == 0 {
+		return nil, nil
+	}
+
+	files := make(map[string][]File)
+	n := 0
+	for field, headers := range req.MultipartForm.File {
+		for _, fh := range headers {
+			// Uploaded file names are not trusted as paths
+			n++
+			path := filepath.Join(dir, fmt.Sprintf("%d-%s", n,
+				filepath.Base(filepath.Clean("/"+fh.Filename))))
+
+			src, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			dst, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				src.Close()
+				return nil, err
+			}
+			_, err = io.Copy(dst, src)
+			src.Close()
+			if cErr := dst.Close(); err == nil {
+				err = cErr
+			}
+			if err == nil && h.credential != nil {
+				err = os.Chown(path, int(h.credential.Uid), int(h.credential.Gid))
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			files[field] = append(files[field], File{
+				Filename:    fh.Filename,
+				Path:        path,
+				ContentType: fh.Header.Get("Content-Type"),
+				Size:        fh.Size})
+		}
+	}
+	return files, nil
+}
+
+// environment returns the command's environment variables. Only the
+// server's variables named in passEnv are included.
+func (h Handler) environment(sub Submission, dir string) []string {
+	var env []string
+	for _, name := range h.passEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	env = append(env,
+		"NEBULA_SUBMISSION_ID="+sub.ID,
+		"NEBULA_PATH="+sub.Path,
+		"NEBULA_CLIENT_IP="+sub.ClientIP,
+		"NEBULA_FILES_DIR="+dir)
+	if !h.env {
+		return env
+	}
+
+	names := make([]string, 0, len(sub.Fields))
+	for name := range sub.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env = append(env, envName(name)+"="+strings.Join(sub.Fields[name], "\n"))
+	}
+	return env
+}
+
+// limitedBuffer keeps the first maxStderr bytes written to it
+type limitedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxStderr - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// exitError returns the error to answer with for the command's result, or
+// nil if the command succeeded
+func (h Handler) exitError(err error, stderr string) *e.HTTPError {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return e.NewCodedError(CodeExecFailed,
+			fmt.Sprintf("could not run command: %s", err),
+			http.StatusInternalServerError)
+	}
+
+	code := -1
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+		code = status.ExitStatus()
+	}
+	status, ok := h.exitCodes[code]
+	if !ok {
+		status = DefaultExitStatus
+	}
+	if status < 400 {
+		return nil
+	}
+
+	msg := fmt.Sprintf("command failed with exit code %d", code)
+	if h.stderrMessage && strings.TrimSpace(stderr) != "" {
+		msg = strings.TrimSpace(stderr)
+	}
+	return e.NewCodedError(CodeExecFailed, msg, status)
+}
+
+// Handle runs the command with the submission
+func (h Handler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+	h.running.Add(1)
+	defer h.running.Done()
+
+	dir, err := ioutil.TempDir("", "nebula-exec")
+	if err != nil {
+		e.HTTPErrorToChan(ch, err, http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	if h.credential != nil {
+		err = os.Chown(dir, int(h.credential.Uid), int(h.credential.Gid))
+		if err != nil {
+			e.HTTPErrorToChan(ch, err, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	sub := Submission{
+		ID:       handler.SubmissionID(req),
+		Path:     req.URL.Path,
+		ClientIP: handler.ClientIP(req),
+		Fields:   req.PostForm}
+	if sub.Fields == nil {
+		sub.Fields = make(map[string][]string)
+	}
+	sub.Files, err = h.writeFiles(req, dir)
+	if err != nil {
+		e.HTTPErrorToChan(ch, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The server's deadline for handling the submission also applies
+	ctx, cancel := context.WithTimeout(req.Context(), h.timeout)
+	defer cancel()
+
+	cmd := exec.Command(h.command[0], h.command[1:]...)
+	cmd.Dir = h.workDir
+	cmd.Env = h.environment(sub, dir)
+	// The command gets its own process group, so that it can be killed
+	// along with any processes it started
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true,
+		Credential: h.credential}
+	if h.stdin {
+		body, err := json.Marshal(sub)
+		if err != nil {
+			e.HTTPErrorToChan(ch, err, http.StatusInternalServerError)
+			return
+		}
+		cmd.Stdin = bytes.NewReader(body)
+	}
+	stderr := &limitedBuffer{}
+	cmd.Stderr = stderr
+
+	if err = cmd.Start(); err != nil {
+		ch <- h.exitError(err, "")
+		return
+	}
+	// Processes started by the command would otherwise keep its standard
+	// error open after it was killed, and Wait with it
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-exited:
+		}
+	}()
+	err = cmd.Wait()
+	close(exited)
+
+	if ctx.Err() == context.DeadlineExceeded {
+		ch <- e.NewCodedError(CodeExecTimeout, "command timed out",
+			http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		if hErr := h.exitError(err, stderr.String()); hErr != nil {
+			ch <- hErr
+		}
+	}
+}
+
+// Shutdown waits for the commands in progress to finish, until the context
+// is done
+func (h Handler) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("commands still running: %s", ctx.Err())
+	}
+}
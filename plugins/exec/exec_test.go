@@ -0,0 +1,207 @@
+package exec
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+func newTestHandler(t *testing.T, conf map[string]interface{}) handler.Handler {
+	conf[handler.LabelAllowedOrigins] = []interface{}{"*"}
+	h, err := NewHandler(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// handle runs the handler on a submission and returns its error
+func handle(h handler.Handler, req *http.Request) *e.HTTPError {
+	ch := make(chan *e.HTTPError, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.Handle(req, ch, &wg)
+	close(ch)
+	return <-ch
+}
+
+// multipartRequest returns a parsed submission with the given fields and
+// a file named upload.txt
+func multipartRequest(t *testing.T, fields url.Values, file string) *http.Request {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	for name, vals := range fields {
+		for _, val := range vals {
+			w.WriteField(name, val)
+		}
+	}
+	f, _ := w.CreateFormFile("upload", "upload.txt")
+	f.Write([]byte(file))
+	w.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/test", buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	req, sub, err := handler.NewSubmission(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.ClientIP = "192.0.2.1"
+	return req
+}
+
+func TestHandle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-exec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only variables in pass_env reach the command
+	os.Setenv("NEBULA_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("NEBULA_TEST_SECRET")
+	os.Setenv("NEBULA_TEST_PASSED", "passed")
+	defer os.Unsetenv("NEBULA_TEST_PASSED")
+
+	// The script saves its input, environment, and files for inspection
+	h := newTestHandler(t, map[string]interface{}{
+		LabelCommand: []interface{}{"/bin/sh", "-c",
+			`cat > stdin.json; printf %s "$FORM_FULL_NAME" > env.txt; ` +
+				`printf %s "$NEBULA_TEST_SECRET:$NEBULA_TEST_PASSED" > server.txt; ` +
+				`cat "$NEBULA_FILES_DIR"/* > files.txt`},
+		LabelEnv:     true,
+		LabelPassEnv: []interface{}{"NEBULA_TEST_PASSED"},
+		LabelWorkDir: dir})
+
+	req := multipartRequest(t, url.Values{"full-name": {"Joe", "Smith"}},
+		"file contents")
+	if res := handle(h, req); res != nil {
+		t.Fatalf("Command should succeed, got %s", res)
+	}
+
+	read := func(name string) string {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	sub := Submission{}
+	if err = json.Unmarshal([]byte(read("stdin.json")), &sub); err != nil {
+		t.Fatal(err)
+	}
+	if sub.ID != handler.SubmissionID(req) || sub.ClientIP != "192.0.2.1" ||
+		sub.Path != "/test" || len(sub.Fields["full-name"]) != 2 {
+		t.Errorf("Unexpected submission on standard input: %#v", sub)
+	}
+	files := sub.Files["upload"]
+	if len(files) != 1 || files[0].Filename != "upload.txt" ||
+		files[0].Size != 13 {
+		t.Errorf("Unexpected files in submission: %#v", files)
+	}
+
+	if env := read("env.txt"); env != "Joe\nSmith" {
+		t.Errorf("Expected fields in the environment, got %q", env)
+	}
+	if env := read("server.txt"); env != ":passed" {
+		t.Errorf("Expected only passed server variables, got %q", env)
+	}
+	if contents := read("files.txt"); contents != "file contents" {
+		t.Errorf("Expected uploaded file to be written, got %q", contents)
+	}
+	if _, err = os.Stat(files[0].Path); !os.IsNotExist(err) {
+		t.Error("Uploaded files should be removed after the command exits")
+	}
+}
+
+func TestHandle_ExitCodes(t *testing.T) {
+	conf := func(script string, stderr bool) map[string]interface{} {
+		return map[string]interface{}{
+			LabelCommand:       []interface{}{"/bin/sh", "-c", script},
+			LabelStdin:         false,
+			LabelTimeout:       "100ms",
+			LabelStderrMessage: stderr,
+			LabelExitCodes: map[string]interface{}{
+				"3": int64(409),
+				"4": int64(202)}}
+	}
+
+	tests := []struct {
+		name    string
+		script  string
+		stderr  bool
+		status  int
+		code    string
+		message string
+	}{
+		{"mapped", "echo 'already signed up' >&2; exit 3", true,
+			http.StatusConflict, CodeExecFailed, "already signed up"},
+		{"hidden stderr", "echo secret >&2; exit 3", false,
+			http.StatusConflict, CodeExecFailed, "command failed with exit code 3"},
+		{"unmapped", "exit 1", true,
+			http.StatusInternalServerError, CodeExecFailed,
+			"command failed with exit code 1"},
+		{"success status", "exit 4", false, 0, "", ""},
+		{"timeout", "sleep 5", false,
+			http.StatusGatewayTimeout, CodeExecTimeout, "command timed out"}}
+
+	for _, test := range tests {
+		h := newTestHandler(t, conf(test.script, test.stderr))
+		res := handle(h, multipartRequest(t, nil, ""))
+		if test.status == 0 {
+			if res != nil {
+				t.Errorf("%s: expected success, got %s", test.name, res)
+			}
+			continue
+		}
+		if res == nil || res.Status() != test.status || res.Code() != test.code ||
+			res.Error() != test.message {
+			t.Errorf("%s: expected %d %s %q, got %#v", test.name, test.status,
+				test.code, test.message, res)
+		}
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		conf map[string]interface{}
+		err  string
+	}{
+		{"missing command", map[string]interface{}{}, LabelCommand},
+		{"empty command", map[string]interface{}{
+			LabelCommand: []interface{}{}}, LabelCommand},
+		{"bad exit code", map[string]interface{}{
+			LabelCommand:   "true",
+			LabelExitCodes: map[string]interface{}{"0": int64(400)}}, LabelExitCodes},
+		{"bad status", map[string]interface{}{
+			LabelCommand:   "true",
+			LabelExitCodes: map[string]interface{}{"1": int64(99)}}, LabelExitCodes},
+		{"bad timeout", map[string]interface{}{
+			LabelCommand: "true",
+			LabelTimeout: "0s"}, LabelTimeout}}
+
+	for _, test := range tests {
+		test.conf[handler.LabelAllowedOrigins] = []interface{}{"*"}
+		_, err := NewHandler(test.conf)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected an error about %s, got %v", test.name,
+				test.err, err)
+		}
+	}
+}
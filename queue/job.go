@@ -0,0 +1,90 @@
+package queue
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// persistedHeaders are the request headers stored with a job. Other headers,
+// such as cookies and credentials, are not written to disk.
+var persistedHeaders = []string{"Accept-Language", "Content-Type", "Origin",
+	"Referer", "User-Agent"}
+
+// Job is a form submission waiting to be processed by a single handler.
+// It contains everything needed to recreate the original request.
+type Job struct {
+	// ID uniquely identifies the job in the queue
+	ID string
+	// Submission is the ID of the submission the job was created for
+	Submission string
+	// Handler is the name of the handler that should process the job
+	Handler string
+	// ClientIP is the IP address of the client that made the submission
+	ClientIP string
+
+	Method     string
+	URL        string
+	Host       string
+	RemoteAddr string
+	Header     http.Header
+	Body       []byte
+
+	Created     time.Time
+	NextAttempt time.Time
+	Attempts    int
+	LastError   string
+}
+
+// NewJob creates a Job for the given handler from the request and its raw
+// body. The body must be passed separately because the request's body has
+// usually been read by the time the job is created. Only the headers in
+// persistedHeaders are kept.
+func NewJob(submission string, handlerName string, req *http.Request, body []byte) *Job {
+	header := make(http.Header)
+	for _, name := range persistedHeaders {
+		if values, ok := req.Header[name]; ok {
+			header[name] = values
+		}
+	}
+
+	return &Job{
+		ID:         submission + "-" + fileSafe(handlerName),
+		Submission: submission,
+		Handler:    handlerName,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		Header:     header,
+		Body:       body}
+}
+
+// Request recreates the request the job was created from. The form is not
+// parsed yet.
+func (j *Job) Request() (*http.Request, error) {
+	req, err := http.NewRequest(j.Method, j.URL, bytes.NewReader(j.Body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header = j.Header
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	req.Host = j.Host
+	req.RemoteAddr = j.RemoteAddr
+	return req, nil
+}
+
+// fileSafe replaces all characters that may not be safe to use in file names
+func fileSafe(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,384 @@
+// Package queue provides a persistent, on-disk queue of form submissions
+// that are handled asynchronously by a pool of workers, with retries.
+package queue
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/log"
+)
+
+const (
+	// jobExt is the file extension of queued jobs
+	jobExt = ".json"
+	// tmpExt is the file extension of jobs that are still being written
+	tmpExt = ".tmp"
+	// failedDir is the subdirectory that jobs are moved to after they failed
+	// permanently, so they can be inspected and requeued by hand
+	failedDir = "failed"
+	// pollInterval is how often the queue directory is checked for jobs
+	// added by other Queues, such as one belonging to an older configuration
+	pollInterval = 5 * time.Second
+	// maxBackoff is the longest time to wait before retrying a job
+	maxBackoff = 6 * time.Hour
+)
+
+// ProcessFunc handles a queued job. Returning an HTTPError with a status
+// below 500 means the job can never succeed and will not be retried.
+type ProcessFunc func(*Job) *e.HTTPError
+
+// Options configures a Queue
+type Options struct {
+	// Workers is the number of jobs processed at the same time
+	Workers int
+	// MaxRetries is the number of times a failed job is retried before it is
+	// moved to the failed directory
+	MaxRetries int
+	// Backoff is the time to wait before the first retry. It doubles with
+	// each retry after that.
+	Backoff time.Duration
+}
+
+// Queue stores jobs in a directory, one file per job, and runs them with a
+// pool of workers once started. Jobs are written to disk before Enqueue
+// returns, so they survive restarts of the server.
+type Queue struct {
+	dir      string
+	opts     Options
+	logger   *log.Logger
+	process  ProcessFunc
+	mutex    sync.Mutex
+	inflight map[string]struct{}
+	jobs     chan *Job
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New returns a Queue storing its jobs in the given directory, creating the
+// directory if needed. The Queue does not process jobs until Start is called.
+func New(dir string, opts Options, logger *log.Logger) (*Queue, error) {
+	if opts.Workers < 1 {
+		return nil, fmt.Errorf("number of workers must be positive, not %d",
+			opts.Workers)
+	}
+	if opts.MaxRetries < 0 {
+		return nil, fmt.Errorf("number of retries must be non-negative, not %d",
+			opts.MaxRetries)
+	}
+
+	err := os.MkdirAll(filepath.Join(dir, failedDir), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Queue{
+		dir:    dir,
+		opts:   opts,
+		logger: logger,
+		wake:   make(chan struct{}, 1)}, nil
+}
+
+// Dir returns the directory the queue stores its jobs in
+func (q *Queue) Dir() string {
+	return q.dir
+}
+
+func (q *Queue) jobPath(id string) string {
+	return filepath.Join(q.dir, id+jobExt)
+}
+
+// write stores the job at the given path. The job is first written to a
+// temporary file, which is synced and then renamed, so a crash never leaves a
+// partially written job behind.
+func (q *Queue) write(job *Job, path string) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+job.ID+tmpExt)
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// Sync the directory so the rename itself is durable
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
+
+// Enqueue writes the job to the queue and wakes the workers, if running.
+// The job's Created and NextAttempt times are set to the current time if
+// they are zero.
+func (q *Queue) Enqueue(job *Job) error {
+	if job.ID == "" {
+		return fmt.Errorf("job must have an ID")
+	}
+
+	now := time.Now()
+	if job.Created.IsZero() {
+		job.Created = now
+	}
+	if job.NextAttempt.IsZero() {
+		job.NextAttempt = now
+	}
+
+	if err := q.write(job, q.jobPath(job.ID)); err != nil {
+		return fmt.Errorf("could not queue job %s: %s", job.ID, err)
+	}
+
+	q.signal()
+	return nil
+}
+
+// signal wakes the dispatcher without blocking
+func (q *Queue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of jobs waiting in the queue, including those being
+// processed.
+func (q *Queue) Len() (int, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, file := range files {
+		if isJobFile(file) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func isJobFile(file os.FileInfo) bool {
+	return !file.IsDir() && strings.HasSuffix(file.Name(), jobExt) &&
+		!strings.HasPrefix(file.Name(), ".")
+}
+
+// Start starts the workers, which pass each job to process. Start must not be
+// called again before Stop.
+func (q *Queue) Start(process ProcessFunc) {
+	q.process = process
+	q.inflight = make(map[string]struct{})
+	q.jobs = make(chan *Job)
+	q.stop = make(chan struct{})
+
+	q.wg.Add(q.opts.Workers + 1)
+	go q.dispatch()
+	for i := 0; i < q.opts.Workers; i++ {
+		go q.work()
+	}
+}
+
+// Stop stops handing out jobs and waits for the workers to finish the jobs
+// they are processing. Jobs still in the queue are processed once the queue
+// (or another Queue using the same directory) is started again.
+func (q *Queue) Stop() {
+	if q.stop == nil {
+		return
+	}
+	close(q.stop)
+	q.wg.Wait()
+	q.stop = nil
+}
+
+// dispatch hands jobs that are due to the workers, checking the directory
+// whenever a job is enqueued, a retry is due, or pollInterval passes.
+func (q *Queue) dispatch() {
+	defer q.wg.Done()
+	defer close(q.jobs)
+
+	for {
+		next := q.dispatchDue()
+
+		wait := pollInterval
+		if !next.IsZero() {
+			if until := next.Sub(time.Now()); until < wait {
+				wait = until
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-q.stop:
+			timer.Stop()
+			return
+		case <-q.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// dispatchDue sends all due jobs to the workers and returns the time the next
+// job is due, or the zero time if there are no jobs waiting.
+func (q *Queue) dispatchDue() time.Time {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		q.logger.Errorf("Error while reading queue directory: %s", err)
+		return time.Time{}
+	}
+
+	var next time.Time
+	for _, file := range files {
+		if !isJobFile(file) {
+			continue
+		}
+
+		id := strings.TrimSuffix(file.Name(), jobExt)
+		q.mutex.Lock()
+		_, busy := q.inflight[id]
+		q.mutex.Unlock()
+		if busy {
+			continue
+		}
+
+		job, err := q.read(id)
+		if err != nil {
+			// Could have been finished by another Queue in the meantime
+			if !os.IsNotExist(err) {
+				q.logger.Errorf("Error while reading queued job %s: %s", id, err)
+			}
+			continue
+		}
+
+		if job.NextAttempt.After(time.Now()) {
+			if next.IsZero() || job.NextAttempt.Before(next) {
+				next = job.NextAttempt
+			}
+			continue
+		}
+
+		q.mutex.Lock()
+		q.inflight[id] = struct{}{}
+		q.mutex.Unlock()
+
+		select {
+		case q.jobs <- job:
+		case <-q.stop:
+			return time.Time{}
+		}
+	}
+
+	return next
+}
+
+func (q *Queue) read(id string) (*Job, error) {
+	data, err := ioutil.ReadFile(q.jobPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Job{}
+	if err = json.Unmarshal(data, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// work processes jobs until the dispatcher stops
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for job := range q.jobs {
+		q.run(job)
+		q.mutex.Lock()
+		delete(q.inflight, job.ID)
+		q.mutex.Unlock()
+		// Let the dispatcher know when a retry is due
+		q.signal()
+	}
+}
+
+// run processes a single job, then removes it from the queue, schedules a
+// retry, or moves it to the failed directory.
+func (q *Queue) run(job *Job) {
+	job.Attempts++
+	q.logger.Debugf("Processing queued job %s (attempt %d)", job.ID, job.Attempts)
+
+	err := q.process(job)
+	if err == nil {
+		q.logger.Logf("Queued job %s completed", job.ID)
+		if rmErr := os.Remove(q.jobPath(job.ID)); rmErr != nil {
+			q.logger.Errorf("Error while removing completed job %s: %s",
+				job.ID, rmErr)
+		}
+		return
+	}
+
+	job.LastError = err.Error()
+	if err.Status() < http.StatusInternalServerError ||
+		job.Attempts > q.opts.MaxRetries {
+		q.logger.Errorf("Queued job %s failed permanently after %d attempt(s): %s",
+			job.ID, job.Attempts, err)
+		q.fail(job)
+		return
+	}
+
+	job.NextAttempt = time.Now().Add(q.backoff(job.Attempts))
+	q.logger.Errorf("Queued job %s failed, retrying at %s: %s",
+		job.ID, job.NextAttempt.Format(time.RFC3339), err)
+	if wErr := q.write(job, q.jobPath(job.ID)); wErr != nil {
+		q.logger.Errorf("Error while rescheduling job %s: %s", job.ID, wErr)
+	}
+}
+
+// backoff returns the time to wait after the given number of attempts
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.opts.Backoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	return wait
+}
+
+// fail moves the job to the failed directory
+func (q *Queue) fail(job *Job) {
+	err := q.write(job, filepath.Join(q.dir, failedDir, job.ID+jobExt))
+	if err == nil {
+		err = os.Remove(q.jobPath(job.ID))
+	}
+	if err != nil {
+		q.logger.Errorf("Error while moving failed job %s: %s", job.ID, err)
+	}
+}
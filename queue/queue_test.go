@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/log"
+)
+
+func testQueue(t *testing.T, dir string) *Queue {
+	q, err := New(dir, Options{
+		Workers:    2,
+		MaxRetries: 2,
+		Backoff:    10 * time.Millisecond}, &log.Logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func testJob(submission string) *Job {
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/contact?a=b",
+		strings.NewReader("name=Joe+Smith"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	return NewJob(submission, "email.contact", req, []byte("name=Joe+Smith"))
+}
+
+// waitFor polls until cond returns true or the timeout passes
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJob_Request(t *testing.T) {
+	job := testJob("abc")
+	req, err := job.Request()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if req.Method != http.MethodPost {
+		t.Errorf("Wrong method: %s", req.Method)
+	}
+	if req.Host != "example.com" {
+		t.Errorf("Wrong host: %s", req.Host)
+	}
+	if err = req.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	if req.PostFormValue("name") != "Joe Smith" || req.FormValue("a") != "b" {
+		t.Errorf("Recreated request has wrong form values: %#v", req.Form)
+	}
+	if req.Header.Get("Cookie") != "" || req.Header.Get("Authorization") != "" {
+		t.Errorf("Credentials should not be stored with the job: %#v", req.Header)
+	}
+}
+
+func TestQueue_Retry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q := testQueue(t, dir)
+	var mutex sync.Mutex
+	attempts := make(map[string]int)
+
+	q.Start(func(job *Job) *e.HTTPError {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts[job.Submission]++
+		switch job.Submission {
+		case "flaky":
+			if attempts[job.Submission] == 1 {
+				return e.NewHTTPError("temporary failure", http.StatusInternalServerError)
+			}
+			return nil
+		case "invalid":
+			return e.NewHTTPError("bad submission", http.StatusBadRequest)
+		default:
+			return e.NewHTTPError("permanent failure", http.StatusInternalServerError)
+		}
+	})
+	defer q.Stop()
+
+	for _, id := range []string{"flaky", "invalid", "broken"} {
+		if err = q.Enqueue(testJob(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor(t, "queue to empty", func() bool {
+		n, err := q.Len()
+		return err == nil && n == 0
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if attempts["flaky"] != 2 {
+		t.Errorf("Job failing once should be attempted twice, not %d times",
+			attempts["flaky"])
+	}
+	if attempts["invalid"] != 1 {
+		t.Errorf("Job with client error should not be retried, attempted %d times",
+			attempts["invalid"])
+	}
+	if attempts["broken"] != 3 {
+		t.Errorf("Job should be retried twice, attempted %d times",
+			attempts["broken"])
+	}
+
+	failed, err := ioutil.ReadDir(filepath.Join(dir, failedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 2 {
+		t.Errorf("Expected 2 failed jobs, found %d", len(failed))
+	}
+}
+
+func TestQueue_Persistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nebula-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Jobs enqueued while no queue is running are kept on disk
+	if err = testQueue(t, dir).Enqueue(testJob("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	q := testQueue(t, dir)
+	if n, err := q.Len(); err != nil || n != 1 {
+		t.Fatalf("New queue should find 1 job, found %d (%v)", n, err)
+	}
+
+	done := make(chan *Job, 1)
+	q.Start(func(job *Job) *e.HTTPError {
+		done <- job
+		return nil
+	})
+	defer q.Stop()
+
+	select {
+	case job := <-done:
+		if job.Submission != "abc" || string(job.Body) != "name=Joe+Smith" {
+			t.Errorf("Job was not stored correctly: %#v", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the stored job")
+	}
+}
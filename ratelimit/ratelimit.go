@@ -0,0 +1,92 @@
+// Package ratelimit provides token bucket rate limiters keyed by strings,
+// such as the IP addresses of clients.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often buckets that have refilled completely are
+// removed, since they are the same as new buckets
+const pruneInterval = time.Minute
+
+// bucket holds the tokens left for a single key
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter allows up to Requests requests per key at once, refilling at a
+// rate of Requests per Per. Safe for parallel use.
+type Limiter struct {
+	Requests int64
+	Per      time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+// New returns a Limiter allowing the given number of requests per period
+func New(requests int64, per time.Duration) *Limiter {
+	return &Limiter{Requests: requests, Per: per}
+}
+
+// rate returns the number of tokens added per second
+func (l *Limiter) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// refill adds the tokens earned since the bucket was last updated
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(float64(l.Requests), b.tokens+elapsed*l.rate())
+		b.updated = now
+	}
+}
+
+// prune removes full buckets. Must be called with the mutex held.
+func (l *Limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+// Allow takes a token from the key's bucket and returns whether there was
+// one. If not, it also returns how long until the next token is added.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	return l.allowAt(key, time.Now())
+}
+
+func (l *Limiter) allowAt(key string, now time.Time) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*bucket)
+	}
+	if now.Sub(l.pruned) > pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.Requests), updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rate()
+	return false, time.Duration(wait * float64(time.Second))
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l := New(2, time.Minute)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allowAt("a", now); !ok {
+			t.Fatalf("Request %d should be allowed", i+1)
+		}
+	}
+
+	ok, wait := l.allowAt("a", now)
+	if ok {
+		t.Fatal("Request over the limit should not be allowed")
+	}
+	if wait != 30*time.Second {
+		t.Errorf("Expected to wait 30s for the next token, got %s", wait)
+	}
+
+	if ok, _ := l.allowAt("b", now); !ok {
+		t.Error("Keys should have separate buckets")
+	}
+
+	if ok, _ := l.allowAt("a", now.Add(30*time.Second)); !ok {
+		t.Error("Request should be allowed after a token was added")
+	}
+	if ok, _ := l.allowAt("a", now.Add(30*time.Second)); ok {
+		t.Error("Only one token should have been added")
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	l := New(2, time.Minute)
+	now := time.Now()
+	l.allowAt("a", now)
+	l.allowAt("b", now)
+	l.allowAt("b", now)
+
+	// Both buckets are full again by the time they are pruned
+	l.allowAt("c", now.Add(pruneInterval+time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("Full buckets should have been pruned, got %d buckets",
+			len(l.buckets))
+	}
+	if _, ok := l.buckets["c"]; !ok {
+		t.Error("Bucket in use should not have been pruned")
+	}
+}
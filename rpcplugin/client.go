@@ -0,0 +1,426 @@
+package rpcplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/log"
+)
+
+const (
+	// minRestartDelay is the time to wait before restarting a plugin that
+	// exited. It doubles each time the plugin exits soon after starting.
+	minRestartDelay = time.Second
+	// maxRestartDelay is the longest time to wait before restarting a plugin
+	maxRestartDelay = time.Minute
+	// stopTimeout is how long a plugin has to exit after its input is
+	// closed before it is killed
+	stopTimeout = 5 * time.Second
+	// startTimeout is how long a plugin has to answer each call made while
+	// starting it before it is killed
+	startTimeout = 5 * time.Second
+)
+
+// stdio joins a plugin's standard output and input into one connection
+type stdio struct {
+	io.ReadCloser
+	io.WriteCloser
+}
+
+func (s stdio) Close() error {
+	err := s.WriteCloser.Close()
+	if rErr := s.ReadCloser.Close(); err == nil {
+		err = rErr
+	}
+	return err
+}
+
+// logWriter logs each line written to it as coming from the plugin
+type logWriter struct {
+	path   string
+	logger *log.Logger
+	buf    []byte
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.logger.Logf("Plugin %s: %s", w.path, w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// process supervises a running plugin, restarting it if it exits and
+// recreating its configuration and handlers
+type process struct {
+	path   string
+	logger *log.Logger
+
+	mutex    sync.Mutex
+	cmd      *exec.Cmd
+	client   *rpc.Client
+	exited   chan struct{}
+	started  time.Time
+	delay    time.Duration
+	closed   bool
+	metadata handler.Metadata
+	config   interface{}
+	handlers map[string]interface{}
+	nextID   int
+}
+
+// start runs the plugin and brings it up to date with the configuration
+// and handlers created so far. Must be called with the mutex held.
+func (p *process) start() error {
+	cmd := exec.Command(p.path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	// Log whatever the plugin writes to its standard error
+	cmd.Stderr = &logWriter{path: p.path, logger: p.logger}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+
+	client := jsonrpc.NewClient(stdio{stdout, stdin})
+	fail := func(err error) error {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	// The mutex is held, so a plugin that does not answer must not block
+	// the server
+	call := func(method string, args interface{}, reply interface{}) error {
+		c := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+		timer := time.NewTimer(startTimeout)
+		defer timer.Stop()
+		select {
+		case <-c.Done:
+			return c.Error
+		case <-timer.C:
+			return fmt.Errorf("no answer to %s within %s", method, startTimeout)
+		}
+	}
+
+	reply := HandshakeReply{}
+	err = call("Handshake", HandshakeArgs{Version: ProtocolVersion}, &reply)
+	if err != nil {
+		return fail(fmt.Errorf("handshake failed: %s", err))
+	}
+	if reply.Version != ProtocolVersion {
+		return fail(fmt.Errorf("plugin speaks protocol version %d, expected %d",
+			reply.Version, ProtocolVersion))
+	}
+	p.metadata = reply.Metadata
+
+	if p.config != nil {
+		err = call("Configure", ConfigureArgs{p.config}, &Empty{})
+		if err != nil {
+			return fail(err)
+		}
+	}
+	for id, conf := range p.handlers {
+		err = call("NewHandler", NewHandlerArgs{ID: id, Config: conf}, &Empty{})
+		if err != nil {
+			return fail(fmt.Errorf("could not recreate handler: %s", err))
+		}
+	}
+
+	p.cmd = cmd
+	p.client = client
+	p.started = time.Now()
+	p.exited = make(chan struct{})
+	go p.supervise(cmd, client, p.exited)
+	return nil
+}
+
+// supervise waits for the plugin to exit and restarts it, unless the
+// process was closed
+func (p *process) supervise(cmd *exec.Cmd, client *rpc.Client, exited chan struct{}) {
+	err := cmd.Wait()
+	client.Close()
+	close(exited)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.cmd != cmd {
+		return
+	}
+	p.cmd = nil
+	p.client = nil
+	if p.closed {
+		return
+	}
+
+	// Back off if the plugin keeps exiting right after starting
+	if time.Since(p.started) > maxRestartDelay {
+		p.delay = minRestartDelay
+	} else if p.delay < maxRestartDelay {
+		p.delay *= 2
+		if p.delay < minRestartDelay {
+			p.delay = minRestartDelay
+		}
+		if p.delay > maxRestartDelay {
+			p.delay = maxRestartDelay
+		}
+	}
+	p.logger.Errorf("Plugin %s exited (%v); restarting in %s", p.path, err, p.delay)
+	time.AfterFunc(p.delay, p.restart)
+}
+
+// restart starts the plugin again if it is not running
+func (p *process) restart() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed || p.client != nil {
+		return
+	}
+	if err := p.start(); err != nil {
+		p.logger.Errorf("Could not restart plugin %s: %s", p.path, err)
+		p.delay = maxRestartDelay
+		time.AfterFunc(p.delay, p.restart)
+	}
+}
+
+// call calls a method of the plugin, giving up when the context is done
+func (p *process) call(ctx context.Context, method string, args interface{},
+	reply interface{}) error {
+	p.mutex.Lock()
+	client := p.client
+	p.mutex.Unlock()
+	if client == nil {
+		return fmt.Errorf("plugin %s is not running", p.path)
+	}
+
+	c := client.Go(serviceName+"."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		return c.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops the plugin, giving it until the context is done to finish
+// calls in progress and shut down its handlers before it is killed
+func (p *process) Shutdown(ctx context.Context) error {
+	p.mutex.Lock()
+	p.closed = true
+	cmd, client, exited := p.cmd, p.client, p.exited
+	p.cmd, p.client = nil, nil
+	p.mutex.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+	// Plugins exit when their input is closed
+	client.Close()
+	select {
+	case <-exited:
+		return nil
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		return fmt.Errorf("plugin %s did not exit in time and was killed", p.path)
+	}
+}
+
+// Close stops the plugin like Shutdown, giving it stopTimeout to exit
+func (p *process) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	return p.Shutdown(ctx)
+}
+
+// configure sends the plugin its section of the configuration file
+func (p *process) configure(conf interface{}) error {
+	p.mutex.Lock()
+	p.config = conf
+	p.mutex.Unlock()
+	return p.call(context.Background(), "Configure", ConfigureArgs{conf}, &Empty{})
+}
+
+// serverOptions are the handler options that only the server uses, since it
+// checks them before sending submissions to the plugin. They are not sent to
+// the plugin, because they include the server's secret.
+var serverOptions = []string{handler.LabelSecret, handler.LabelTimeTrap,
+	handler.LabelRequireToken, handler.LabelProofOfWork, handler.LabelCaptcha}
+
+// pluginConfig returns the handler configuration without serverOptions
+func pluginConfig(conf interface{}) interface{} {
+	m, ok := conf.(map[string]interface{})
+	if !ok {
+		return conf
+	}
+	c := make(map[string]interface{}, len(m))
+	for key, value := range m {
+		c[key] = value
+	}
+	for _, key := range serverOptions {
+		delete(c, key)
+	}
+	return c
+}
+
+// newHandler creates a handler with the given configuration
+func (p *process) newHandler(conf interface{}) (handler.Handler, error) {
+	h := &Handler{process: p}
+	if err := h.Unmarshal(conf); err != nil {
+		return nil, err
+	}
+	conf = pluginConfig(conf)
+
+	// Remember the handler before creating it, so that it is recreated if
+	// the plugin restarts in the meantime
+	p.mutex.Lock()
+	p.nextID++
+	h.id = strconv.Itoa(p.nextID)
+	if p.handlers == nil {
+		p.handlers = make(map[string]interface{})
+	}
+	p.handlers[h.id] = conf
+	p.mutex.Unlock()
+
+	err := p.call(context.Background(), "NewHandler",
+		NewHandlerArgs{ID: h.id, Config: conf}, &Empty{})
+	if err != nil {
+		p.mutex.Lock()
+		delete(p.handlers, h.id)
+		p.mutex.Unlock()
+		return nil, err
+	}
+	return h, nil
+}
+
+// Load starts the plugin executable at the given path and returns it as a
+// handler.Plugin. The plugin is restarted if it exits, until it is closed.
+func Load(path string, logger *log.Logger) (*handler.Plugin, error) {
+	p := &process{path: path, logger: logger}
+	p.mutex.Lock()
+	err := p.start()
+	p.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &handler.Plugin{
+		NewHandler: p.newHandler,
+		Configure:  p.configure,
+		Metadata:   p.metadata,
+		Close:      p.Close,
+		Shutdown:   p.Shutdown}, nil
+}
+
+// IsPlugin returns whether the file at the given path can be run as a
+// plugin, which is when it is a regular file that is executable
+func IsPlugin(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0
+}
+
+// Handler is a handler running in a plugin. Its options common to all
+// handlers are checked by the server, so only submissions it should handle
+// are sent to the plugin.
+type Handler struct {
+	handler.Base
+	process *process
+	id      string
+}
+
+// newRequest serializes the submission to send it to the plugin
+func newRequest(id string, req *http.Request) (*Request, error) {
+	r := &Request{
+		Handler:      id,
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		Host:         req.Host,
+		RemoteAddr:   req.RemoteAddr,
+		Header:       req.Header,
+		Form:         req.Form,
+		PostForm:     req.PostForm,
+		SubmissionID: handler.SubmissionID(req),
+		ClientIP:     handler.ClientIP(req)}
+	if deadline, ok := req.Context().Deadline(); ok {
+		r.Deadline = deadline
+	}
+
+	if req.MultipartForm == nil {
+		return r, nil
+	}
+	r.Files = make(map[string][]File)
+	for field, files := range req.MultipartForm.File {
+		for _, fh := range files {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, err
+			}
+			content, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			r.Files[field] = append(r.Files[field], File{
+				Filename: fh.Filename,
+				Header:   fh.Header,
+				Content:  content})
+		}
+	}
+	return r, nil
+}
+
+// Handle sends the submission to the plugin
+func (h *Handler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	r, err := newRequest(h.id, req)
+	if err != nil {
+		ch <- e.NewHTTPError(err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reply := HandleReply{}
+	err = h.process.call(req.Context(), "Handle", r, &reply)
+	if err == context.DeadlineExceeded {
+		ch <- e.NewHTTPError("plugin took too long to respond",
+			http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
+		// The path is only logged, since the error is shown to the client
+		h.process.logger.Errorf("Plugin %s failed to handle submission %s: %s",
+			h.process.path, handler.SubmissionID(req), err)
+		ch <- e.NewHTTPError("plugin failed to handle the submission",
+			http.StatusBadGateway)
+		return
+	}
+
+	if reply.Status != 0 {
+		httpErr := e.NewCodedError(reply.Code, reply.Message, reply.Status)
+		for field, msg := range reply.Fields {
+			httpErr.AddFieldError(field, msg)
+		}
+		ch <- httpErr
+	}
+}
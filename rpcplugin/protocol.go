@@ -0,0 +1,85 @@
+// Package rpcplugin runs handler plugins as separate processes that the
+// server talks to with JSON-RPC over the plugin's standard input and output.
+// Unlike plugins loaded with Go's plugin package, they do not have to be
+// built with exactly the same toolchain and dependencies as the server.
+//
+// A plugin is an executable whose main function calls Serve. It must not
+// write anything else to its standard output; its standard error is logged
+// by the server.
+package rpcplugin
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"time"
+
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+// ProtocolVersion is the version of the protocol spoken between the server
+// and its plugins. The server refuses plugins speaking another version.
+const ProtocolVersion = 1
+
+// serviceName is the name that the plugin's methods are registered under
+const serviceName = "Plugin"
+
+// HandshakeArgs is sent by the server when it starts a plugin
+type HandshakeArgs struct {
+	Version int
+}
+
+// HandshakeReply is the plugin's answer to a handshake
+type HandshakeReply struct {
+	Version  int
+	Metadata handler.Metadata
+}
+
+// ConfigureArgs holds the plugin's section of the configuration file
+type ConfigureArgs struct {
+	Config interface{}
+}
+
+// NewHandlerArgs holds the configuration of a handler to create. The ID is
+// used to refer to the handler in later calls.
+type NewHandlerArgs struct {
+	ID     string
+	Config interface{}
+}
+
+// Empty is the reply to calls that return nothing but an error
+type Empty struct{}
+
+// File is a file uploaded with a submission
+type File struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Content  []byte
+}
+
+// Request is a form submission sent to a handler. The form has already been
+// parsed by the server.
+type Request struct {
+	Handler      string
+	Method       string
+	URL          string
+	Host         string
+	RemoteAddr   string
+	Header       http.Header
+	Form         url.Values
+	PostForm     url.Values
+	Files        map[string][]File
+	SubmissionID string
+	ClientIP     string
+	// Deadline is when the server stops waiting for the handler
+	Deadline time.Time
+}
+
+// HandleReply is the result of handling a submission. A Status of zero
+// means the submission was handled successfully.
+type HandleReply struct {
+	Status  int
+	Message string
+	Code    string
+	Fields  map[string]string
+}
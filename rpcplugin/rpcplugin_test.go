@@ -0,0 +1,201 @@
+package rpcplugin
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+	"gitlab.com/BluestNight/nebula-forms/log"
+)
+
+// pluginEnv makes the test binary run as a plugin when set
+const pluginEnv = "NEBULA_TEST_PLUGIN"
+
+// testHandler answers with the configured greeting, which shows that the
+// configuration reached the plugin
+type testHandler struct {
+	handler.Base
+	greeting string
+}
+
+var configured string
+
+func (h *testHandler) Handle(req *http.Request, ch chan *e.HTTPError, wg *sync.WaitGroup) {
+	defer wg.Done()
+	switch req.FormValue("action") {
+	case "crash":
+		os.Exit(1)
+	case "file":
+		f, _, err := req.FormFile("upload")
+		if err != nil {
+			ch <- e.NewHTTPError(err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		buf := &bytes.Buffer{}
+		buf.ReadFrom(f)
+		ch <- e.NewHTTPError(buf.String(), http.StatusTeapot)
+	default:
+		err := e.NewCodedError("greeting", fmt.Sprintf("%s %s from %s",
+			configured, h.greeting, handler.ClientIP(req)), http.StatusTeapot)
+		err.AddFieldError("name", req.FormValue("name"))
+		ch <- err
+	}
+}
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(pluginEnv) {
+	case "":
+		os.Exit(m.Run())
+	case "hang":
+		// Never answer the handshake
+		time.Sleep(time.Hour)
+		os.Exit(1)
+	}
+
+	err := Serve(handler.Factory{
+		Configure: func(conf interface{}) error {
+			configured = fmt.Sprint(conf)
+			return nil
+		},
+		NewHandler: func(conf interface{}) (handler.Handler, error) {
+			if _, ok := conf.(map[string]interface{})[handler.LabelSecret]; ok {
+				return nil, fmt.Errorf("plugin received the server's secret")
+			}
+			h := &testHandler{greeting: fmt.Sprint(conf.(map[string]interface{})["greeting"])}
+			return h, h.Unmarshal(conf)
+		},
+		Metadata: handler.Metadata{Name: "greeter", Version: "0.1.0"}})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// handle runs the handler on a submission and returns its error
+func handle(h handler.Handler, req *http.Request) *e.HTTPError {
+	ch := make(chan *e.HTTPError, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	h.Handle(req, ch, &wg)
+	close(ch)
+	return <-ch
+}
+
+func formRequest(t *testing.T, body url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/test",
+		strings.NewReader(body.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	req, sub, err := handler.NewSubmission(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.ClientIP = "192.0.2.1"
+	return req
+}
+
+func TestLoad(t *testing.T) {
+	os.Setenv(pluginEnv, "1")
+	defer os.Unsetenv(pluginEnv)
+
+	p, err := Load(os.Args[0], &log.Logger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if p.Metadata.Name != "greeter" || p.Metadata.Version != "0.1.0" {
+		t.Errorf("Unexpected metadata from handshake: %#v", p.Metadata)
+	}
+
+	if err = p.Configure("hello"); err != nil {
+		t.Fatal(err)
+	}
+	h, err := p.NewHandler(map[string]interface{}{
+		handler.LabelAllowedOrigins: []interface{}{"*"},
+		handler.LabelSecret:         "s3cret",
+		"greeting":                  "world"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := handle(h, formRequest(t, url.Values{"name": {"Joe"}}))
+	if res == nil || res.Status() != http.StatusTeapot || res.Code() != "greeting" ||
+		res.Error() != "hello world from 192.0.2.1" || res.FieldErrors()["name"] != "Joe" {
+		t.Errorf("Unexpected result from plugin: %#v", res)
+	}
+
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	w.WriteField("action", "file")
+	f, _ := w.CreateFormFile("upload", "upload.txt")
+	f.Write([]byte("file contents"))
+	w.Close()
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/test", buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if err := req.ParseMultipartForm(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	if err := handle(h, req); err == nil || err.Error() != "file contents" {
+		t.Errorf("Uploaded file should reach the plugin, got %#v", err)
+	}
+
+	// The plugin is restarted with its configuration and handlers after
+	// crashing
+	if err := handle(h, formRequest(t, url.Values{"action": {"crash"}})); err == nil ||
+		err.Status() != http.StatusBadGateway {
+		t.Errorf("Expected status 502 after the plugin crashed, got %#v", err)
+	} else if strings.Contains(err.Error(), os.Args[0]) {
+		t.Errorf("Error shown to the client should not contain the plugin's path: %s",
+			err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res = handle(h, formRequest(t, url.Values{"name": {"Joe"}}))
+		if res != nil && res.Status() == http.StatusTeapot {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Plugin was not restarted, got %#v", res)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if res.Error() != "hello world from 192.0.2.1" {
+		t.Errorf("Restarted plugin should be configured again, got %s", res)
+	}
+}
+
+func TestLoad_Timeout(t *testing.T) {
+	os.Setenv(pluginEnv, "hang")
+	defer os.Unsetenv(pluginEnv)
+
+	done := make(chan error, 1)
+	go func() {
+		p, err := Load(os.Args[0], &log.Logger{})
+		if p != nil {
+			p.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("Loading a plugin that does not answer should fail")
+		}
+	case <-time.After(startTimeout + 5*time.Second):
+		t.Fatal("Loading a plugin that does not answer should time out")
+	}
+}
@@ -0,0 +1,207 @@
+package rpcplugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"os"
+	"sync"
+
+	e "gitlab.com/BluestNight/nebula-forms/errors"
+	"gitlab.com/BluestNight/nebula-forms/handler"
+)
+
+// maxFormMemory is the number of bytes of uploaded files kept in memory
+// when recreating a submission. Larger files are stored in temporary files.
+const maxFormMemory = int64(1 << 20) // 1 MiB
+
+// server answers the calls made by the server to the plugin
+type server struct {
+	metadata handler.Metadata
+	plugin   *handler.Plugin
+
+	mutex    sync.RWMutex
+	handlers map[string]handler.Handler
+}
+
+// Handshake checks that the server speaks the same protocol version
+func (s *server) Handshake(args HandshakeArgs, reply *HandshakeReply) error {
+	reply.Version = ProtocolVersion
+	reply.Metadata = s.metadata
+	return nil
+}
+
+// Configure configures the plugin
+func (s *server) Configure(args ConfigureArgs, reply *Empty) error {
+	if s.plugin.Configure == nil {
+		return nil
+	}
+	return s.plugin.Configure(args.Config)
+}
+
+// NewHandler creates a handler and stores it under the given ID
+func (s *server) NewHandler(args NewHandlerArgs, reply *Empty) error {
+	h, err := s.plugin.NewHandler(args.Config)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.handlers[args.ID] = h
+	s.mutex.Unlock()
+	return nil
+}
+
+// Request recreates the submission sent by the server as an *http.Request
+func (r *Request) Request() (*http.Request, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method:     r.Method,
+		URL:        u,
+		Host:       r.Host,
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+		Form:       r.Form,
+		PostForm:   r.PostForm,
+		Body:       http.NoBody}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+
+	if len(r.Files) > 0 {
+		// File headers can only be created by parsing a multipart body
+		buf := &bytes.Buffer{}
+		w := multipart.NewWriter(buf)
+		for field, files := range r.Files {
+			for _, f := range files {
+				header := f.Header
+				if header == nil {
+					header = make(map[string][]string)
+				}
+				header.Set("Content-Disposition", fmt.Sprintf(
+					`form-data; name="%s"; filename="%s"`, field, f.Filename))
+				part, err := w.CreatePart(header)
+				if err != nil {
+					return nil, err
+				}
+				part.Write(f.Content)
+			}
+		}
+		w.Close()
+
+		req.MultipartForm, err = multipart.NewReader(buf, w.Boundary()).
+			ReadForm(maxFormMemory)
+		if err != nil {
+			return nil, err
+		}
+		req.MultipartForm.Value = r.PostForm
+	}
+
+	return handler.WithSubmission(req, &handler.Submission{
+		ID:       r.SubmissionID,
+		ClientIP: r.ClientIP}), nil
+}
+
+// Handle handles a submission with the handler it was sent to
+func (s *server) Handle(args Request, reply *HandleReply) error {
+	s.mutex.RLock()
+	h := s.handlers[args.Handler]
+	s.mutex.RUnlock()
+	if h == nil {
+		return fmt.Errorf("no handler with ID %s", args.Handler)
+	}
+
+	req, err := args.Request()
+	if err != nil {
+		return err
+	}
+	if req.MultipartForm != nil {
+		defer req.MultipartForm.RemoveAll()
+	}
+	if !args.Deadline.IsZero() {
+		ctx, cancel := context.WithDeadline(req.Context(), args.Deadline)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	ch := make(chan *e.HTTPError, 1)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go h.Handle(req, ch, &wg)
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	for err := range ch {
+		if err != nil && reply.Status == 0 {
+			reply.Status = err.Status()
+			reply.Message = err.Error()
+			reply.Code = err.Code()
+			reply.Fields = err.FieldErrors()
+		}
+	}
+	return nil
+}
+
+// shutdown releases the resources of the handlers and of the plugin, once
+// the server has closed the connection
+func (s *server) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, h := range s.handlers {
+		if err := handler.Shutdown(ctx, h); err != nil {
+			fmt.Fprintf(os.Stderr, "Error while shutting down handler %s: %s\n",
+				id, err)
+		}
+	}
+	if err := handler.Shutdown(ctx, s.plugin); err != nil {
+		fmt.Fprintf(os.Stderr, "Error while shutting down: %s\n", err)
+	}
+}
+
+// ServeConn answers calls from the server on the given connection until it
+// is closed, then shuts down the handlers. Most plugins use Serve instead.
+func ServeConn(conn io.ReadWriteCloser, f handler.Factory) error {
+	srv := &server{
+		metadata: f.Metadata,
+		plugin:   &handler.Plugin{NewHandler: f.NewHandler, Configure: f.Configure},
+		handlers: make(map[string]handler.Handler)}
+	if f.New != nil {
+		srv.plugin = f.New()
+	}
+	if srv.plugin.NewHandler == nil {
+		return fmt.Errorf("plugin has no NewHandler function")
+	}
+
+	s := rpc.NewServer()
+	if err := s.RegisterName(serviceName, srv); err != nil {
+		return err
+	}
+	s.ServeCodec(jsonrpc.NewServerCodec(conn))
+	srv.shutdown()
+	return nil
+}
+
+// Serve answers calls from the server on standard input and output until
+// the server closes them, using the same functions and metadata that a
+// handler type registered with handler.Register has. Configure may be nil.
+// The handlers and the Plugin returned by the factory's New function are
+// shut down before Serve returns, within the time the server waits for the
+// plugin to exit.
+func Serve(f handler.Factory) error {
+	return ServeConn(stdio{os.Stdin, os.Stdout}, f)
+}
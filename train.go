@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gitlab.com/BluestNight/nebula-forms/bayes"
+)
+
+// pathList is a flag that can be given more than once
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ", ")
+}
+
+func (p *pathList) Set(path string) error {
+	*p = append(*p, path)
+	return nil
+}
+
+// train runs the train command with the given arguments, returning the exit
+// code. It adds exported submissions to a spam filter model, creating the
+// model if it does not exist yet.
+func train(args []string) int {
+	flags := flag.NewFlagSet("train", flag.ContinueOnError)
+	model := flags.String("model", "", "the model file to train")
+	var spam, ham pathList
+	flags.Var(&spam, "spam",
+		"a file or directory of submissions to train as spam (repeatable)")
+	flags.Var(&ham, "ham",
+		"a file or directory of submissions to train as ham (repeatable)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s train -model FILE [-spam PATH]... [-ham PATH]...\n\n",
+			os.Args[0])
+		fmt.Fprint(os.Stderr, "Files ending in .jsonl hold one submission per line, "+
+			"files ending in .json hold one submission or a list of them, and "+
+			"other files hold the text of one submission.\n\n")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *model == "" || len(spam)+len(ham) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	m, err := bayes.Load(*model)
+	if os.IsNotExist(err) {
+		m = bayes.New()
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading model %s: %s\n", *model, err)
+		return 1
+	}
+
+	classes := []struct {
+		class string
+		paths pathList
+	}{{bayes.Spam, spam}, {bayes.Ham, ham}}
+	for _, c := range classes {
+		for _, path := range c.paths {
+			n, err := m.TrainPath(c.class, path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error training %s as %s: %s\n",
+					path, c.class, err)
+				return 1
+			}
+			fmt.Printf("Trained %d submissions from %s as %s\n", n, path, c.class)
+		}
+	}
+
+	if err = m.Save(*model); err != nil {
+		fmt.Fprintf(os.Stderr, "Error saving model %s: %s\n", *model, err)
+		return 1
+	}
+	fmt.Printf("Model %s now has %d spam and %d ham submissions. "+
+		"Reload the server to use it.\n", *model, m.SpamDocs, m.HamDocs)
+	return 0
+}